@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/fs"
+	"github.com/llklkl/webdav/internal/model"
+	"github.com/llklkl/webdav/internal/server"
+)
+
+var explainCmd = &cobra.Command{
+	Use:   "explain PATH",
+	Short: "Explain whether a user is allowed to access a path, and why.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		confPath, _ := cmd.Flags().GetString("conf")
+		username, _ := cmd.Flags().GetString("user")
+		groups, _ := cmd.Flags().GetStringSlice("group")
+		anonymous, _ := cmd.Flags().GetBool("anonymous")
+		method, _ := cmd.Flags().GetString("method")
+
+		cfg, err := conf.Parse(confPath)
+		if err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+		method = strings.ToUpper(method)
+		needPerm, ok := fs.MethodPerm(method)
+		if !ok {
+			cmd.PrintErrf("unsupported method[%s]\n", method)
+			return
+		}
+		// the scopes of [[user]] only apply to the users it configures
+		local := slices.ContainsFunc(cfg.User, func(u *conf.UserConf) bool { return u.Username == username })
+		user := &model.User{Username: username, Groups: groups, Local: local}
+		if anonymous {
+			if cfg.Anonymous == nil {
+				cmd.PrintErrln("anonymous access is not configured")
+				return
+			}
+			user = &model.User{Username: "anonymous", Scope: cfg.Anonymous.Scope, ReadOnly: true, Anonymous: true}
+		} else if username == "" {
+			cmd.PrintErrln("either --user or --anonymous is required")
+			return
+		}
+		lib, name, ok := server.MatchLibrary(cfg, user.Username, args[0])
+		if !ok {
+			cmd.PrintErrf("no library serves %s\n", args[0])
+			return
+		}
+
+		out := cmd.OutOrStdout()
+		fmt.Fprintf(out, "library:  %s (prefix %s, mount point %s)\n", lib.Name, lib.Prefix, lib.MountPoint)
+		fmt.Fprintf(out, "path:     %s\n", name)
+		fmt.Fprintf(out, "user:     %s\n", user.Username)
+		fmt.Fprintf(out, "required: %s (%s)\n", needPerm.String(), method)
+
+		ctx := model.SetUser(context.Background(), user)
+		allowed, steps := fs.NewFs(cfg, lib, fs.Options{}).Explain(ctx, name, needPerm)
+		if len(steps) == 0 {
+			fmt.Fprintln(out, "no scope of the library is granted to the user")
+		}
+		for _, step := range steps {
+			fmt.Fprintf(out, "  %s\n", step.String())
+		}
+		if lib.DenyPrecedence {
+			fmt.Fprintln(out, "deny precedence is enabled")
+		}
+		if allowed {
+			fmt.Fprintln(out, "decision: allow")
+		} else {
+			fmt.Fprintln(out, "decision: deny")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(explainCmd)
+	explainCmd.Flags().StringP("conf", "c", "", "path to configure file")
+	explainCmd.Flags().StringP("user", "u", "", "username")
+	explainCmd.Flags().StringSlice("group", nil, "groups reported by the authentication provider, e.g. LDAP groups")
+	explainCmd.Flags().Bool("anonymous", false, "explain for the anonymous user")
+	explainCmd.Flags().StringP("method", "X", "GET", "WebDAV method")
+	explainCmd.MarkFlagRequired("conf")
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	"github.com/llklkl/webdav/internal/password"
+)
+
+var hashPasswordCmd = &cobra.Command{
+	Use:   "hash-password [password]",
+	Short: "Hash a password for the credential of a user.",
+	Long: `Hash a password for the credential of a user.
+The password is read from the terminal (or stdin) when it is not given as an argument.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		algo, _ := cmd.Flags().GetString("algo")
+
+		var pwd string
+		var err error
+		if len(args) > 0 {
+			pwd = args[0]
+		} else {
+			pwd, err = readPassword(cmd)
+			if err != nil {
+				cmd.PrintErrln(err)
+				return
+			}
+		}
+
+		hash, err := password.Hash(password.Algorithm(algo), pwd)
+		if err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+
+		fmt.Fprintln(cmd.OutOrStdout(), hash)
+	},
+}
+
+func readPassword(cmd *cobra.Command) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("read password error: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	cmd.PrintErr("Password: ")
+	first, err := term.ReadPassword(fd)
+	cmd.PrintErrln()
+	if err != nil {
+		return "", fmt.Errorf("read password error: %w", err)
+	}
+	cmd.PrintErr("Confirm password: ")
+	second, err := term.ReadPassword(fd)
+	cmd.PrintErrln()
+	if err != nil {
+		return "", fmt.Errorf("read password error: %w", err)
+	}
+	if string(first) != string(second) {
+		return "", errors.New("passwords do not match")
+	}
+
+	return string(first), nil
+}
+
+func init() {
+	rootCmd.AddCommand(hashPasswordCmd)
+	hashPasswordCmd.Flags().StringP("algo", "a", string(password.Argon2id), "hash algorithm, support: argon2id, bcrypt, scrypt")
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/lock"
+)
+
+var lockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Inspect and remove the WebDAV locks.",
+}
+
+var lockListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the locks.",
+	Run: func(cmd *cobra.Command, args []string) {
+		library, _ := cmd.Flags().GetString("library")
+
+		store, err := openLockStore(cmd)
+		if err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "LIBRARY\tUSER\tPATH\tDEPTH\tCREATED\tEXPIRES\tTOKEN")
+		for _, l := range store.List() {
+			if library != "" && l.Library != library {
+				continue
+			}
+			depth := "infinity"
+			if l.ZeroDepth {
+				depth = "0"
+			}
+			expires := "never"
+			if !l.ExpiresAt.IsZero() {
+				expires = l.ExpiresAt.Local().Format(time.DateTime)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", l.Library, l.User, l.Root, depth,
+				l.CreatedAt.Local().Format(time.DateTime), expires, l.Token)
+		}
+		_ = w.Flush()
+	},
+}
+
+var lockUnlockCmd = &cobra.Command{
+	Use:   "unlock [TOKEN...]",
+	Short: "Remove locks by token, or all locks at or below a path of a library.",
+	Run: func(cmd *cobra.Command, args []string) {
+		library, _ := cmd.Flags().GetString("library")
+		user, _ := cmd.Flags().GetString("user")
+		root, _ := cmd.Flags().GetString("path")
+		if len(args) == 0 && (library == "" || root == "") {
+			cmd.PrintErrln("specify the tokens, or --library and --path")
+			return
+		}
+
+		store, err := openLockStore(cmd)
+		if err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+		tokens := args
+		if len(tokens) == 0 {
+			root = path.Clean("/" + root)
+			for _, l := range store.List() {
+				if l.Library != library || (user != "" && l.User != user) {
+					continue
+				}
+				if root == "/" || l.Root == root || strings.HasPrefix(l.Root, root+"/") {
+					tokens = append(tokens, l.Token)
+				}
+			}
+		}
+
+		for _, token := range tokens {
+			if err := store.Unlock(token); err != nil {
+				cmd.PrintErrf("unlock %s error: %v\n", token, err)
+				continue
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "unlocked %s\n", token)
+		}
+	},
+}
+
+func openLockStore(cmd *cobra.Command) (*lock.Store, error) {
+	confPath, _ := cmd.Flags().GetString("conf")
+	cfg, err := conf.Parse(confPath)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Lock == nil {
+		return nil, errors.New("[lock] is not configured")
+	}
+
+	return lock.OpenStore(cfg.Lock.Path)
+}
+
+func init() {
+	rootCmd.AddCommand(lockCmd)
+	lockCmd.AddCommand(lockListCmd, lockUnlockCmd)
+	lockCmd.PersistentFlags().StringP("conf", "c", "", "path to configure file")
+	lockCmd.MarkPersistentFlagRequired("conf")
+
+	lockListCmd.Flags().StringP("library", "l", "", "only list the locks of the library")
+
+	lockUnlockCmd.Flags().StringP("library", "l", "", "library of the path")
+	lockUnlockCmd.Flags().StringP("user", "u", "", "only remove the locks of the user, for the libraries of each user")
+	lockUnlockCmd.Flags().StringP("path", "p", "", "remove the locks at or below the path")
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/auth"
+)
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage the app tokens of users.",
+}
+
+var tokenCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create an app token for a user, the token is only shown once.",
+	Run: func(cmd *cobra.Command, args []string) {
+		username, _ := cmd.Flags().GetString("user")
+		name, _ := cmd.Flags().GetString("name")
+		scope, _ := cmd.Flags().GetStringSlice("scope")
+		readOnly, _ := cmd.Flags().GetBool("read-only")
+		expire, _ := cmd.Flags().GetDuration("expire")
+
+		cfg, store, err := openTokenStore(cmd)
+		if err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+		if !slices.ContainsFunc(cfg.User, func(u *conf.UserConf) bool { return u.Username == username }) {
+			cmd.PrintErrf("user[%s] not found\n", username)
+			return
+		}
+		userScope := conf.UserScope(cfg, username)
+		for _, s := range scope {
+			if !slices.Contains(userScope, s) {
+				cmd.PrintErrf("scope[%s] is not granted to user[%s]\n", s, username)
+				return
+			}
+		}
+		var expiresAt time.Time
+		if expire > 0 {
+			expiresAt = time.Now().Add(expire).UTC().Truncate(time.Second)
+		}
+
+		token, err := store.Create(username, name, scope, readOnly, expiresAt)
+		if err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), token)
+	},
+}
+
+var tokenListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the app tokens.",
+	Run: func(cmd *cobra.Command, args []string) {
+		username, _ := cmd.Flags().GetString("user")
+
+		_, store, err := openTokenStore(cmd)
+		if err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+		users := store.Users()
+		if username != "" {
+			users = []string{username}
+		}
+
+		now := time.Now()
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "USER\tNAME\tSCOPE\tREAD ONLY\tCREATED\tEXPIRES")
+		for _, u := range users {
+			for _, t := range store.List(u) {
+				scope := "*"
+				if len(t.Scope) > 0 {
+					scope = strings.Join(t.Scope, ",")
+				}
+				expires := "never"
+				if !t.ExpiresAt.IsZero() {
+					expires = t.ExpiresAt.Local().Format(time.DateTime)
+					if t.Expired(now) {
+						expires += " (expired)"
+					}
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\t%s\n", u, t.Name, scope, t.ReadOnly,
+					t.CreatedAt.Local().Format(time.DateTime), expires)
+			}
+		}
+		_ = w.Flush()
+	},
+}
+
+var tokenRevokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "Revoke an app token of a user.",
+	Run: func(cmd *cobra.Command, args []string) {
+		username, _ := cmd.Flags().GetString("user")
+		name, _ := cmd.Flags().GetString("name")
+
+		_, store, err := openTokenStore(cmd)
+		if err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+		if err := store.Revoke(username, name); err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+		cmd.Println("ok")
+	},
+}
+
+func openTokenStore(cmd *cobra.Command) (*conf.Conf, *auth.TokenStore, error) {
+	confPath, _ := cmd.Flags().GetString("conf")
+	cfg, err := conf.Parse(confPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.Auth.Token == nil {
+		return nil, nil, errors.New("[auth.token] is not configured")
+	}
+	store, err := auth.OpenTokenStore(cfg.Auth.Token.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cfg, store, nil
+}
+
+func init() {
+	rootCmd.AddCommand(tokenCmd)
+	tokenCmd.AddCommand(tokenCreateCmd, tokenListCmd, tokenRevokeCmd)
+	tokenCmd.PersistentFlags().StringP("conf", "c", "", "path to configure file")
+	tokenCmd.MarkPersistentFlagRequired("conf")
+
+	tokenCreateCmd.Flags().StringP("user", "u", "", "username")
+	tokenCreateCmd.Flags().StringP("name", "n", "", "name of the token")
+	tokenCreateCmd.Flags().StringSlice("scope", nil, "restrict the token to these scopes of the user, default: all")
+	tokenCreateCmd.Flags().Bool("read-only", false, "restrict the token to read only access")
+	tokenCreateCmd.Flags().Duration("expire", 0, "expire the token after the duration, default: never")
+	tokenCreateCmd.MarkFlagRequired("user")
+	tokenCreateCmd.MarkFlagRequired("name")
+
+	tokenListCmd.Flags().StringP("user", "u", "", "only list the tokens of the user")
+
+	tokenRevokeCmd.Flags().StringP("user", "u", "", "username")
+	tokenRevokeCmd.Flags().StringP("name", "n", "", "name of the token")
+	tokenRevokeCmd.MarkFlagRequired("user")
+	tokenRevokeCmd.MarkFlagRequired("name")
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/fs"
+	"github.com/llklkl/webdav/internal/model"
+	"github.com/llklkl/webdav/internal/props"
+	"github.com/llklkl/webdav/internal/server"
+	"github.com/llklkl/webdav/internal/trash"
+)
+
+var trashCmd = &cobra.Command{
+	Use:   "trash",
+	Short: "List, restore and purge the deleted files of a library.",
+}
+
+var trashListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the items of the trash, the latest first.",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, bin, err := openBin(cmd)
+		if err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+		items, err := bin.List(ctx)
+		if err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSER\tDELETED\tREASON\tPATH")
+		for _, item := range items {
+			reason := "delete"
+			if item.Overwritten {
+				reason = "overwrite"
+			}
+			name := item.Path
+			if item.IsDir {
+				name += "/"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", item.ID, item.User,
+				item.DeletedAt.Local().Format(time.DateTime), reason, name)
+		}
+		_ = w.Flush()
+	},
+}
+
+var trashRestoreCmd = &cobra.Command{
+	Use:   "restore ID...",
+	Short: "Restore the items to their original paths, or to another path.",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		to, _ := cmd.Flags().GetString("to")
+		if to != "" && len(args) > 1 {
+			cmd.PrintErrln("--to requires a single item")
+			return
+		}
+
+		ctx, bin, err := openBin(cmd)
+		if err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+		for _, id := range args {
+			item, err := bin.Get(ctx, id)
+			if err == nil {
+				err = bin.Restore(ctx, item, to)
+			}
+			if err != nil {
+				cmd.PrintErrf("restore %s error: %v\n", id, err)
+				continue
+			}
+			dest := to
+			if dest == "" {
+				dest = item.Path
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "restored %s to %s\n", id, dest)
+		}
+	},
+}
+
+var trashPurgeCmd = &cobra.Command{
+	Use:   "purge [ID...]",
+	Short: "Remove the items permanently.",
+	Run: func(cmd *cobra.Command, args []string) {
+		all, _ := cmd.Flags().GetBool("all")
+		if len(args) == 0 && !all {
+			cmd.PrintErrln("specify the ids, or --all")
+			return
+		}
+
+		ctx, bin, err := openBin(cmd)
+		if err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+		ids := args
+		if len(ids) == 0 {
+			items, err := bin.List(ctx)
+			if err != nil {
+				cmd.PrintErrln(err)
+				return
+			}
+			for _, item := range items {
+				ids = append(ids, item.ID)
+			}
+		}
+		for _, id := range ids {
+			if err := bin.Purge(ctx, id); err != nil {
+				cmd.PrintErrf("purge %s error: %v\n", id, err)
+				continue
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "purged %s\n", id)
+		}
+	},
+}
+
+// openBin opens the trash of the library, of the user for the libraries of
+// each user.
+func openBin(cmd *cobra.Command) (context.Context, *trash.Bin, error) {
+	confPath, _ := cmd.Flags().GetString("conf")
+	name, _ := cmd.Flags().GetString("library")
+	username, _ := cmd.Flags().GetString("user")
+
+	cfg, err := conf.Parse(confPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	var lib *conf.LibraryConf
+	for _, l := range cfg.Library {
+		if l.Name == name {
+			lib = l
+		}
+	}
+	if lib == nil {
+		return nil, nil, fmt.Errorf("library[%s] is not found", name)
+	}
+	if lib.Backend == conf.BackendMemory {
+		return nil, nil, errors.New("the files of a memory library are only in the server")
+	}
+	if conf.IsTemplate(lib.MountPoint) && username == "" {
+		return nil, nil, errors.New("--user is required by the libraries of each user")
+	}
+
+	deadProps, err := props.New(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	storage, err := server.NewStorage(lib)
+	if err != nil {
+		return nil, nil, err
+	}
+	cipher, err := server.NewCipher(lib)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx := model.SetUser(context.Background(), &model.User{Username: username})
+	bin, err := fs.NewFs(cfg, lib, fs.Options{Props: deadProps, Storage: storage, Cipher: cipher}).Bin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ctx, bin, nil
+}
+
+func init() {
+	rootCmd.AddCommand(trashCmd)
+	trashCmd.AddCommand(trashListCmd, trashRestoreCmd, trashPurgeCmd)
+	trashCmd.PersistentFlags().StringP("conf", "c", "", "path to configure file")
+	trashCmd.PersistentFlags().StringP("library", "l", "", "library of the trash")
+	trashCmd.PersistentFlags().StringP("user", "u", "", "owner of the trash, for the libraries of each user")
+	trashCmd.MarkPersistentFlagRequired("conf")
+	trashCmd.MarkPersistentFlagRequired("library")
+
+	trashRestoreCmd.Flags().String("to", "", "restore to the path instead of the original path")
+	trashPurgeCmd.Flags().Bool("all", false, "purge all items")
+}
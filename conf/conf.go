@@ -24,13 +24,23 @@
 package conf
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
 	"net/url"
+	"path"
 	"path/filepath"
 	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/llklkl/webdav/internal/glob"
+	"github.com/llklkl/webdav/internal/password"
 )
 
 type Conf struct {
@@ -42,18 +52,171 @@ type Conf struct {
 	TlsCertPem     string `toml:"tls_cert_pem"`
 	TlsKeyPemPath  string `toml:"tls_key_pem_path"`
 	TlsCertPemPath string `toml:"tls_cert_pem_path"`
+	// client certificates: "" (ignored), request or require
+	TlsClientAuth    string `toml:"tls_client_auth"`
+	TlsClientCaPath  string `toml:"tls_client_ca_path"`
+	TlsClientCrlPath string `toml:"tls_client_crl_path"`
 
 	Library []*LibraryConf `toml:"library"`
 	Scope   []*ScopeConf   `toml:"scope"`
 	User    []*UserConf    `toml:"user"`
+	Group   []*GroupConf   `toml:"group"`
 
-	Security *SecurityConf `toml:"security"`
+	Security  *SecurityConf  `toml:"security"`
+	Auth      *AuthConf      `toml:"auth"`
+	Anonymous *AnonymousConf `toml:"anonymous"`
+	Quota     *QuotaConf     `toml:"quota"`
+	Lock      *LockConf      `toml:"lock"`
+	Props     *PropsConf     `toml:"props"`
 }
 
 type LibraryConf struct {
-	Name       string `toml:"name"`
+	Name string `toml:"name"`
+	// where the files are stored: local (default), s3, sftp or memory
+	Backend    string `toml:"backend"`
 	MountPoint string `toml:"mount_point"`
 	Prefix     string `toml:"prefix"`
+	// strip the prefix from the paths of the files, /webdav/x is stored as
+	// <mount point>/x rather than <mount point>/webdav/x, always with
+	// {username}
+	StripPrefix bool `toml:"strip_prefix"`
+	// a permission denied by any scope of the user is denied, even if another
+	// scope allows it
+	DenyPrecedence bool `toml:"deny_precedence"`
+	// mode of the directories created for the mount point with {username},
+	// default 0o700
+	CreateMode uint32 `toml:"create_mode"`
+	// bytes of the whole library, and of each user within the library
+	Quota      ByteSize        `toml:"quota"`
+	UserQuota  ByteSize        `toml:"user_quota"`
+	S3         *S3Conf         `toml:"s3"`
+	SFTP       *SFTPConf       `toml:"sftp"`
+	Memory     *MemoryConf     `toml:"memory"`
+	Trash      *TrashConf      `toml:"trash"`
+	Versions   *VersionsConf   `toml:"versions"`
+	Encryption *EncryptionConf `toml:"encryption"`
+	Union      *UnionConf      `toml:"union"`
+	Archive    *ArchiveConf    `toml:"archive"`
+}
+
+// ArchiveConf shows the zip, tar, tar.gz and tar.zst files of a library as
+// read only collections beside them.
+type ArchiveConf struct {
+	// the collection of an archive is named by the suffix, default "!", e.g.
+	// backup.zip!/
+	Suffix string `toml:"suffix"`
+	// the indexes of the recently used archives cached, default 64
+	Cache int `toml:"cache"`
+	// the members of the cached indexes in total, default 100000, an
+	// archive with more members is not browsable
+	Entries int `toml:"entries"`
+}
+
+// UnionConf stacks read only directories below the mount point of a library,
+// which is the writable upper layer.
+type UnionConf struct {
+	// the first directory has precedence
+	Lower []string `toml:"lower"`
+}
+
+// EncryptionConf encrypts the files of a library at rest, with the master key
+// in a file or derived from a passphrase.
+type EncryptionConf struct {
+	// file of the 32 bytes key, raw or hex encoded, e.g. by openssl rand -hex 32
+	KeyFile string `toml:"key_file"`
+	// the key is derived from the passphrase with argon2id when no key file
+	Passphrase string `toml:"passphrase"`
+	// salt of the passphrase, required with it, e.g. by openssl rand -hex 16
+	Salt string `toml:"salt"`
+	// encrypt the file names too, which limits a name to about 130 bytes
+	Names bool `toml:"names"`
+}
+
+// VersionsConf keeps the previous contents of the overwritten files of a
+// library in its .versions directory.
+type VersionsConf struct {
+	// the latest versions kept of each file, unlimited when 0
+	Keep int `toml:"keep"`
+	// the versions are removed after the age, never when 0
+	MaxAge time.Duration `toml:"max_age"`
+}
+
+// TrashConf keeps the deleted and overwritten files of a library in its
+// .trash directory, from which they can be restored.
+type TrashConf struct {
+	// the items are purged after the retention, default 30 days
+	Retention time.Duration `toml:"retention"`
+	// the users, and the members of the groups, who can see and restore the
+	// items deleted by all users
+	Admins      []string `toml:"admins"`
+	AdminGroups []string `toml:"admin_groups"`
+}
+
+// S3Conf is the bucket of a library with the s3 backend.
+type S3Conf struct {
+	// e.g. https://s3.amazonaws.com or http://127.0.0.1:9000
+	Endpoint string `toml:"endpoint"`
+	// default us-east-1
+	Region string `toml:"region"`
+	Bucket string `toml:"bucket"`
+	// the files of the library are stored under the prefix of the bucket
+	Prefix string `toml:"prefix"`
+	// use path-style requests instead of virtual-hosted-style, e.g. for MinIO
+	PathStyle bool `toml:"path_style"`
+	// the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables are
+	// used when empty
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+	// uploads larger than the part size use multipart upload, default 16MiB,
+	// at least 5MiB
+	PartSize ByteSize `toml:"part_size"`
+}
+
+// SFTPConf is the remote directory of a library with the sftp backend.
+type SFTPConf struct {
+	// host:port, the port is 22 when omitted
+	Address  string `toml:"address"`
+	Username string `toml:"username"`
+	// the user is authenticated by the private key and/or the password
+	Password             string `toml:"password"`
+	PrivateKeyPath       string `toml:"private_key_path"`
+	PrivateKeyPassphrase string `toml:"private_key_passphrase"`
+	// the pinned public key of the host in the authorized_keys format, or its
+	// SHA256 fingerprint, e.g. SHA256:...
+	HostKey string `toml:"host_key"`
+	// absolute path of the directory on the host
+	Root string `toml:"root"`
+	// connections to the host, default 4
+	MaxConns int `toml:"max_conns"`
+}
+
+// MemoryConf limits a library with the memory backend.
+type MemoryConf struct {
+	// bytes of the files, unlimited when 0
+	Size ByteSize `toml:"size"`
+	// the files which are not modified within the ttl are removed, never when 0
+	TTL time.Duration `toml:"ttl"`
+}
+
+const (
+	BackendLocal  = "local"
+	BackendS3     = "s3"
+	BackendSFTP   = "sftp"
+	BackendMemory = "memory"
+)
+
+// IsLocal reports whether the library is a directory of the local file
+// system.
+func (conf *LibraryConf) IsLocal() bool {
+	return conf.Backend == "" || conf.Backend == BackendLocal
+}
+
+// UsernamePlaceholder is replaced with the username of the request in the
+// mount point and the prefix of library.
+const UsernamePlaceholder = "{username}"
+
+func IsTemplate(s string) bool {
+	return strings.Contains(s, UsernamePlaceholder)
 }
 
 func ValidLibrary(cfg *Conf, conf *LibraryConf) error {
@@ -63,12 +226,144 @@ func ValidLibrary(cfg *Conf, conf *LibraryConf) error {
 	if conf.Name == "" {
 		return errors.New("empty library name")
 	}
+	if conf.Trash != nil && conf.Trash.Retention < 0 {
+		return fmt.Errorf("the trash retention of library[%s] is invalid", conf.Name)
+	}
+	if conf.Versions != nil && (conf.Versions.Keep < 0 || conf.Versions.MaxAge < 0) {
+		return fmt.Errorf("the versions of library[%s] is invalid", conf.Name)
+	}
+	if conf.Encryption != nil && (conf.Encryption.KeyFile == "") == (conf.Encryption.Passphrase == "") {
+		return fmt.Errorf("the encryption of library[%s] requires either a key file or a passphrase", conf.Name)
+	}
+	if conf.Encryption != nil && conf.Encryption.Passphrase != "" && conf.Encryption.Salt == "" {
+		return fmt.Errorf("the passphrase of library[%s] requires a salt", conf.Name)
+	}
+	if conf.Archive != nil && (strings.Contains(conf.Archive.Suffix, "/") || conf.Archive.Cache < 0 || conf.Archive.Entries < 0) {
+		return fmt.Errorf("the archive of library[%s] is invalid", conf.Name)
+	}
+	if conf.Union != nil {
+		if err := ValidUnion(conf); err != nil {
+			return err
+		}
+	}
+	switch conf.Backend {
+	case "", BackendLocal:
+	case BackendS3:
+		if err := ValidS3(conf); err != nil {
+			return err
+		}
+	case BackendSFTP:
+		if err := ValidSFTP(conf); err != nil {
+			return err
+		}
+	case BackendMemory:
+		if conf.Memory != nil && conf.Memory.TTL < 0 {
+			return fmt.Errorf("the memory ttl of library[%s] is invalid", conf.Name)
+		}
+	default:
+		return fmt.Errorf("the backend[%s] of library[%s] is invalid", conf.Backend, conf.Name)
+	}
+	if !conf.IsLocal() {
+		if conf.MountPoint != "" {
+			return fmt.Errorf("the mount point of library[%s] is only supported by the local backend", conf.Name)
+		}
+		if conf.Quota > 0 || conf.UserQuota > 0 {
+			return fmt.Errorf("the quota of library[%s] is only supported by the local backend", conf.Name)
+		}
+		return validPrefix(conf)
+	}
 	if conf.MountPoint == "" {
 		return fmt.Errorf("the mount point of library[%s] is empty", conf.Name)
 	}
 	if !filepath.IsAbs(conf.MountPoint) {
 		return fmt.Errorf("mount point only support absolute path for library[%s]", conf.Name)
 	}
+	if strings.Contains(strings.ReplaceAll(conf.MountPoint, UsernamePlaceholder, ""), "{") {
+		return fmt.Errorf("the mount point of library[%s] only supports the %s placeholder", conf.Name, UsernamePlaceholder)
+	}
+	if conf.CreateMode&^0o777 != 0 {
+		return fmt.Errorf("the create mode of library[%s] is invalid", conf.Name)
+	}
+	return validPrefix(conf)
+}
+
+func validPrefix(conf *LibraryConf) error {
+	for _, seg := range strings.Split(conf.Prefix, "/") {
+		if strings.Contains(seg, "{") && seg != UsernamePlaceholder {
+			return fmt.Errorf("the prefix of library[%s] only supports %s as a whole path segment",
+				conf.Name, UsernamePlaceholder)
+		}
+	}
+	if strings.Count(conf.Prefix, UsernamePlaceholder) > 1 {
+		return fmt.Errorf("the prefix of library[%s] has more than one %s", conf.Name, UsernamePlaceholder)
+	}
+	return nil
+}
+
+func ValidS3(library *LibraryConf) error {
+	conf := library.S3
+	if conf == nil {
+		return fmt.Errorf("the s3 backend of library[%s] requires [library.s3]", library.Name)
+	}
+	u, err := url.Parse(conf.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("the s3 endpoint[%s] of library[%s] should be a http or https url", conf.Endpoint, library.Name)
+	}
+	if conf.Bucket == "" {
+		return fmt.Errorf("the s3 bucket of library[%s] is empty", library.Name)
+	}
+	if (conf.AccessKey == "") != (conf.SecretKey == "") {
+		return fmt.Errorf("the s3 access key and secret key of library[%s] should be set together", library.Name)
+	}
+	if conf.PartSize != 0 && conf.PartSize < 5<<20 {
+		return fmt.Errorf("the s3 part size of library[%s] should be at least 5MiB", library.Name)
+	}
+	return nil
+}
+
+func ValidUnion(library *LibraryConf) error {
+	if len(library.Union.Lower) == 0 {
+		return fmt.Errorf("the union of library[%s] has no lower directory", library.Name)
+	}
+	for _, dir := range library.Union.Lower {
+		if dir == "" || IsTemplate(dir) {
+			return fmt.Errorf("the lower directory[%s] of library[%s] is invalid", dir, library.Name)
+		}
+		if library.IsLocal() && filepath.Clean(dir) == filepath.Clean(library.MountPoint) {
+			return fmt.Errorf("the lower directory[%s] of library[%s] is its mount point", dir, library.Name)
+		}
+	}
+	return nil
+}
+
+func ValidSFTP(library *LibraryConf) error {
+	conf := library.SFTP
+	if conf == nil {
+		return fmt.Errorf("the sftp backend of library[%s] requires [library.sftp]", library.Name)
+	}
+	if conf.Address == "" {
+		return fmt.Errorf("the sftp address of library[%s] is empty", library.Name)
+	}
+	if conf.Username == "" {
+		return fmt.Errorf("the sftp username of library[%s] is empty", library.Name)
+	}
+	if conf.Password == "" && conf.PrivateKeyPath == "" {
+		return fmt.Errorf("the sftp password or private key of library[%s] is required", library.Name)
+	}
+	if conf.HostKey == "" {
+		return fmt.Errorf("the sftp host key of library[%s] is required", library.Name)
+	}
+	if !strings.HasPrefix(conf.HostKey, "SHA256:") {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(conf.HostKey)); err != nil {
+			return fmt.Errorf("the sftp host key of library[%s] is invalid: %w", library.Name, err)
+		}
+	}
+	if !path.IsAbs(conf.Root) {
+		return fmt.Errorf("the sftp root[%s] of library[%s] should be an absolute path", conf.Root, library.Name)
+	}
+	if conf.MaxConns < 0 {
+		return fmt.Errorf("the sftp max conns of library[%s] is invalid", library.Name)
+	}
 	return nil
 }
 
@@ -78,6 +373,27 @@ type ScopeConf struct {
 	Include    []string `toml:"include"`
 	Exclude    []string `toml:"exclude"`
 	Permission []string `toml:"permission"`
+	// Rule are evaluated in order before include and exclude, the first rule
+	// matching both the path and the permission decides.
+	Rule []*RuleConf `toml:"rule"`
+}
+
+type RuleConf struct {
+	// allow or deny
+	Action string   `toml:"action"`
+	Paths  []string `toml:"paths"`
+	// all permissions when empty
+	Perms []string `toml:"perms"`
+}
+
+var permissions = []string{
+	"read",
+	"write",
+	"delete",
+	"create_file",
+	"create_folder",
+	"rename",
+	"*",
 }
 
 func ValidScope(cfg *Conf, conf *ScopeConf) error {
@@ -90,27 +406,68 @@ func ValidScope(cfg *Conf, conf *ScopeConf) error {
 	if !slices.ContainsFunc(cfg.Library, func(l *LibraryConf) bool { return l.Name == conf.Library }) {
 		return fmt.Errorf("library[%s] not found", conf.Library)
 	}
+	for _, pattern := range slices.Concat(conf.Include, conf.Exclude) {
+		if err := ValidPattern(pattern); err != nil {
+			return fmt.Errorf("scope[%s] pattern[%s] is invalid: %w", conf.Name, pattern, err)
+		}
+	}
 	for _, perm := range conf.Permission {
-		if !slices.Contains([]string{
-			"read",
-			"write",
-			"delete",
-			"create_file",
-			"create_folder",
-			"rename",
-			"*",
-		}, perm) {
+		if !slices.Contains(permissions, perm) {
 			return fmt.Errorf("scope[%s] permission[%s] is invalid", conf.Name, perm)
 		}
 	}
+	for i, rule := range conf.Rule {
+		if rule.Action != "allow" && rule.Action != "deny" {
+			return fmt.Errorf("scope[%s] rule[%d] action[%s] is invalid", conf.Name, i, rule.Action)
+		}
+		if len(rule.Paths) == 0 {
+			return fmt.Errorf("scope[%s] rule[%d] has no paths", conf.Name, i)
+		}
+		for _, pattern := range rule.Paths {
+			if err := ValidPattern(pattern); err != nil {
+				return fmt.Errorf("scope[%s] rule[%d] pattern[%s] is invalid: %w", conf.Name, i, pattern, err)
+			}
+		}
+		for _, perm := range rule.Perms {
+			if !slices.Contains(permissions, perm) {
+				return fmt.Errorf("scope[%s] rule[%d] permission[%s] is invalid", conf.Name, i, perm)
+			}
+		}
+	}
 
 	return nil
 }
 
+// ValidPattern checks an include or exclude pattern of scope: dir:, file:,
+// glob: or re:.
+func ValidPattern(pattern string) error {
+	var err error
+	switch {
+	case strings.HasPrefix(pattern, "dir:"), strings.HasPrefix(pattern, "file:"):
+	case strings.HasPrefix(pattern, "glob:"):
+		_, err = glob.Compile(pattern[5:])
+	case strings.HasPrefix(pattern, "re:"):
+		_, err = glob.CompileRegexp(pattern[3:])
+	default:
+		err = errors.New("unsupported pattern")
+	}
+	return err
+}
+
 type UserConf struct {
 	Username   string   `toml:"username"`
 	Credential string   `toml:"credential"`
 	Scope      []string `toml:"scope"`
+	// client certificate authentication: "" (not used), sufficient (certificate
+	// or password) or required (certificate and password)
+	Cert string `toml:"cert"`
+	// hex of H(username:realm:password) by digest algorithm, MD5 or SHA-256,
+	// required by digest authentication when the credential is hashed
+	DigestHa1 map[string]string `toml:"digest_ha1"`
+	// bytes of the user in all libraries, and in the libraries by name which
+	// override the user_quota of library
+	Quota        ByteSize            `toml:"quota"`
+	LibraryQuota map[string]ByteSize `toml:"library_quota"`
 }
 
 func ValidUser(cfg *Conf, conf *UserConf) error {
@@ -120,11 +477,211 @@ func ValidUser(cfg *Conf, conf *UserConf) error {
 	if conf.Username == "" {
 		return errors.New("empty user name")
 	}
+	if !slices.Contains([]string{"", "sufficient", "required"}, conf.Cert) {
+		return fmt.Errorf("the cert[%s] of user[%s] is invalid", conf.Cert, conf.Username)
+	}
+	if conf.Cert != "" && (cfg.Auth == nil || cfg.Auth.Cert == nil) {
+		return fmt.Errorf("the cert of user[%s] requires [auth.cert]", conf.Username)
+	}
+	if conf.Credential == "" {
+		// users with a sufficient certificate may have no password
+		if conf.Cert != "sufficient" {
+			return fmt.Errorf("empty credential of user[%s]", conf.Username)
+		}
+	} else if algo := password.Identify(conf.Credential); algo == password.Plaintext {
+		if cfg.Security == nil || !cfg.Security.AllowPlaintextCredential {
+			return fmt.Errorf("the credential of user[%s] is not hashed, "+
+				"use `webdav hash-password` or enable [security.allow_plaintext_credential]", conf.Username)
+		}
+	} else if algo.HtpasswdOnly() {
+		return fmt.Errorf("the credential of user[%s] uses %s, which is only supported in htpasswd files, "+
+			"use `webdav hash-password`", conf.Username, algo)
+	} else if err := password.Check(conf.Credential); err != nil {
+		return fmt.Errorf("the credential of user[%s] is invalid: %w", conf.Username, err)
+	}
 	for _, scope := range conf.Scope {
 		if !slices.ContainsFunc(cfg.Scope, func(s *ScopeConf) bool { return s.Name == scope }) {
 			return fmt.Errorf("the scope[%s] of user[%s] not found", scope, conf.Username)
 		}
 	}
+	for library := range conf.LibraryQuota {
+		if !slices.ContainsFunc(cfg.Library, func(l *LibraryConf) bool { return l.Name == library }) {
+			return fmt.Errorf("the library[%s] of user[%s] quota not found", library, conf.Username)
+		}
+	}
+
+	return nil
+}
+
+// ByteSize is a number of bytes, which can be written with a unit, e.g. 500MB
+// or 10GiB.
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	unit := int64(1)
+	for _, u := range byteUnits {
+		if n, ok := strings.CutSuffix(s, u.suffix); ok {
+			s, unit = strings.TrimSpace(n), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(n >= 0) || math.IsInf(n, 1) {
+		return fmt.Errorf("invalid byte size[%s]", text)
+	}
+	*b = ByteSize(n * float64(unit))
+	return nil
+}
+
+func (b ByteSize) MarshalText() ([]byte, error) {
+	return []byte(strconv.FormatInt(int64(b), 10)), nil
+}
+
+type QuotaConf struct {
+	// interval of the scans which correct the usage tracked incrementally,
+	// default 1h
+	ReconcileInterval time.Duration `toml:"reconcile_interval"`
+}
+
+// LockConf persists the WebDAV locks, the locks are kept in memory and lost
+// on restart when it is not configured.
+type LockConf struct {
+	// json file where the locks of all libraries are stored
+	Path string `toml:"path"`
+}
+
+func ValidLock(cfg *Conf, conf *LockConf) error {
+	if conf == nil {
+		return nil
+	}
+	if conf.Path == "" {
+		return errors.New("the path of [lock] is empty")
+	}
+
+	return nil
+}
+
+// PropsConf stores the dead properties set by PROPPATCH.
+type PropsConf struct {
+	// auto (default): extended attributes, or the sidecar database when the
+	// file system does not support them; xattr; sidecar; none
+	Backend string `toml:"backend"`
+	// json file of the sidecar database
+	SidecarPath string `toml:"sidecar_path"`
+}
+
+func ValidProps(cfg *Conf, conf *PropsConf) error {
+	if conf == nil {
+		return nil
+	}
+	switch conf.Backend {
+	case "", "auto", "xattr", "none":
+	case "sidecar":
+		if conf.SidecarPath == "" {
+			return errors.New("the sidecar backend of [props] requires [sidecar_path]")
+		}
+	default:
+		return fmt.Errorf("the backend[%s] of [props] is invalid", conf.Backend)
+	}
+
+	return nil
+}
+
+// GroupConf grants scopes to its members, which are usernames of any
+// provider. Users are also members of the groups reported by the provider,
+// e.g. LDAP groups or the groups claim of a JWT.
+type GroupConf struct {
+	Name    string   `toml:"name"`
+	Members []string `toml:"members"`
+	Scope   []string `toml:"scope"`
+}
+
+func ValidGroup(cfg *Conf, conf *GroupConf) error {
+	if conf == nil {
+		return errors.New("empty group configure")
+	}
+	if conf.Name == "" {
+		return errors.New("empty group name")
+	}
+	if slices.ContainsFunc(cfg.Group, func(g *GroupConf) bool { return g != conf && g.Name == conf.Name }) {
+		return fmt.Errorf("group[%s] is duplicated", conf.Name)
+	}
+	for _, scope := range conf.Scope {
+		if !slices.ContainsFunc(cfg.Scope, func(s *ScopeConf) bool { return s.Name == scope }) {
+			return fmt.Errorf("the scope[%s] of group[%s] not found", scope, conf.Name)
+		}
+	}
+
+	return nil
+}
+
+// UserScope returns the scope names of the user and of the groups it is a
+// member of.
+func UserScope(cfg *Conf, username string) []string {
+	var scope []string
+	add := func(names []string) {
+		for _, name := range names {
+			if !slices.Contains(scope, name) {
+				scope = append(scope, name)
+			}
+		}
+	}
+	for _, user := range cfg.User {
+		if user.Username == username {
+			add(user.Scope)
+		}
+	}
+	for _, group := range cfg.Group {
+		if slices.Contains(group.Members, username) {
+			add(group.Scope)
+		}
+	}
+	return scope
+}
+
+// readOnly reports whether the scope grants nothing but read.
+func readOnly(scope *ScopeConf) bool {
+	notRead := func(perm string) bool { return perm != "read" }
+	if slices.ContainsFunc(scope.Permission, notRead) {
+		return false
+	}
+	for _, rule := range scope.Rule {
+		if rule.Action == "allow" && (len(rule.Perms) == 0 || slices.ContainsFunc(rule.Perms, notRead)) {
+			return false
+		}
+	}
+	return true
+}
+
+// AnonymousConf grants scopes to the requests without credentials.
+type AnonymousConf struct {
+	Scope []string `toml:"scope"`
+}
+
+func ValidAnonymous(cfg *Conf, conf *AnonymousConf) error {
+	if conf == nil {
+		return nil
+	}
+	for _, scope := range conf.Scope {
+		i := slices.IndexFunc(cfg.Scope, func(s *ScopeConf) bool { return s.Name == scope })
+		if i < 0 {
+			return fmt.Errorf("the scope[%s] of anonymous not found", scope)
+		}
+		if !readOnly(cfg.Scope[i]) {
+			return fmt.Errorf("the scope[%s] of anonymous grants more than read, anonymous access is read only", scope)
+		}
+	}
 
 	return nil
 }
@@ -133,6 +690,273 @@ type SecurityConf struct {
 	PasswordRetryPerFiveMinute int  `toml:"password_retry_per_five_minute"`
 	BanUserWrongPwd            bool `toml:"ban_user_wrong_pwd"`
 	BanIpWrongPwd              bool `toml:"ban_ip_wrong_pwd"`
+	AllowPlaintextCredential   bool `toml:"allow_plaintext_credential"`
+}
+
+type AuthConf struct {
+	// Providers are tried in order, default: basic, and htpasswd if configured.
+	Providers []string `toml:"providers"`
+	// Fallthrough tries the next provider when a provider rejects the credential.
+	Fallthrough bool          `toml:"fallthrough"`
+	Htpasswd    *HtpasswdConf `toml:"htpasswd"`
+	Ldap        *LdapConf     `toml:"ldap"`
+	Jwt         *JwtConf      `toml:"jwt"`
+	Token       *TokenConf    `toml:"token"`
+	Digest      *DigestConf   `toml:"digest"`
+	Cert        *CertConf     `toml:"cert"`
+}
+
+func ValidAuth(cfg *Conf, conf *AuthConf) error {
+	if conf == nil {
+		return nil
+	}
+	for i, provider := range conf.Providers {
+		if provider == "" {
+			return errors.New("empty auth provider")
+		}
+		if slices.Contains(conf.Providers[:i], provider) {
+			return fmt.Errorf("auth provider[%s] is duplicated", provider)
+		}
+	}
+	if slices.Contains(conf.Providers, "htpasswd") && conf.Htpasswd == nil {
+		return errors.New("auth provider[htpasswd] requires [auth.htpasswd]")
+	}
+	if slices.Contains(conf.Providers, "ldap") && conf.Ldap == nil {
+		return errors.New("auth provider[ldap] requires [auth.ldap]")
+	}
+	if slices.Contains(conf.Providers, "jwt") && conf.Jwt == nil {
+		return errors.New("auth provider[jwt] requires [auth.jwt]")
+	}
+	if slices.Contains(conf.Providers, "token") && conf.Token == nil {
+		return errors.New("auth provider[token] requires [auth.token]")
+	}
+	if slices.Contains(conf.Providers, "digest") && conf.Digest == nil {
+		return errors.New("auth provider[digest] requires [auth.digest]")
+	}
+	if slices.Contains(conf.Providers, "cert") && conf.Cert == nil {
+		return errors.New("auth provider[cert] requires [auth.cert]")
+	}
+	if conf.Htpasswd != nil {
+		if err := ValidHtpasswd(cfg, conf.Htpasswd); err != nil {
+			return err
+		}
+	}
+	if conf.Ldap != nil {
+		if err := ValidLdap(cfg, conf.Ldap); err != nil {
+			return err
+		}
+	}
+	if conf.Jwt != nil {
+		if err := ValidJwt(cfg, conf.Jwt); err != nil {
+			return err
+		}
+	}
+	if conf.Token != nil && conf.Token.Path == "" {
+		return errors.New("the path of token store is empty")
+	}
+	if conf.Digest != nil {
+		if err := ValidDigest(cfg, conf.Digest); err != nil {
+			return err
+		}
+	}
+	if conf.Cert != nil {
+		if err := ValidCert(cfg, conf.Cert); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type HtpasswdConf struct {
+	Path         string              `toml:"path"`
+	DefaultScope []string            `toml:"default_scope"`
+	UserScope    map[string][]string `toml:"user_scope"`
+}
+
+func ValidHtpasswd(cfg *Conf, conf *HtpasswdConf) error {
+	if conf.Path == "" {
+		return errors.New("the path of htpasswd file is empty")
+	}
+	for _, scope := range conf.DefaultScope {
+		if !hasScope(cfg, scope) {
+			return fmt.Errorf("the default scope[%s] of htpasswd not found", scope)
+		}
+	}
+	for username, scopes := range conf.UserScope {
+		for _, scope := range scopes {
+			if !hasScope(cfg, scope) {
+				return fmt.Errorf("the scope[%s] of htpasswd user[%s] not found", scope, username)
+			}
+		}
+	}
+
+	return nil
+}
+
+type LdapConf struct {
+	// ldap://host:389 or ldaps://host:636
+	Url                string `toml:"url"`
+	StartTls           bool   `toml:"start_tls"`
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
+	CaCertPath         string `toml:"ca_cert_path"`
+	// service account used to search users, anonymous if empty
+	BindDn       string `toml:"bind_dn"`
+	BindPassword string `toml:"bind_password"`
+	BaseDn       string `toml:"base_dn"`
+	// {username} is replaced by the escaped username
+	UserFilter string `toml:"user_filter"`
+	// the attribute of the user entry which is the username, default uid,
+	// e.g. sAMAccountName of Active Directory
+	UsernameAttribute string `toml:"username_attribute"`
+	// groups are searched by group_filter under group_base_dn, {dn} and
+	// {username} are replaced, and/or read from member_of_attribute of the user
+	GroupBaseDn       string              `toml:"group_base_dn"`
+	GroupFilter       string              `toml:"group_filter"`
+	GroupAttribute    string              `toml:"group_attribute"`
+	MemberOfAttribute string              `toml:"member_of_attribute"`
+	GroupScope        map[string][]string `toml:"group_scope"`
+	DefaultScope      []string            `toml:"default_scope"`
+	CacheTTL          time.Duration       `toml:"cache_ttl"`
+	Timeout           time.Duration       `toml:"timeout"`
+}
+
+func ValidLdap(cfg *Conf, conf *LdapConf) error {
+	u, err := url.Parse(conf.Url)
+	if err != nil {
+		return fmt.Errorf("bad format [auth.ldap.url]: %w", err)
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return fmt.Errorf("unsupported ldap url scheme[%s]", u.Scheme)
+	}
+	if u.Scheme == "ldaps" && conf.StartTls {
+		return errors.New("start_tls can not be used with ldaps")
+	}
+	if conf.BaseDn == "" {
+		return errors.New("the base dn of ldap is empty")
+	}
+	if !strings.Contains(conf.UserFilter, "{username}") {
+		return errors.New("the user filter of ldap should contain {username}")
+	}
+	if conf.GroupFilter != "" && conf.GroupBaseDn == "" {
+		return errors.New("the group base dn of ldap is empty")
+	}
+	if conf.CacheTTL < 0 || conf.Timeout < 0 {
+		return errors.New("the cache ttl and timeout of ldap should not be negative")
+	}
+	for _, scope := range conf.DefaultScope {
+		if !hasScope(cfg, scope) {
+			return fmt.Errorf("the default scope[%s] of ldap not found", scope)
+		}
+	}
+	for group, scopes := range conf.GroupScope {
+		for _, scope := range scopes {
+			if !hasScope(cfg, scope) {
+				return fmt.Errorf("the scope[%s] of ldap group[%s] not found", scope, group)
+			}
+		}
+	}
+
+	return nil
+}
+
+type JwtConf struct {
+	// secrets of HS256/HS384/HS512 tokens
+	HmacSecrets []string `toml:"hmac_secrets"`
+	// local JWKS file with the public keys of RS256/ES256/EdDSA tokens
+	JwksPath string `toml:"jwks_path"`
+	// the iss and aud claims are checked when not empty
+	Issuer        string `toml:"issuer"`
+	Audience      string `toml:"audience"`
+	UsernameClaim string `toml:"username_claim"`
+	ScopeClaim    string `toml:"scope_claim"`
+	GroupClaim    string `toml:"group_claim"`
+	// tolerated clock skew when checking exp and nbf
+	Leeway time.Duration `toml:"leeway"`
+	// accept tokens without exp, which never expire
+	AllowNoExp bool `toml:"allow_no_exp"`
+}
+
+func ValidJwt(cfg *Conf, conf *JwtConf) error {
+	if len(conf.HmacSecrets) == 0 && conf.JwksPath == "" {
+		return errors.New("at least one of hmac_secrets or jwks_path of jwt should be set")
+	}
+	for _, secret := range conf.HmacSecrets {
+		if len(secret) < 32 {
+			return errors.New("the hmac secret of jwt should be at least 32 bytes")
+		}
+	}
+	if conf.Leeway < 0 {
+		return errors.New("the leeway of jwt should not be negative")
+	}
+
+	return nil
+}
+
+type TokenConf struct {
+	// json file where the hashed app tokens are stored
+	Path string `toml:"path"`
+}
+
+type DigestConf struct {
+	// default: webdav
+	Realm string `toml:"realm"`
+	// in order of preference, support: SHA-256, MD5, default: both
+	Algorithms []string      `toml:"algorithms"`
+	NonceTTL   time.Duration `toml:"nonce_ttl"`
+}
+
+func ValidDigest(cfg *Conf, conf *DigestConf) error {
+	for _, algorithm := range conf.Algorithms {
+		if algorithm != "SHA-256" && algorithm != "MD5" {
+			return fmt.Errorf("unsupported digest algorithm[%s]", algorithm)
+		}
+	}
+	if conf.NonceTTL < 0 {
+		return errors.New("the nonce ttl of digest should not be negative")
+	}
+	for _, user := range cfg.User {
+		for algorithm, ha1 := range user.DigestHa1 {
+			if algorithm != "SHA-256" && algorithm != "MD5" {
+				return fmt.Errorf("unsupported digest algorithm[%s] of user[%s]", algorithm, user.Username)
+			}
+			if _, err := hex.DecodeString(ha1); err != nil {
+				return fmt.Errorf("the digest ha1 of user[%s] is not hex: %w", user.Username, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+type CertConf struct {
+	// where the username comes from: cn (default), email (SAN) or oid:<dotted oid>
+	UsernameFrom string `toml:"username_from"`
+}
+
+func ValidCert(cfg *Conf, conf *CertConf) error {
+	if cfg.TlsClientAuth == "" {
+		return errors.New("[auth.cert] requires [tls_client_auth]")
+	}
+	from := conf.UsernameFrom
+	if from == "" || from == "cn" || from == "email" {
+		return nil
+	}
+	oid, ok := strings.CutPrefix(from, "oid:")
+	if !ok {
+		return fmt.Errorf("the username_from[%s] of cert is invalid", from)
+	}
+	for _, arc := range strings.Split(oid, ".") {
+		if _, err := strconv.ParseUint(arc, 10, 32); err != nil {
+			return fmt.Errorf("the username_from[%s] of cert is invalid", from)
+		}
+	}
+
+	return nil
+}
+
+func hasScope(cfg *Conf, scope string) bool {
+	return slices.ContainsFunc(cfg.Scope, func(s *ScopeConf) bool { return s.Name == scope })
 }
 
 func Valid(cfg *Conf) error {
@@ -157,6 +981,17 @@ func Valid(cfg *Conf) error {
 			return errors.New("empty tls certificate")
 		}
 	}
+	if cfg.TlsClientAuth != "" {
+		if cfg.TlsClientAuth != "request" && cfg.TlsClientAuth != "require" {
+			return fmt.Errorf("the tls_client_auth[%s] is invalid", cfg.TlsClientAuth)
+		}
+		if !cfg.HttpsEnable {
+			return errors.New("[tls_client_auth] requires https")
+		}
+		if cfg.TlsClientCaPath == "" {
+			return errors.New("[tls_client_auth] requires [tls_client_ca_path]")
+		}
+	}
 
 	for _, lib := range cfg.Library {
 		if err := ValidLibrary(cfg, lib); err != nil {
@@ -173,6 +1008,23 @@ func Valid(cfg *Conf) error {
 			return err
 		}
 	}
+	for _, group := range cfg.Group {
+		if err := ValidGroup(cfg, group); err != nil {
+			return err
+		}
+	}
+	if err := ValidAuth(cfg, cfg.Auth); err != nil {
+		return err
+	}
+	if err := ValidAnonymous(cfg, cfg.Anonymous); err != nil {
+		return err
+	}
+	if err := ValidLock(cfg, cfg.Lock); err != nil {
+		return err
+	}
+	if err := ValidProps(cfg, cfg.Props); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -189,5 +1041,8 @@ func Parse(path string) (*Conf, error) {
 	if cfg.Security == nil {
 		cfg.Security = &SecurityConf{}
 	}
+	if cfg.Auth == nil {
+		cfg.Auth = &AuthConf{}
+	}
 	return cfg, nil
 }
@@ -25,6 +25,8 @@ package conf
 
 import (
 	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 
 	"github.com/BurntSushi/toml"
@@ -32,19 +34,75 @@ import (
 
 func TestParse(t *testing.T) {
 	cfg := &Conf{
-		HttpEnable:     false,
-		HttpListen:     "",
-		HttpsEnable:    false,
-		HttpsListen:    "",
-		TlsKeyPem:      "",
-		TlsCertPem:     "",
-		TlsKeyPemPath:  "",
-		TlsCertPemPath: "",
+		HttpEnable:       false,
+		HttpListen:       "",
+		HttpsEnable:      false,
+		HttpsListen:      "",
+		TlsKeyPem:        "",
+		TlsCertPem:       "",
+		TlsKeyPemPath:    "",
+		TlsCertPemPath:   "",
+		TlsClientAuth:    "",
+		TlsClientCaPath:  "",
+		TlsClientCrlPath: "",
 		Library: []*LibraryConf{
 			{
-				Name:       "",
-				MountPoint: "",
-				Prefix:     "",
+				Name:           "",
+				Backend:        "",
+				MountPoint:     "",
+				Prefix:         "",
+				StripPrefix:    false,
+				DenyPrecedence: false,
+				CreateMode:     0,
+				Quota:          0,
+				UserQuota:      0,
+				S3: &S3Conf{
+					Endpoint:  "",
+					Region:    "",
+					Bucket:    "",
+					Prefix:    "",
+					PathStyle: false,
+					AccessKey: "",
+					SecretKey: "",
+					PartSize:  0,
+				},
+				SFTP: &SFTPConf{
+					Address:              "",
+					Username:             "",
+					Password:             "",
+					PrivateKeyPath:       "",
+					PrivateKeyPassphrase: "",
+					HostKey:              "",
+					Root:                 "",
+					MaxConns:             0,
+				},
+				Memory: &MemoryConf{
+					Size: 0,
+					TTL:  0,
+				},
+				Trash: &TrashConf{
+					Retention:   0,
+					Admins:      nil,
+					AdminGroups: nil,
+				},
+				Versions: &VersionsConf{
+					Keep:   0,
+					MaxAge: 0,
+				},
+				Encryption: &EncryptionConf{
+					KeyFile:    "",
+					Passphrase: "",
+					Salt:       "",
+					Names:      false,
+				},
+				Union: &UnionConf{
+					Lower: nil,
+				},
+				Archive: &ArchiveConf{
+					Suffix:  "",
+					Cache:   0,
+					Entries: 0,
+				},
 			},
 		},
 		Scope: []*ScopeConf{
@@ -54,24 +112,106 @@ func TestParse(t *testing.T) {
 				Include:    nil,
 				Exclude:    nil,
 				Permission: nil,
+				Rule: []*RuleConf{
+					{
+						Action: "",
+						Paths:  nil,
+						Perms:  nil,
+					},
+				},
 			},
 		},
 		User: []*UserConf{
 			{
-				Username:   "",
-				Credential: "",
-				Scope:      nil,
+				Username:     "",
+				Credential:   "",
+				Scope:        nil,
+				Cert:         "",
+				DigestHa1:    nil,
+				Quota:        0,
+				LibraryQuota: nil,
+			},
+		},
+		Group: []*GroupConf{
+			{
+				Name:    "",
+				Members: nil,
+				Scope:   nil,
 			},
 		},
 		Security: &SecurityConf{
 			PasswordRetryPerFiveMinute: 0,
 			BanUserWrongPwd:            false,
 			BanIpWrongPwd:              false,
+			AllowPlaintextCredential:   false,
+		},
+		Auth: &AuthConf{
+			Providers:   nil,
+			Fallthrough: false,
+			Htpasswd: &HtpasswdConf{
+				Path:         "",
+				DefaultScope: nil,
+				UserScope:    nil,
+			},
+			Ldap: &LdapConf{
+				Url:                "",
+				StartTls:           false,
+				InsecureSkipVerify: false,
+				CaCertPath:         "",
+				BindDn:             "",
+				BindPassword:       "",
+				BaseDn:             "",
+				UserFilter:         "",
+				UsernameAttribute:  "",
+				GroupBaseDn:        "",
+				GroupFilter:        "",
+				GroupAttribute:     "",
+				MemberOfAttribute:  "",
+				GroupScope:         nil,
+				DefaultScope:       nil,
+				CacheTTL:           0,
+				Timeout:            0,
+			},
+			Jwt: &JwtConf{
+				HmacSecrets:   nil,
+				JwksPath:      "",
+				Issuer:        "",
+				Audience:      "",
+				UsernameClaim: "",
+				ScopeClaim:    "",
+				GroupClaim:    "",
+				Leeway:        0,
+				AllowNoExp:    false,
+			},
+			Token: &TokenConf{
+				Path: "",
+			},
+			Digest: &DigestConf{
+				Realm:      "",
+				Algorithms: nil,
+				NonceTTL:   0,
+			},
+			Cert: &CertConf{
+				UsernameFrom: "",
+			},
+		},
+		Anonymous: &AnonymousConf{
+			Scope: nil,
+		},
+		Quota: &QuotaConf{
+			ReconcileInterval: 0,
+		},
+		Lock: &LockConf{
+			Path: "",
+		},
+		Props: &PropsConf{
+			Backend:     "",
+			SidecarPath: "",
 		},
 	}
 
 	data, _ := toml.Marshal(cfg)
-	fp, err := os.OpenFile("./config.example.toml", os.O_RDWR|os.O_CREATE|os.O_RDWR, 0755)
+	fp, err := os.OpenFile(filepath.Join(t.TempDir(), "config.example.toml"), os.O_RDWR|os.O_CREATE|os.O_RDWR, 0755)
 	if err != nil {
 		t.Log(err)
 		return
@@ -80,3 +220,80 @@ func TestParse(t *testing.T) {
 	fp.Sync()
 	fp.Close()
 }
+
+func TestUserScope(t *testing.T) {
+	cfg := &Conf{
+		User: []*UserConf{
+			{Username: "alice", Scope: []string{"media"}},
+		},
+		Group: []*GroupConf{
+			{Name: "staff", Members: []string{"alice", "bob"}, Scope: []string{"media", "docs"}},
+			{Name: "admins", Members: []string{"bob"}, Scope: []string{"backup"}},
+		},
+	}
+	if got := UserScope(cfg, "alice"); !slices.Equal(got, []string{"media", "docs"}) {
+		t.Errorf("alice: %v", got)
+	}
+	if got := UserScope(cfg, "bob"); !slices.Equal(got, []string{"media", "docs", "backup"}) {
+		t.Errorf("bob: %v", got)
+	}
+	if got := UserScope(cfg, "carol"); got != nil {
+		t.Errorf("carol: %v", got)
+	}
+}
+
+func TestValidUserCredential(t *testing.T) {
+	cfg := &Conf{}
+	for _, c := range []struct {
+		credential string
+		valid      bool
+	}{
+		{"$2y$10$2yGHWDl/Wd2DwTLWMa1mU.0Spgdaqy6P5hpNtAs2fRv/kXgmyj6ue", true},
+		{"{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=", false},
+		{"$apr1$mU9o6Gxp$G3kZVU1ZrSJp1Z2tsdTjo0", false},
+		{"test", false},
+	} {
+		err := ValidUser(cfg, &UserConf{Username: "test", Credential: c.credential})
+		if (err == nil) != c.valid {
+			t.Errorf("%s: %v", c.credential, err)
+		}
+	}
+}
+
+func TestValidEncryption(t *testing.T) {
+	for _, c := range []struct {
+		encryption *EncryptionConf
+		valid      bool
+	}{
+		{&EncryptionConf{KeyFile: "backup.key"}, true},
+		{&EncryptionConf{Passphrase: "secret", Salt: "5f0c6e1a9d2b47e3"}, true},
+		{&EncryptionConf{Passphrase: "secret"}, false},
+		{&EncryptionConf{}, false},
+	} {
+		lib := &LibraryConf{Name: "backup", MountPoint: t.TempDir(), Encryption: c.encryption}
+		err := ValidLibrary(&Conf{Library: []*LibraryConf{lib}}, lib)
+		if (err == nil) != c.valid {
+			t.Errorf("%+v: %v", c.encryption, err)
+		}
+	}
+}
+
+func TestValidAnonymous(t *testing.T) {
+	for _, c := range []struct {
+		scope *ScopeConf
+		valid bool
+	}{
+		{&ScopeConf{Name: "public", Permission: []string{"read"}}, true},
+		{&ScopeConf{Name: "public", Permission: []string{"read"}, Rule: []*RuleConf{{Action: "deny", Paths: []string{"dir:/"}}}}, true},
+		{&ScopeConf{Name: "public", Permission: []string{"read", "write"}}, false},
+		{&ScopeConf{Name: "public", Permission: []string{"*"}}, false},
+		{&ScopeConf{Name: "public", Rule: []*RuleConf{{Action: "allow", Paths: []string{"dir:/"}}}}, false},
+		{&ScopeConf{Name: "public", Rule: []*RuleConf{{Action: "allow", Paths: []string{"dir:/"}, Perms: []string{"read"}}}}, true},
+	} {
+		cfg := &Conf{Scope: []*ScopeConf{c.scope}}
+		err := ValidAnonymous(cfg, &AnonymousConf{Scope: []string{"public"}})
+		if (err == nil) != c.valid {
+			t.Errorf("%+v: %v", c.scope, err)
+		}
+	}
+}
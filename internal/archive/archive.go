@@ -0,0 +1,393 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+// Package archive reads the members of zip, tar, tar.gz and tar.zst files in a
+// webdav.FileSystem without extracting them.
+//
+// The index of an archive is built by reading its central directory, or the
+// headers of the tar stream, and is cached until the archive is modified. The
+// stored members of zip files and the members of plain tar files are read at
+// their offsets, the compressed members are decompressed from their start,
+// and again from the start for a backward seek.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/net/webdav"
+)
+
+type format int
+
+const (
+	formatNone format = iota
+	formatZip
+	formatTar
+	formatTarGz
+	formatTarZst
+)
+
+// DefaultCacheSize is the number of indexes cached by default.
+const DefaultCacheSize = 64
+
+// DefaultCacheEntries is the number of members of the cached indexes by
+// default, an archive with more members is not browsable.
+const DefaultCacheEntries = 100000
+
+var (
+	errUnsupported    = errors.New("the compression method of member is not supported")
+	errTooManyEntries = errors.New("the archive has too many members")
+)
+
+// methodEncrypted is the method of the encrypted zip members.
+const methodEncrypted = 0xffff
+
+func formatOf(name string) format {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return formatZip
+	case strings.HasSuffix(name, ".tar"):
+		return formatTar
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return formatTarGz
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		return formatTarZst
+	}
+	return formatNone
+}
+
+// Supported reports whether the file is an archive by its name.
+func Supported(name string) bool {
+	return formatOf(name) != formatNone
+}
+
+// Entry is a member of an archive.
+type Entry struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	// offset of the data in the archive, or in the decompressed tar stream
+	offset int64
+	// compressed size and method of a zip member
+	compressed int64
+	method     uint16
+}
+
+func (e *Entry) Name() string       { return path.Base(e.name) }
+func (e *Entry) Size() int64        { return e.size }
+func (e *Entry) Mode() os.FileMode  { return e.mode }
+func (e *Entry) ModTime() time.Time { return e.modTime }
+func (e *Entry) IsDir() bool        { return e.mode.IsDir() }
+func (e *Entry) Sys() any           { return nil }
+
+// Index is the members of an archive.
+type Index struct {
+	format  format
+	size    int64
+	modTime time.Time
+	entries map[string]*Entry
+	// the members of each directory, sorted by name
+	children map[string][]*Entry
+}
+
+// cleanMember returns the path of a member, false when it is outside of the
+// archive.
+func cleanMember(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", false
+		}
+	}
+	name = path.Clean("/" + name)
+	return name, name != "/"
+}
+
+func newIndex(f format, info os.FileInfo) *Index {
+	root := &Entry{name: "/", mode: os.ModeDir | 0o555, modTime: info.ModTime()}
+	return &Index{
+		format:   f,
+		size:     info.Size(),
+		modTime:  info.ModTime(),
+		entries:  map[string]*Entry{"/": root},
+		children: map[string][]*Entry{},
+	}
+}
+
+// add adds the member with its parent directories, a later member replaces
+// the earlier one like extraction does.
+func (idx *Index) add(e *Entry, maxEntries int) error {
+	dir := path.Dir(e.name)
+	if _, ok := idx.entries[dir]; !ok {
+		if err := idx.add(&Entry{name: dir, mode: os.ModeDir | 0o555, modTime: e.modTime}, maxEntries); err != nil {
+			return err
+		}
+	}
+	if old, ok := idx.entries[e.name]; ok {
+		if old.IsDir() && e.IsDir() {
+			return nil
+		}
+		idx.children[dir] = slices.DeleteFunc(idx.children[dir], func(c *Entry) bool { return c == old })
+	} else if len(idx.entries) >= maxEntries {
+		return errTooManyEntries
+	}
+	idx.entries[e.name] = e
+	idx.children[dir] = append(idx.children[dir], e)
+	return nil
+}
+
+func (idx *Index) sort() {
+	for _, children := range idx.children {
+		slices.SortFunc(children, func(a, b *Entry) int { return strings.Compare(a.name, b.name) })
+	}
+}
+
+// Stat returns the file info of a member, "/" is the root of the archive.
+func (idx *Index) Stat(member string) (os.FileInfo, error) {
+	e, ok := idx.entries[path.Clean("/"+member)]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: member, Err: os.ErrNotExist}
+	}
+	return e, nil
+}
+
+// build reads the index of the archive, which fails with more members than
+// maxEntries.
+func build(r *readerAt, f format, info os.FileInfo, maxEntries int) (*Index, error) {
+	idx := newIndex(f, info)
+	if f == formatZip {
+		zr, err := zip.NewReader(r, info.Size())
+		if err != nil {
+			return nil, err
+		}
+		for _, zf := range zr.File {
+			name, ok := cleanMember(zf.Name)
+			if !ok {
+				continue
+			}
+			offset, err := zf.DataOffset()
+			if err != nil {
+				return nil, err
+			}
+			method := zf.Method
+			if zf.Flags&0x1 != 0 {
+				method = methodEncrypted
+			}
+			mode := zf.Mode().Perm() &^ 0o222
+			if strings.HasSuffix(zf.Name, "/") {
+				mode |= os.ModeDir | 0o111
+			} else if !zf.Mode().IsRegular() {
+				continue
+			}
+			err = idx.add(&Entry{name: name, size: int64(zf.UncompressedSize64), mode: mode, modTime: zf.Modified,
+				offset: offset, compressed: int64(zf.CompressedSize64), method: method}, maxEntries)
+			if err != nil {
+				return nil, err
+			}
+		}
+		idx.sort()
+		return idx, nil
+	}
+
+	stream, closer, err := decompress(f, io.NewSectionReader(r, 0, info.Size()))
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+	tr := tar.NewReader(stream)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name, ok := cleanMember(hdr.Name)
+		if !ok {
+			continue
+		}
+		mode := os.FileMode(hdr.Mode).Perm() &^ 0o222
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			mode |= os.ModeDir | 0o111
+		case tar.TypeReg:
+		default:
+			continue
+		}
+		offset, _ := stream.Seek(0, io.SeekCurrent)
+		err = idx.add(&Entry{name: name, size: hdr.Size, mode: mode, modTime: hdr.ModTime, offset: offset}, maxEntries)
+		if err != nil {
+			return nil, err
+		}
+	}
+	idx.sort()
+	return idx, nil
+}
+
+// decompress returns the tar stream of the archive, whose position is the
+// offset in the stream.
+func decompress(f format, r io.ReadSeeker) (io.ReadSeeker, func(), error) {
+	switch f {
+	case formatTarGz:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &counter{r: zr}, func() { zr.Close() }, nil
+	case formatTarZst:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return &counter{r: zr}, zr.Close, nil
+	}
+	return r, func() {}, nil
+}
+
+// counter reports the position of a stream, which can only skip forward.
+type counter struct {
+	r   io.Reader
+	pos int64
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.pos += int64(n)
+	return n, err
+}
+
+func (c *counter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += c.pos
+	case io.SeekEnd:
+		return 0, errors.New("the end of stream is unknown")
+	}
+	if offset < c.pos {
+		return 0, errors.New("the stream can not seek backward")
+	}
+	if _, err := io.CopyN(io.Discard, c, offset-c.pos); err != nil {
+		return 0, err
+	}
+	return c.pos, nil
+}
+
+// readerAt reads a file of webdav.FileSystem at offsets.
+type readerAt struct {
+	mu sync.Mutex
+	f  webdav.File
+}
+
+func (r *readerAt) ReadAt(p []byte, off int64) (int, error) {
+	if ra, ok := r.f.(io.ReaderAt); ok {
+		return ra.ReadAt(p, off)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(r.f, p)
+}
+
+// Cache keeps the indexes of the recently used archives, bounded by the number
+// of indexes and by their members in total.
+type Cache struct {
+	indexes *lru.Cache[string, *Index]
+
+	mu sync.Mutex
+	// members of the cached indexes
+	entries    int
+	maxEntries int
+}
+
+func NewCache(size, entries int) *Cache {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	if entries <= 0 {
+		entries = DefaultCacheEntries
+	}
+	c := &Cache{maxEntries: entries}
+	// the indexes are only evicted in add, which holds c.mu
+	c.indexes, _ = lru.NewWithEvict(size, func(_ string, idx *Index) { c.entries -= len(idx.entries) })
+	return c
+}
+
+func (c *Cache) add(key string, idx *Index) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// an added index replacing another one is not reported as evicted
+	c.indexes.Remove(key)
+	c.entries += len(idx.entries)
+	c.indexes.Add(key, idx)
+	for c.entries > c.maxEntries {
+		c.indexes.RemoveOldest()
+	}
+}
+
+// Index returns the index of the archive in the file system, key identifies
+// the file system, e.g. its root. An archive which can not be read is reported
+// as an *os.PathError, which skips it in a PROPFIND rather than aborting it.
+func (c *Cache) Index(ctx context.Context, fsys webdav.FileSystem, key, name string) (*Index, error) {
+	info, err := fsys.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	f := formatOf(name)
+	if !info.Mode().IsRegular() || f == formatNone {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	cacheKey := key + "\x00" + name
+	if idx, ok := c.indexes.Get(cacheKey); ok && idx.size == info.Size() && idx.modTime.Equal(info.ModTime()) {
+		return idx, nil
+	}
+
+	file, err := fsys.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	idx, err := build(&readerAt{f: file}, f, info, c.maxEntries)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fmt.Errorf("read archive error: %w", err)}
+	}
+	c.add(cacheKey, idx)
+	return idx, nil
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/net/webdav"
+)
+
+var members = map[string]string{
+	"readme.txt":        "hello",
+	"docs/big.txt":      strings.Repeat("0123456789", 100000),
+	"docs/sub/deep.txt": "deep",
+}
+
+func writeTar(t *testing.T, w io.Writer) {
+	t.Helper()
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{Name: "docs/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"readme.txt", "docs/big.txt", "docs/sub/deep.txt"} {
+		data := members[name]
+		if err := tw.WriteHeader(&tar.Header{Name: "./" + name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "../escape.txt", Typeflag: tar.TypeReg, Mode: 0644}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newArchives writes the members in all formats into a directory.
+func newArchives(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i, name := range []string{"readme.txt", "docs/big.txt", "docs/sub/deep.txt"} {
+		method := zip.Deflate
+		if i == 0 {
+			method = zip.Store
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(members[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"a.zip": bytes.Clone(buf.Bytes())}
+
+	buf.Reset()
+	writeTar(t, &buf)
+	files["a.tar"] = bytes.Clone(buf.Bytes())
+
+	buf.Reset()
+	gw := gzip.NewWriter(&buf)
+	writeTar(t, gw)
+	gw.Close()
+	files["a.tar.gz"] = bytes.Clone(buf.Bytes())
+
+	buf.Reset()
+	zstdWriter, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTar(t, zstdWriter)
+	zstdWriter.Close()
+	files["a.tar.zst"] = bytes.Clone(buf.Bytes())
+
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestArchives(t *testing.T) {
+	ctx := context.Background()
+	fsys := webdav.Dir(newArchives(t))
+	cache := NewCache(2, 0)
+	for _, name := range []string{"/a.zip", "/a.tar", "/a.tar.gz", "/a.tar.zst"} {
+		idx, err := cache.Index(ctx, fsys, "", name)
+		if err != nil {
+			t.Fatalf("index %s: %v", name, err)
+		}
+		if again, _ := cache.Index(ctx, fsys, "", name); again != idx {
+			t.Errorf("index %s is not cached", name)
+		}
+		if _, err := idx.Stat("/escape.txt"); !os.IsNotExist(err) {
+			t.Errorf("%s: stat a member outside: %v", name, err)
+		}
+		if info, err := idx.Stat("/docs/sub"); err != nil || !info.IsDir() {
+			t.Errorf("%s: stat sub: %v %v", name, info, err)
+		}
+
+		dir, err := idx.Open(ctx, fsys, name, "/docs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos, err := dir.Readdir(-1)
+		if err != nil || len(infos) != 2 || infos[0].Name() != "big.txt" || infos[1].Name() != "sub" {
+			t.Errorf("%s: readdir %v %v", name, infos, err)
+		}
+		dir.Close()
+
+		for member, data := range members {
+			f, err := idx.Open(ctx, fsys, name, member)
+			if err != nil {
+				t.Fatalf("%s: open %s: %v", name, member, err)
+			}
+			if info, _ := f.Stat(); info.Size() != int64(len(data)) {
+				t.Errorf("%s: size of %s %d", name, member, info.Size())
+			}
+			// seek forward and backward like range requests
+			for _, offset := range []int64{int64(len(data)) - 3, 1} {
+				if _, err := f.Seek(offset, io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+				got := make([]byte, 3)
+				if _, err := io.ReadFull(f, got); err != nil || string(got) != data[offset:offset+3] {
+					t.Errorf("%s: read %s at %d: %q %v", name, member, offset, got, err)
+				}
+			}
+			if _, err := f.Write([]byte("x")); err == nil {
+				t.Errorf("%s: wrote %s", name, member)
+			}
+			f.Close()
+		}
+	}
+	if _, err := cache.Index(ctx, fsys, "", "/missing.zip"); !os.IsNotExist(err) {
+		t.Errorf("index missing: %v", err)
+	}
+}
+
+func TestCacheEntries(t *testing.T) {
+	ctx := context.Background()
+	dir := newArchives(t)
+	if err := os.WriteFile(filepath.Join(dir, "broken.zip"), []byte("not a zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fsys := webdav.Dir(dir)
+
+	// each archive has 6 members with the root and the parent directories
+	cache := NewCache(4, 12)
+	zipIndex, err := cache.Index(ctx, fsys, "", "/a.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a.tar", "/a.tar.gz"} {
+		if _, err := cache.Index(ctx, fsys, "", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cache.entries != 12 || cache.indexes.Len() != 2 {
+		t.Errorf("cached %d indexes of %d members", cache.indexes.Len(), cache.entries)
+	}
+	if again, _ := cache.Index(ctx, fsys, "", "/a.zip"); again == zipIndex {
+		t.Error("the least recently used index is not evicted")
+	}
+
+	var pathErr *os.PathError
+	if _, err := NewCache(4, 5).Index(ctx, fsys, "", "/a.zip"); !errors.As(err, &pathErr) || !errors.Is(err, errTooManyEntries) {
+		t.Errorf("index too many members: %v", err)
+	}
+	if _, err := cache.Index(ctx, fsys, "", "/broken.zip"); !errors.As(err, &pathErr) {
+		t.Errorf("index broken: %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package archive
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+
+	"golang.org/x/net/webdav"
+)
+
+var errReadOnly = errors.New("the members of archive are read only")
+
+// Open opens a member of the archive in the file system for reading.
+func (idx *Index) Open(ctx context.Context, fsys webdav.FileSystem, name, member string) (webdav.File, error) {
+	e, ok := idx.entries[path.Clean("/"+member)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: member, Err: os.ErrNotExist}
+	}
+	if e.IsDir() {
+		return &dirFile{entry: e, entries: idx.children[e.name]}, nil
+	}
+
+	file, err := fsys.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	r := &readerAt{f: file}
+	m := &memberFile{entry: e, file: file}
+	switch {
+	case idx.format == formatTar, idx.format == formatZip && e.method == zip.Store:
+		m.section = io.NewSectionReader(r, e.offset, e.size)
+	case idx.format == formatZip && e.method == zip.Deflate:
+		m.open = func() (io.Reader, func(), error) {
+			fr := flate.NewReader(io.NewSectionReader(r, e.offset, e.compressed))
+			return fr, func() { fr.Close() }, nil
+		}
+	case idx.format == formatZip:
+		file.Close()
+		return nil, &os.PathError{Op: "open", Path: member, Err: errUnsupported}
+	default:
+		m.open = func() (io.Reader, func(), error) {
+			stream, closer, err := decompress(idx.format, io.NewSectionReader(r, 0, idx.size))
+			if err != nil {
+				return nil, nil, err
+			}
+			if _, err := stream.Seek(e.offset, io.SeekStart); err != nil {
+				closer()
+				return nil, nil, err
+			}
+			return stream, closer, nil
+		}
+	}
+	return m, nil
+}
+
+type dirFile struct {
+	entry   *Entry
+	entries []*Entry
+}
+
+func (f *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	if count > 0 && len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := len(f.entries)
+	if count > 0 {
+		n = min(count, n)
+	}
+	infos := make([]os.FileInfo, n)
+	for i, e := range f.entries[:n] {
+		infos[i] = e
+	}
+	f.entries = f.entries[n:]
+	return infos, nil
+}
+
+func (f *dirFile) Stat() (os.FileInfo, error) {
+	return f.entry, nil
+}
+
+func (f *dirFile) Read(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: f.entry.name, Err: errors.New("is a directory")}
+}
+
+func (f *dirFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (f *dirFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.entry.name, Err: errReadOnly}
+}
+
+func (f *dirFile) Close() error {
+	return nil
+}
+
+// memberFile reads a member at its offset in the archive, or decompresses it
+// from its start.
+type memberFile struct {
+	entry *Entry
+	file  webdav.File
+
+	section *io.SectionReader
+	// open returns the decompressed member from its start
+	open   func() (io.Reader, func(), error)
+	stream io.Reader
+	close  func()
+	// position of the stream, and the offset of the next read
+	pos    int64
+	offset int64
+}
+
+func (f *memberFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.entry.name, Err: errors.New("not a directory")}
+}
+
+func (f *memberFile) Stat() (os.FileInfo, error) {
+	return f.entry, nil
+}
+
+func (f *memberFile) Read(p []byte) (int, error) {
+	if f.section != nil {
+		return f.section.Read(p)
+	}
+	if f.offset >= f.entry.size {
+		return 0, io.EOF
+	}
+	if f.stream == nil || f.offset < f.pos {
+		f.closeStream()
+		stream, closer, err := f.open()
+		if err != nil {
+			return 0, err
+		}
+		f.stream, f.close, f.pos = io.LimitReader(stream, f.entry.size), closer, 0
+	}
+	if f.offset > f.pos {
+		n, err := io.CopyN(io.Discard, f.stream, f.offset-f.pos)
+		f.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.stream.Read(p)
+	f.pos += int64(n)
+	f.offset = f.pos
+	return n, err
+}
+
+func (f *memberFile) Seek(offset int64, whence int) (int64, error) {
+	if f.section != nil {
+		return f.section.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.entry.size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.entry.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memberFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.entry.name, Err: errReadOnly}
+}
+
+func (f *memberFile) closeStream() {
+	if f.close != nil {
+		f.close()
+		f.stream, f.close = nil, nil
+	}
+}
+
+func (f *memberFile) Close() error {
+	f.closeStream()
+	return f.file.Close()
+}
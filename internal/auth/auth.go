@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/model"
+)
+
+var (
+	// ErrNoCredential means the request carries no credential the provider understands.
+	ErrNoCredential = errors.New("no credential")
+	// ErrUserNotFound means the provider does not know the user.
+	ErrUserNotFound = errors.New("user not found")
+	// ErrInvalidCredential means the provider knows the user but the credential is wrong.
+	ErrInvalidCredential = errors.New("invalid credential")
+	// ErrStaleCredential means the credential has expired, e.g. the nonce of
+	// digest authentication, which the client renews without the user. It is
+	// not a failed login.
+	ErrStaleCredential = errors.New("stale credential")
+)
+
+type Authenticator interface {
+	Name() string
+	Authenticate(r *http.Request) (*model.User, error)
+}
+
+// Challenger is implemented by authenticators which want to advertise
+// themselves in the WWW-Authenticate header of a 401 response.
+type Challenger interface {
+	Challenge() string
+}
+
+// RequestChallenger is a Challenger whose challenges depend on the request,
+// e.g. with fresh nonces.
+type RequestChallenger interface {
+	Challenges(r *http.Request) []string
+}
+
+type Factory func(cfg *conf.Conf) (Authenticator, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("auth provider[%s] registered twice", name))
+	}
+	registry[name] = factory
+}
+
+func Providers() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Chain tries the authenticators in order, the first success wins.
+type Chain struct {
+	authenticators []Authenticator
+	fallThrough    bool
+	// users who need a client certificate in addition to the password
+	certRequired map[string]bool
+	certMapper   *certMapper
+}
+
+func NewChain(cfg *conf.Conf) (*Chain, error) {
+	c := &Chain{certRequired: map[string]bool{}}
+	names := ProviderNames(cfg)
+	if cfg.Auth != nil {
+		c.fallThrough = cfg.Auth.Fallthrough
+		c.certMapper = newCertMapper(cfg.Auth.Cert)
+	}
+	for _, u := range cfg.User {
+		if u.Cert == "required" {
+			c.certRequired[u.Username] = true
+		}
+	}
+
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	for _, name := range names {
+		factory, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("auth provider[%s] not found", name)
+		}
+		a, err := factory(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("create auth provider[%s] error: %w", name, err)
+		}
+		c.authenticators = append(c.authenticators, a)
+	}
+
+	return c, nil
+}
+
+// ProviderNames returns the configured providers, or the default ones derived
+// from the configure file.
+func ProviderNames(cfg *conf.Conf) []string {
+	if cfg.Auth != nil && len(cfg.Auth.Providers) > 0 {
+		return slices.Clone(cfg.Auth.Providers)
+	}
+
+	// client certificates and app tokens go first, the password of the user
+	// would reject them otherwise
+	var names []string
+	if cfg.Auth != nil && cfg.Auth.Cert != nil {
+		names = append(names, "cert")
+	}
+	if cfg.Auth != nil && cfg.Auth.Token != nil {
+		names = append(names, "token")
+	}
+	names = append(names, "basic")
+	if cfg.Auth != nil && cfg.Auth.Digest != nil {
+		names = append(names, "digest")
+	}
+	if cfg.Auth != nil && cfg.Auth.Htpasswd != nil {
+		names = append(names, "htpasswd")
+	}
+	if cfg.Auth != nil && cfg.Auth.Ldap != nil {
+		names = append(names, "ldap")
+	}
+	if cfg.Auth != nil && cfg.Auth.Jwt != nil {
+		names = append(names, "jwt")
+	}
+	return names
+}
+
+func (c *Chain) Name() string {
+	return "chain"
+}
+
+// Authenticate returns the user from the first authenticator which succeeds.
+// Requests without a known user are passed on to the next authenticator, and
+// so are wrong credentials when fallthrough is enabled. The most specific
+// error is returned when all of them fail.
+func (c *Chain) Authenticate(r *http.Request) (*model.User, error) {
+	lastErr := ErrNoCredential
+	for _, a := range c.authenticators {
+		user, err := a.Authenticate(r)
+		if err == nil {
+			if err := c.checkCert(r, user); err != nil {
+				return nil, err
+			}
+			return user, nil
+		}
+		switch {
+		case errors.Is(err, ErrNoCredential):
+		case errors.Is(err, ErrStaleCredential):
+			if errors.Is(lastErr, ErrNoCredential) {
+				lastErr = err
+			}
+		case errors.Is(err, ErrUserNotFound):
+			if errors.Is(lastErr, ErrNoCredential) {
+				lastErr = err
+			}
+		default:
+			if !c.fallThrough {
+				return nil, err
+			}
+			lastErr = err
+		}
+	}
+
+	return nil, lastErr
+}
+
+func (c *Chain) checkCert(r *http.Request, user *model.User) error {
+	if !c.certRequired[user.Username] {
+		return nil
+	}
+	if c.certMapper != nil {
+		if username, ok := c.certMapper.Username(r); ok && username == user.Username {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: client certificate required", ErrInvalidCredential)
+}
+
+func (c *Chain) Challenges(r *http.Request) []string {
+	var challenges []string
+	for _, a := range c.authenticators {
+		switch ch := a.(type) {
+		case RequestChallenger:
+			challenges = append(challenges, ch.Challenges(r)...)
+		case Challenger:
+			if s := ch.Challenge(); !slices.Contains(challenges, s) {
+				challenges = append(challenges, s)
+			}
+		}
+	}
+	return challenges
+}
+
+// Username returns the username claimed by the request, before it is
+// authenticated.
+func Username(r *http.Request) string {
+	if username, _, ok := r.BasicAuth(); ok {
+		return username
+	}
+	if params, ok := digestParams(r); ok {
+		return params["username"]
+	}
+	return ""
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/llklkl/webdav/internal/model"
+)
+
+type fakeAuthenticator struct {
+	name string
+	err  error
+}
+
+func (f *fakeAuthenticator) Name() string {
+	return f.name
+}
+
+func (f *fakeAuthenticator) Authenticate(r *http.Request) (*model.User, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &model.User{Username: f.name}, nil
+}
+
+func TestChainAuthenticate(t *testing.T) {
+	ok := func(name string) Authenticator { return &fakeAuthenticator{name: name} }
+	fail := func(err error) Authenticator { return &fakeAuthenticator{err: err} }
+
+	cases := []struct {
+		name        string
+		chain       []Authenticator
+		fallThrough bool
+		user        string
+		err         error
+	}{
+		{"first success wins", []Authenticator{ok("a"), ok("b")}, false, "a", nil},
+		{"skip no credential", []Authenticator{fail(ErrNoCredential), ok("b")}, false, "b", nil},
+		{"skip unknown user", []Authenticator{fail(ErrUserNotFound), ok("b")}, false, "b", nil},
+		{"stop at invalid credential", []Authenticator{fail(ErrInvalidCredential), ok("b")}, false, "", ErrInvalidCredential},
+		{"fallthrough invalid credential", []Authenticator{fail(ErrInvalidCredential), ok("b")}, true, "b", nil},
+		{"most specific error", []Authenticator{fail(ErrInvalidCredential), fail(ErrUserNotFound), fail(ErrNoCredential)}, true, "", ErrInvalidCredential},
+		{"unknown user over no credential", []Authenticator{fail(ErrNoCredential), fail(ErrUserNotFound)}, false, "", ErrUserNotFound},
+		{"empty chain", nil, false, "", ErrNoCredential},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			chain := &Chain{authenticators: c.chain, fallThrough: c.fallThrough}
+			user, err := chain.Authenticate(httptest.NewRequest(http.MethodGet, "/", nil))
+			if !errors.Is(err, c.err) {
+				t.Fatalf("expect err %v, got %v", c.err, err)
+			}
+			if c.user != "" && (user == nil || user.Username != c.user) {
+				t.Fatalf("expect user %s, got %v", c.user, user)
+			}
+		})
+	}
+}
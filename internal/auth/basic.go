@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/model"
+	"github.com/llklkl/webdav/internal/password"
+)
+
+const verifiedCacheTTL = 10 * time.Minute
+
+func init() {
+	Register("basic", func(cfg *conf.Conf) (Authenticator, error) {
+		return NewBasic(cfg), nil
+	})
+}
+
+// verifiedKey identifies a (user, credential) pair that has been verified
+// successfully, so that changing the credential invalidates the entry.
+type verifiedKey struct {
+	username   string
+	credential string
+}
+
+// verifier checks passwords against credentials, and caches the successful
+// ones to avoid paying the cost of the hash algorithm on every request.
+type verifier struct {
+	key      []byte
+	verified *expirable.LRU[verifiedKey, []byte]
+}
+
+func newVerifier() *verifier {
+	v := &verifier{
+		key:      make([]byte, 32),
+		verified: expirable.NewLRU[verifiedKey, []byte](1024, nil, verifiedCacheTTL),
+	}
+	_, _ = rand.Read(v.key)
+	return v
+}
+
+func (v *verifier) Verify(username, credential, pwd string) bool {
+	key := verifiedKey{username: username, credential: credential}
+	mac := hmac.New(sha256.New, v.key)
+	mac.Write([]byte(pwd))
+	digest := mac.Sum(nil)
+	if cached, ok := v.verified.Get(key); ok && hmac.Equal(cached, digest) {
+		return true
+	}
+
+	ok, err := password.Verify(credential, pwd)
+	if err != nil {
+		slog.Warn("failed to verify credential", slog.String("username", username), slog.Any("err", err))
+		return false
+	}
+	if ok && password.Identify(credential) != password.Plaintext {
+		v.verified.Add(key, digest)
+	}
+
+	return ok
+}
+
+// Basic authenticates the users configured in [[user]] with HTTP basic authentication.
+type Basic struct {
+	users    map[string]string
+	verifier *verifier
+}
+
+func NewBasic(cfg *conf.Conf) *Basic {
+	b := &Basic{
+		users:    map[string]string{},
+		verifier: newVerifier(),
+	}
+	for _, u := range cfg.User {
+		// users of a sufficient client certificate may have no password
+		if u.Credential != "" {
+			b.users[u.Username] = u.Credential
+		}
+	}
+
+	return b
+}
+
+func (b *Basic) Name() string {
+	return "basic"
+}
+
+func (b *Basic) Challenge() string {
+	return `Basic realm="webdav"`
+}
+
+func (b *Basic) Authenticate(r *http.Request) (*model.User, error) {
+	username, pwd, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredential
+	}
+	credential, ok := b.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	if !b.verifier.Verify(username, credential, pwd) {
+		return nil, ErrInvalidCredential
+	}
+
+	return &model.User{Username: username, Local: true}, nil
+}
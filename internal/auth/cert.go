@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package auth
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/model"
+)
+
+func init() {
+	Register("cert", func(cfg *conf.Conf) (Authenticator, error) {
+		if cfg.Auth == nil || cfg.Auth.Cert == nil {
+			return nil, errors.New("[auth.cert] is not configured")
+		}
+		return NewCert(cfg), nil
+	})
+}
+
+// certMapper maps the verified client certificate of a request to a username.
+type certMapper struct {
+	from string
+	oid  asn1.ObjectIdentifier
+}
+
+func newCertMapper(cfg *conf.CertConf) *certMapper {
+	m := &certMapper{from: "cn"}
+	if cfg == nil || cfg.UsernameFrom == "" {
+		return m
+	}
+	m.from = cfg.UsernameFrom
+	if s, ok := strings.CutPrefix(cfg.UsernameFrom, "oid:"); ok {
+		m.from = "oid"
+		for _, arc := range strings.Split(s, ".") {
+			n, _ := strconv.Atoi(arc)
+			m.oid = append(m.oid, n)
+		}
+	}
+	return m
+}
+
+func (m *certMapper) Username(r *http.Request) (string, bool) {
+	// the chains are only set when the certificate is verified against the client CAs
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	var username string
+	switch m.from {
+	case "cn":
+		username = cert.Subject.CommonName
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			username = cert.EmailAddresses[0]
+		}
+	case "oid":
+		for _, name := range cert.Subject.Names {
+			if name.Type.Equal(m.oid) {
+				username = fmt.Sprint(name.Value)
+				break
+			}
+		}
+	}
+	return username, username != ""
+}
+
+// Cert authenticates the users configured in [[user]] with TLS client
+// certificates. Users whose certificate is required also need a password,
+// which is left to the other providers.
+type Cert struct {
+	mapper *certMapper
+	users  map[string]string
+}
+
+func NewCert(cfg *conf.Conf) *Cert {
+	c := &Cert{
+		mapper: newCertMapper(cfg.Auth.Cert),
+		users:  map[string]string{},
+	}
+	for _, u := range cfg.User {
+		if u.Cert != "" {
+			c.users[u.Username] = u.Cert
+		}
+	}
+
+	return c
+}
+
+func (c *Cert) Name() string {
+	return "cert"
+}
+
+func (c *Cert) Authenticate(r *http.Request) (*model.User, error) {
+	username, ok := c.mapper.Username(r)
+	if !ok {
+		return nil, ErrNoCredential
+	}
+	mode, ok := c.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	// the password of another user in the request is left to the other providers
+	if claimed := Username(r); mode != "sufficient" || (claimed != "" && claimed != username) {
+		return nil, ErrNoCredential
+	}
+
+	return &model.User{Username: username, Attributes: map[string]string{"cert": username}, Local: true}, nil
+}
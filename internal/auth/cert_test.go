@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/llklkl/webdav/conf"
+)
+
+func withCert(r *http.Request, cert *x509.Certificate) *http.Request {
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return r
+}
+
+func TestCertMapper(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: "alice",
+			Names: []pkix.AttributeTypeAndValue{
+				{Type: asn1.ObjectIdentifier{2, 5, 4, 45}, Value: "uid-42"},
+			},
+		},
+		EmailAddresses: []string{"alice@example.com"},
+	}
+	tests := []struct {
+		from string
+		want string
+	}{
+		{"", "alice"},
+		{"cn", "alice"},
+		{"email", "alice@example.com"},
+		{"oid:2.5.4.45", "uid-42"},
+	}
+	for _, tt := range tests {
+		m := newCertMapper(&conf.CertConf{UsernameFrom: tt.from})
+		got, ok := m.Username(withCert(basicRequest("", ""), cert))
+		if !ok || got != tt.want {
+			t.Errorf("username from %q: got %q, want %q", tt.from, got, tt.want)
+		}
+	}
+
+	// unverified certificates are ignored
+	r := basicRequest("", "")
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if _, ok := newCertMapper(nil).Username(r); ok {
+		t.Error("expect no username without verified chains")
+	}
+}
+
+func TestCertChain(t *testing.T) {
+	cfg := &conf.Conf{
+		User: []*conf.UserConf{
+			{Username: "alice", Cert: "sufficient"},
+			{Username: "bob", Credential: "bobpw", Cert: "required"},
+			{Username: "carol", Credential: "carolpw"},
+		},
+		Security: &conf.SecurityConf{AllowPlaintextCredential: true},
+		Auth:     &conf.AuthConf{Cert: &conf.CertConf{}},
+	}
+	chain, err := NewChain(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := func(cn string) *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+	}
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		user string
+		err  error
+	}{
+		{"certificate only", withCert(basicRequest("", ""), cert("alice")), "alice", nil},
+		{"no password for certificate only user", basicRequest("alice", ""), "", ErrUserNotFound},
+		{"certificate and password", withCert(basicRequest("bob", "bobpw"), cert("bob")), "bob", nil},
+		{"required certificate missing", basicRequest("bob", "bobpw"), "", ErrInvalidCredential},
+		{"required certificate of other user", withCert(basicRequest("bob", "bobpw"), cert("alice")), "", ErrInvalidCredential},
+		{"certificate without password", withCert(&http.Request{Header: http.Header{}}, cert("bob")), "", ErrNoCredential},
+		{"password only user", withCert(basicRequest("carol", "carolpw"), cert("carol")), "carol", nil},
+	}
+	for _, tt := range tests {
+		user, err := chain.Authenticate(tt.r)
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s: expect %v, got %v", tt.name, tt.err, err)
+			}
+			continue
+		}
+		if err != nil || user.Username != tt.user {
+			t.Errorf("%s: expect user %s, got %+v %v", tt.name, tt.user, user, err)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/model"
+	"github.com/llklkl/webdav/internal/password"
+)
+
+const (
+	defaultDigestRealm    = "webdav"
+	defaultDigestNonceTTL = 5 * time.Minute
+	maxDigestNonces       = 65536
+	// nonce counts older than the window are treated as replays
+	digestNonceWindow = 64
+)
+
+var defaultDigestAlgorithms = []string{"SHA-256", "MD5"}
+
+// errStaleNonce makes the client retry with a fresh nonce without asking the
+// user for the password again.
+var errStaleNonce = fmt.Errorf("%w: stale nonce", ErrStaleCredential)
+
+func init() {
+	Register("digest", func(cfg *conf.Conf) (Authenticator, error) {
+		if cfg.Auth == nil || cfg.Auth.Digest == nil {
+			return nil, errors.New("[auth.digest] is not configured")
+		}
+		return NewDigest(cfg), nil
+	})
+}
+
+type digestNonce struct {
+	mu   sync.Mutex
+	max  uint64
+	seen uint64
+}
+
+// use records the nonce count, and reports false if it has been used.
+func (n *digestNonce) use(nc uint64) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if nc > n.max {
+		shift := nc - n.max
+		if shift >= digestNonceWindow {
+			n.seen = 0
+		} else {
+			n.seen <<= shift
+		}
+		n.seen |= 1
+		n.max = nc
+		return true
+	}
+	diff := n.max - nc
+	if diff >= digestNonceWindow || n.seen&(1<<diff) != 0 {
+		return false
+	}
+	n.seen |= 1 << diff
+	return true
+}
+
+// Digest authenticates the users configured in [[user]] with HTTP digest
+// authentication (RFC 7616), qop=auth only. Nonces are the issue time signed
+// with a secret, so that challenges keep no state, only the nonces which
+// authenticate a user record their nonce counts.
+type Digest struct {
+	realm      string
+	algorithms []string
+	ttl        time.Duration
+	secret     []byte
+	now        func() time.Time
+	// username -> algorithm -> hex of H(username:realm:password)
+	users  map[string]map[string]string
+	mu     sync.Mutex
+	nonces *expirable.LRU[string, *digestNonce]
+}
+
+func NewDigest(cfg *conf.Conf) *Digest {
+	dc := cfg.Auth.Digest
+	d := &Digest{
+		realm:      dc.Realm,
+		algorithms: dc.Algorithms,
+		secret:     make([]byte, 32),
+		now:        time.Now,
+		users:      map[string]map[string]string{},
+	}
+	_, _ = rand.Read(d.secret)
+	if d.realm == "" {
+		d.realm = defaultDigestRealm
+	}
+	if len(d.algorithms) == 0 {
+		d.algorithms = defaultDigestAlgorithms
+	}
+	d.ttl = dc.NonceTTL
+	if d.ttl == 0 {
+		d.ttl = defaultDigestNonceTTL
+	}
+	d.nonces = expirable.NewLRU[string, *digestNonce](maxDigestNonces, nil, d.ttl)
+
+	for _, u := range cfg.User {
+		ha1 := map[string]string{}
+		for algorithm, h := range u.DigestHa1 {
+			ha1[algorithm] = strings.ToLower(h)
+		}
+		if u.Credential != "" && password.Identify(u.Credential) == password.Plaintext {
+			for _, algorithm := range d.algorithms {
+				if _, ok := ha1[algorithm]; !ok {
+					ha1[algorithm] = digestHash(algorithm, u.Username+":"+d.realm+":"+u.Credential)
+				}
+			}
+		}
+		if len(ha1) > 0 {
+			d.users[u.Username] = ha1
+		}
+	}
+
+	return d
+}
+
+func (d *Digest) Name() string {
+	return "digest"
+}
+
+// newNonce returns the issue time and random bytes, followed by their HMAC.
+func (d *Digest) newNonce() string {
+	b := make([]byte, 16, 16+sha256.Size)
+	binary.BigEndian.PutUint64(b, uint64(d.now().UnixNano()))
+	_, _ = rand.Read(b[8:])
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(b))
+}
+
+// validNonce reports whether the nonce is issued by newNonce within the ttl.
+func (d *Digest) validNonce(nonce string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 16+sha256.Size {
+		return false
+	}
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write(b[:16])
+	if !hmac.Equal(mac.Sum(nil), b[16:]) {
+		return false
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	return d.now().Before(issued.Add(d.ttl))
+}
+
+// nonceCounts returns the nonce counts used with the nonce.
+func (d *Digest) nonceCounts(nonce string) *digestNonce {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	counts, ok := d.nonces.Get(nonce)
+	if !ok {
+		counts = &digestNonce{}
+		d.nonces.Add(nonce, counts)
+	}
+	return counts
+}
+
+func (d *Digest) Challenges(r *http.Request) []string {
+	stale := false
+	if params, ok := digestParams(r); ok {
+		stale = !d.validNonce(params["nonce"])
+	}
+
+	nonce := d.newNonce()
+
+	challenges := make([]string, 0, len(d.algorithms))
+	for _, algorithm := range d.algorithms {
+		challenge := fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=%s, nonce="%s"`, d.realm, algorithm, nonce)
+		if stale {
+			challenge += ", stale=true"
+		}
+		challenges = append(challenges, challenge)
+	}
+	return challenges
+}
+
+func (d *Digest) Authenticate(r *http.Request) (*model.User, error) {
+	params, ok := digestParams(r)
+	if !ok {
+		return nil, ErrNoCredential
+	}
+	username := params["username"]
+	ha1s, ok := d.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	algorithm := params["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	i := slices.IndexFunc(d.algorithms, func(a string) bool { return strings.EqualFold(a, algorithm) })
+	if i < 0 {
+		return nil, fmt.Errorf("%w: unsupported algorithm", ErrInvalidCredential)
+	}
+	algorithm = d.algorithms[i]
+	ha1, ok := ha1s[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("%w: no %s credential", ErrInvalidCredential, algorithm)
+	}
+	if params["realm"] != d.realm || params["qop"] != "auth" || params["uri"] != r.RequestURI {
+		return nil, fmt.Errorf("%w: mismatched parameters", ErrInvalidCredential)
+	}
+	ncHex := params["nc"]
+	nc, err := strconv.ParseUint(ncHex, 16, 64)
+	if err != nil || len(ncHex) != 8 || nc == 0 || params["cnonce"] == "" {
+		return nil, fmt.Errorf("%w: malformed nonce count", ErrInvalidCredential)
+	}
+	if !d.validNonce(params["nonce"]) {
+		return nil, errStaleNonce
+	}
+
+	ha2 := digestHash(algorithm, r.Method+":"+params["uri"])
+	expected := digestHash(algorithm, strings.Join([]string{
+		ha1, params["nonce"], ncHex, params["cnonce"], params["qop"], ha2,
+	}, ":"))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 {
+		return nil, ErrInvalidCredential
+	}
+	if !d.nonceCounts(params["nonce"]).use(nc) {
+		return nil, fmt.Errorf("%w: replayed nonce count", ErrInvalidCredential)
+	}
+
+	return &model.User{Username: username, Local: true}, nil
+}
+
+func digestHash(algorithm, s string) string {
+	var h hash.Hash
+	if algorithm == "SHA-256" {
+		h = sha256.New()
+	} else {
+		h = md5.New()
+	}
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func digestParams(r *http.Request) (map[string]string, bool) {
+	const prefix = "Digest "
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) <= len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return nil, false
+	}
+	return parseDigestParams(authorization[len(prefix):]), true
+}
+
+// parseDigestParams parses the comma separated key=value pairs, values may be
+// quoted strings.
+func parseDigestParams(s string) map[string]string {
+	params := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return params
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			b := strings.Builder{}
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			value = b.String()
+			s = s[min(i+1, len(s)):]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[key] = value
+	}
+}
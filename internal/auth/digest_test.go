@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/llklkl/webdav/conf"
+)
+
+func digestRequest(d *Digest, algorithm, username, pwd, nonce, nc string) *http.Request {
+	r := httptest.NewRequest("PROPFIND", "/dav/a%20b.txt", nil)
+	ha1 := digestHash(algorithm, username+":"+d.realm+":"+pwd)
+	ha2 := digestHash(algorithm, r.Method+":"+r.RequestURI)
+	response := digestHash(algorithm, strings.Join([]string{ha1, nonce, nc, "cn", "auth", ha2}, ":"))
+	r.Header.Set("Authorization", fmt.Sprintf(
+		`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s, qop=auth, nc=%s, cnonce="cn", response="%s"`,
+		username, d.realm, nonce, r.RequestURI, algorithm, nc, response))
+	return r
+}
+
+func challengeNonce(t *testing.T, d *Digest, r *http.Request) (string, bool) {
+	challenges := d.Challenges(r)
+	if len(challenges) != 2 {
+		t.Fatalf("expect a challenge per algorithm, got %v", challenges)
+	}
+	params, _ := digestParams(&http.Request{Header: http.Header{"Authorization": {challenges[0]}}})
+	return params["nonce"], params["stale"] == "true"
+}
+
+func TestDigestAuthenticate(t *testing.T) {
+	d := NewDigest(&conf.Conf{
+		User: []*conf.UserConf{
+			{Username: "alice", Credential: "secret"},
+			{Username: "bob", Credential: "$2y$10$short", DigestHa1: map[string]string{
+				"SHA-256": digestHash("SHA-256", "bob:webdav:bobpw"),
+			}},
+		},
+		Auth: &conf.AuthConf{Digest: &conf.DigestConf{}},
+	})
+	nonce, stale := challengeNonce(t, d, httptest.NewRequest(http.MethodGet, "/", nil))
+	if stale {
+		t.Error("expect no stale without credential")
+	}
+
+	for i, algorithm := range []string{"SHA-256", "MD5"} {
+		if _, err := d.Authenticate(digestRequest(d, algorithm, "alice", "secret", nonce, fmt.Sprintf("%08x", i+1))); err != nil {
+			t.Errorf("%s: %v", algorithm, err)
+		}
+	}
+	if _, err := d.Authenticate(digestRequest(d, "SHA-256", "bob", "bobpw", nonce, "00000003")); err != nil {
+		t.Errorf("bob: %v", err)
+	}
+
+	for _, c := range []struct {
+		name string
+		r    *http.Request
+		err  error
+	}{
+		{"replay", digestRequest(d, "MD5", "alice", "secret", nonce, "00000001"), ErrInvalidCredential},
+		{"wrong password", digestRequest(d, "SHA-256", "alice", "wrong", nonce, "00000004"), ErrInvalidCredential},
+		{"no ha1", digestRequest(d, "MD5", "bob", "bobpw", nonce, "00000004"), ErrInvalidCredential},
+		{"unknown user", digestRequest(d, "SHA-256", "carol", "secret", nonce, "00000004"), ErrUserNotFound},
+		{"unknown nonce", digestRequest(d, "SHA-256", "alice", "secret", "unknown", "00000001"), ErrStaleCredential},
+	} {
+		if _, err := d.Authenticate(c.r); !errors.Is(err, c.err) {
+			t.Errorf("%s: expect %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	// out of order nonce counts within the window are accepted once
+	for _, nc := range []string{"00000008", "00000006"} {
+		if _, err := d.Authenticate(digestRequest(d, "SHA-256", "alice", "secret", nonce, nc)); err != nil {
+			t.Errorf("nc %s: %v", nc, err)
+		}
+	}
+	if _, err := d.Authenticate(digestRequest(d, "SHA-256", "alice", "secret", nonce, "00000006")); !errors.Is(err, ErrInvalidCredential) {
+		t.Errorf("expect replay to be rejected, got %v", err)
+	}
+
+	if _, stale := challengeNonce(t, d, digestRequest(d, "SHA-256", "alice", "secret", "unknown", "00000001")); !stale {
+		t.Error("expect stale for unknown nonce")
+	}
+
+	// challenges keep no state, only the nonce used by alice is recorded
+	for range 100 {
+		challengeNonce(t, d, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	if n := d.nonces.Len(); n != 1 {
+		t.Errorf("expect 1 recorded nonce, got %d", n)
+	}
+
+	now := time.Now()
+	d.now = func() time.Time { return now.Add(defaultDigestNonceTTL) }
+	if _, err := d.Authenticate(digestRequest(d, "SHA-256", "alice", "secret", nonce, "00000009")); !errors.Is(err, ErrStaleCredential) {
+		t.Errorf("expired nonce: expect stale credential, got %v", err)
+	}
+}
+
+func TestParseDigestParams(t *testing.T) {
+	params := parseDigestParams(`username="a \"b\", c", realm=webdav,qop=auth ,  nc=00000001, empty=""`)
+	expected := map[string]string{"username": `a "b", c`, "realm": "webdav", "qop": "auth", "nc": "00000001", "empty": ""}
+	for k, v := range expected {
+		if params[k] != v {
+			t.Errorf("%s: expect %q, got %q", k, v, params[k])
+		}
+	}
+}
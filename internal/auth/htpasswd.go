@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/model"
+	"github.com/llklkl/webdav/internal/password"
+	"github.com/llklkl/webdav/internal/pkg"
+)
+
+const htpasswdReloadInterval = 5 * time.Second
+
+func init() {
+	Register("htpasswd", func(cfg *conf.Conf) (Authenticator, error) {
+		if cfg.Auth == nil || cfg.Auth.Htpasswd == nil {
+			return nil, errors.New("[auth.htpasswd] is not configured")
+		}
+		return NewHtpasswd(cfg.Auth.Htpasswd, cfg.Security.AllowPlaintextCredential)
+	})
+}
+
+// Htpasswd authenticates users in an Apache htpasswd file with HTTP basic
+// authentication, the file is reloaded when it changes.
+type Htpasswd struct {
+	path           string
+	allowPlaintext bool
+	verifier       *verifier
+	defaultScope   []string
+	userScope      map[string][]string
+
+	mu      sync.RWMutex
+	users   map[string]string
+	modTime time.Time
+	size    int64
+}
+
+func NewHtpasswd(cfg *conf.HtpasswdConf, allowPlaintext bool) (*Htpasswd, error) {
+	h := &Htpasswd{
+		path:           cfg.Path,
+		allowPlaintext: allowPlaintext,
+		verifier:       newVerifier(),
+		defaultScope:   cfg.DefaultScope,
+		userScope:      cfg.UserScope,
+		users:          map[string]string{},
+	}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	pkg.SafeG(h.watch)
+
+	return h, nil
+}
+
+func (h *Htpasswd) Name() string {
+	return "htpasswd"
+}
+
+func (h *Htpasswd) Challenge() string {
+	return `Basic realm="webdav"`
+}
+
+func (h *Htpasswd) Authenticate(r *http.Request) (*model.User, error) {
+	username, pwd, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredential
+	}
+	credential, ok := h.get(username)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	if !h.verifier.Verify(username, credential, pwd) {
+		return nil, ErrInvalidCredential
+	}
+
+	scope, ok := h.userScope[username]
+	if !ok {
+		scope = h.defaultScope
+	}
+	return &model.User{Username: username, Scope: scope}, nil
+}
+
+func (h *Htpasswd) get(username string) (string, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	credential, ok := h.users[username]
+	return credential, ok
+}
+
+func (h *Htpasswd) load() error {
+	fp, err := os.Open(h.path)
+	if err != nil {
+		return fmt.Errorf("open htpasswd file error: %w", err)
+	}
+	defer fp.Close()
+
+	info, err := fp.Stat()
+	if err != nil {
+		return fmt.Errorf("stat htpasswd file error: %w", err)
+	}
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(fp)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		username, credential, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			slog.Warn("invalid htpasswd entry", slog.String("path", h.path), slog.Int("line", lineNo))
+			continue
+		}
+		if password.Identify(credential) == password.Plaintext {
+			if !h.allowPlaintext {
+				slog.Warn("unsupported htpasswd entry", slog.String("path", h.path),
+					slog.Int("line", lineNo), slog.String("username", username))
+				continue
+			}
+		} else if err := password.Check(credential); err != nil {
+			slog.Warn("invalid htpasswd entry", slog.String("path", h.path),
+				slog.Int("line", lineNo), slog.String("username", username), slog.Any("err", err))
+			continue
+		}
+		users[username] = credential
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read htpasswd file error: %w", err)
+	}
+
+	h.mu.Lock()
+	h.users = users
+	h.modTime = info.ModTime()
+	h.size = info.Size()
+	h.mu.Unlock()
+
+	return nil
+}
+
+func (h *Htpasswd) changed() bool {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		slog.Warn("stat htpasswd file error", slog.String("path", h.path), slog.Any("err", err))
+		return false
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return !info.ModTime().Equal(h.modTime) || info.Size() != h.size
+}
+
+func (h *Htpasswd) watch() {
+	ticker := time.NewTicker(htpasswdReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !h.changed() {
+			continue
+		}
+		if err := h.load(); err != nil {
+			slog.Error("failed to reload htpasswd file", slog.String("path", h.path), slog.Any("err", err))
+			continue
+		}
+		slog.Info("htpasswd file reloaded", slog.String("path", h.path))
+	}
+}
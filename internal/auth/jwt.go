@@ -0,0 +1,460 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/model"
+)
+
+const (
+	defaultJwtUsernameClaim = "sub"
+	defaultJwtScopeClaim    = "scopes"
+	defaultJwtGroupClaim    = "groups"
+	maxJwtLength            = 8192
+)
+
+func init() {
+	Register("jwt", func(cfg *conf.Conf) (Authenticator, error) {
+		if cfg.Auth == nil || cfg.Auth.Jwt == nil {
+			return nil, errors.New("[auth.jwt] is not configured")
+		}
+		return NewJwt(cfg.Auth.Jwt)
+	})
+}
+
+type jwtKey struct {
+	kid string
+	alg string
+	// []byte, *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey
+	key any
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Jwt authenticates bearer tokens signed by the configured HMAC secrets or
+// the public keys in a local JWKS file.
+type Jwt struct {
+	cfg  *conf.JwtConf
+	keys []*jwtKey
+	now  func() time.Time
+}
+
+func NewJwt(cfg *conf.JwtConf) (*Jwt, error) {
+	j := &Jwt{
+		cfg: cfg,
+		now: time.Now,
+	}
+	for _, secret := range cfg.HmacSecrets {
+		j.keys = append(j.keys, &jwtKey{key: []byte(secret)})
+	}
+	if cfg.JwksPath != "" {
+		keys, err := loadJwks(cfg.JwksPath)
+		if err != nil {
+			return nil, err
+		}
+		j.keys = append(j.keys, keys...)
+	}
+
+	return j, nil
+}
+
+func (j *Jwt) Name() string {
+	return "jwt"
+}
+
+func (j *Jwt) Challenge() string {
+	return `Bearer realm="webdav"`
+}
+
+func (j *Jwt) Authenticate(r *http.Request) (*model.User, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredential
+	}
+	claims, err := j.verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	usernameClaim := j.cfg.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = defaultJwtUsernameClaim
+	}
+	username, _ := claims[usernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("%w: empty claim[%s]", ErrInvalidCredential, usernameClaim)
+	}
+	scopeClaim := j.cfg.ScopeClaim
+	if scopeClaim == "" {
+		scopeClaim = defaultJwtScopeClaim
+	}
+	groupClaim := j.cfg.GroupClaim
+	if groupClaim == "" {
+		groupClaim = defaultJwtGroupClaim
+	}
+
+	return &model.User{
+		Username: username,
+		Groups:   stringsClaim(claims[groupClaim]),
+		Scope:    stringsClaim(claims[scopeClaim]),
+	}, nil
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) <= len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(authorization[len(prefix):]), true
+}
+
+func (j *Jwt) verify(token string) (map[string]any, error) {
+	if len(token) > maxJwtLength {
+		return nil, fmt.Errorf("%w: token too long", ErrInvalidCredential)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidCredential)
+	}
+
+	var header jwtHeader
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: malformed header", ErrInvalidCredential)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidCredential)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range j.keys {
+		if header.Kid != "" && key.kid != "" && header.Kid != key.kid {
+			continue
+		}
+		if key.alg != "" && key.alg != header.Alg {
+			continue
+		}
+		if verifyJwtSignature(header.Alg, key.key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidCredential)
+	}
+
+	var claims map[string]any
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed claims", ErrInvalidCredential)
+	}
+	if err := j.validClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (j *Jwt) validClaims(claims map[string]any) error {
+	now := j.now()
+	if v, ok := claims["exp"]; ok {
+		exp, ok := numericClaim(v)
+		if !ok || !now.Before(exp.Add(j.cfg.Leeway)) {
+			return fmt.Errorf("%w: token expired", ErrInvalidCredential)
+		}
+	} else if !j.cfg.AllowNoExp {
+		return fmt.Errorf("%w: token without exp", ErrInvalidCredential)
+	}
+	if v, ok := claims["nbf"]; ok {
+		nbf, ok := numericClaim(v)
+		if !ok || now.Add(j.cfg.Leeway).Before(nbf) {
+			return fmt.Errorf("%w: token not valid yet", ErrInvalidCredential)
+		}
+	}
+	if j.cfg.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != j.cfg.Issuer {
+			return fmt.Errorf("%w: unexpected issuer", ErrInvalidCredential)
+		}
+	}
+	if j.cfg.Audience != "" {
+		found := false
+		for _, aud := range stringsClaim(claims["aud"]) {
+			if aud == j.cfg.Audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: unexpected audience", ErrInvalidCredential)
+		}
+	}
+
+	return nil
+}
+
+func decodeJwtPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+func numericClaim(v any) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(f*float64(time.Second))), true
+}
+
+// stringsClaim accepts both an array of strings and a space separated string.
+func stringsClaim(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		values := make([]string, 0, len(v))
+		for i := range v {
+			if s, ok := v[i].(string); ok && s != "" {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func jwtHash(alg string) (crypto.Hash, func() hash.Hash) {
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256, sha256.New
+	case "384":
+		return crypto.SHA384, sha512.New384
+	case "512":
+		return crypto.SHA512, sha512.New
+	}
+	return 0, nil
+}
+
+func verifyJwtSignature(alg string, key any, signed, signature []byte) bool {
+	switch alg {
+	case "HS256", "HS384", "HS512":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		_, h := jwtHash(alg)
+		mac := hmac.New(h, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case "RS256", "RS384", "RS512":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		id, h := jwtHash(alg)
+		digest := h()
+		digest.Write(signed)
+		return rsa.VerifyPKCS1v15(pub, id, digest.Sum(nil), signature) == nil
+	case "ES256", "ES384", "ES512":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size || curveAlg(pub.Curve) != alg {
+			return false
+		}
+		_, h := jwtHash(alg)
+		digest := h()
+		digest.Write(signed)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(pub, digest.Sum(nil), r, s)
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return false
+		}
+		return ed25519.Verify(pub, signed, signature)
+	}
+
+	return false
+}
+
+func curveAlg(curve elliptic.Curve) string {
+	switch curve {
+	case elliptic.P256():
+		return "ES256"
+	case elliptic.P384():
+		return "ES384"
+	case elliptic.P521():
+		return "ES512"
+	}
+	return ""
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func loadJwks(path string) ([]*jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read jwks file error: %w", err)
+	}
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parse jwks file error: %w", err)
+	}
+
+	keys := make([]*jwtKey, 0, len(set.Keys))
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("parse key[%d] of jwks file error: %w", i, err)
+		}
+		keys = append(keys, &jwtKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing key found in jwks file")
+	}
+
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (any, error) {
+	decode := func(s string) ([]byte, error) {
+		if s == "" {
+			return nil, errors.New("missing key parameter")
+		}
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve[%s]", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid ec point")
+		}
+		// validated through the uncompressed point encoding
+		point := append([]byte{4}, append(x, y...)...)
+		pub, err := ecdsa.ParseUncompressedPublicKey(curve, point)
+		if err != nil {
+			return nil, err
+		}
+		return pub, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve[%s]", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type[%s]", k.Kty)
+}
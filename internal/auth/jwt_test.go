@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/llklkl/webdav/conf"
+)
+
+const testHmacSecret = "0123456789abcdef0123456789abcdef"
+
+func signJwt(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, e := ecdsa.Sign(rand.Reader, k, digest[:])
+		sig, err = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...), e
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestJwtAuthenticate(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherEcKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+		{"kty": "EC", "kid": "ec", "crv": "P-256",
+			"x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edPub)},
+	}})
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksPath, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := NewJwt(&conf.JwtConf{
+		HmacSecrets: []string{testHmacSecret},
+		JwksPath:    jwksPath,
+		Audience:    "webdav",
+		Leeway:      time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	j.now = func() time.Time { return now }
+
+	claims := func(extra map[string]any) map[string]any {
+		c := map[string]any{"sub": "ci", "aud": []string{"webdav"}, "scopes": []string{"upload"}, "exp": now.Unix() + 60}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+
+	for _, c := range []struct {
+		name string
+		alg  string
+		kid  string
+		key  any
+	}{
+		{"HS256", "HS256", "", []byte(testHmacSecret)},
+		{"RS256", "RS256", "rsa", rsaKey},
+		{"ES256", "ES256", "ec", ecKey},
+		{"EdDSA", "EdDSA", "ed", edKey},
+		{"ES256 without kid", "ES256", "", ecKey},
+	} {
+		user, err := j.Authenticate(bearerRequest(signJwt(t, c.alg, c.kid, c.key, claims(nil))))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if user.Username != "ci" || !slices.Equal(user.Scope, []string{"upload"}) {
+			t.Errorf("%s: unexpected user %+v", c.name, user)
+		}
+	}
+
+	user, err := j.Authenticate(bearerRequest(signJwt(t, "HS256", "", []byte(testHmacSecret),
+		claims(map[string]any{"scopes": "media backup", "aud": "webdav"}))))
+	if err != nil || !slices.Equal(user.Scope, []string{"media", "backup"}) {
+		t.Errorf("space separated scopes: %v, %+v", err, user)
+	}
+	user, err = j.Authenticate(bearerRequest(signJwt(t, "HS256", "", []byte(testHmacSecret),
+		claims(map[string]any{"groups": []string{"admins", "ci"}}))))
+	if err != nil || !slices.Equal(user.Groups, []string{"admins", "ci"}) {
+		t.Errorf("groups: %v, %+v", err, user)
+	}
+
+	for _, c := range []struct {
+		name  string
+		token string
+	}{
+		{"expired", signJwt(t, "HS256", "", []byte(testHmacSecret), claims(map[string]any{"exp": now.Unix() - 120}))},
+		{"not before", signJwt(t, "HS256", "", []byte(testHmacSecret), claims(map[string]any{"nbf": now.Unix() + 120}))},
+		{"audience", signJwt(t, "HS256", "", []byte(testHmacSecret), claims(map[string]any{"aud": "other"}))},
+		{"empty subject", signJwt(t, "HS256", "", []byte(testHmacSecret), claims(map[string]any{"sub": ""}))},
+		{"wrong secret", signJwt(t, "HS256", "", []byte("fedcba9876543210fedcba9876543210"), claims(nil))},
+		{"unknown key", signJwt(t, "ES256", "ec", otherEcKey, claims(nil))},
+		{"kid mismatch", signJwt(t, "RS256", "ec", rsaKey, claims(nil))},
+		{"alg none", signJwt(t, "none", "", nil, claims(nil))},
+		{"malformed", "a.b"},
+	} {
+		if _, err := j.Authenticate(bearerRequest(c.token)); !errors.Is(err, ErrInvalidCredential) {
+			t.Errorf("%s: expect invalid credential, got %v", c.name, err)
+		}
+	}
+
+	noExp := claims(nil)
+	delete(noExp, "exp")
+	token := signJwt(t, "HS256", "", []byte(testHmacSecret), noExp)
+	if _, err := j.Authenticate(bearerRequest(token)); !errors.Is(err, ErrInvalidCredential) {
+		t.Errorf("without exp: expect invalid credential, got %v", err)
+	}
+	j.cfg.AllowNoExp = true
+	if _, err := j.Authenticate(bearerRequest(token)); err != nil {
+		t.Errorf("without exp allowed: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth("ci", "secret")
+	if _, err := j.Authenticate(r); !errors.Is(err, ErrNoCredential) {
+		t.Errorf("basic auth: expect no credential, got %v", err)
+	}
+}
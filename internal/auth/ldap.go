@@ -0,0 +1,309 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/model"
+)
+
+const (
+	defaultLdapCacheTTL       = 5 * time.Minute
+	defaultLdapTimeout        = 10 * time.Second
+	defaultLdapGroupAttribute = "cn"
+	defaultLdapUserAttribute  = "uid"
+)
+
+func init() {
+	Register("ldap", func(cfg *conf.Conf) (Authenticator, error) {
+		if cfg.Auth == nil || cfg.Auth.Ldap == nil {
+			return nil, errors.New("[auth.ldap] is not configured")
+		}
+		return NewLdap(cfg.Auth.Ldap)
+	})
+}
+
+type ldapCacheKey struct {
+	username string
+	digest   string
+}
+
+// Ldap authenticates users against a directory with HTTP basic authentication.
+// It binds as the service account, searches the user, then binds as the user
+// to verify the password.
+type Ldap struct {
+	cfg       *conf.LdapConf
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	cacheKey []byte
+	cache    *expirable.LRU[ldapCacheKey, *model.User]
+}
+
+func NewLdap(cfg *conf.LdapConf) (*Ldap, error) {
+	l := &Ldap{
+		cfg:      cfg,
+		timeout:  cfg.Timeout,
+		cacheKey: make([]byte, 32),
+	}
+	if l.timeout == 0 {
+		l.timeout = defaultLdapTimeout
+	}
+	ttl := cfg.CacheTTL
+	if ttl == 0 {
+		ttl = defaultLdapCacheTTL
+	}
+	l.cache = expirable.NewLRU[ldapCacheKey, *model.User](1024, nil, ttl)
+	_, _ = rand.Read(l.cacheKey)
+
+	u, err := url.Parse(cfg.Url)
+	if err != nil {
+		return nil, err
+	}
+	l.tlsConfig = &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CaCertPath != "" {
+		pem, err := os.ReadFile(cfg.CaCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("read ldap ca cert error: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in ldap ca cert")
+		}
+		l.tlsConfig.RootCAs = pool
+	}
+
+	return l, nil
+}
+
+func (l *Ldap) Name() string {
+	return "ldap"
+}
+
+func (l *Ldap) Challenge() string {
+	return `Basic realm="webdav"`
+}
+
+func (l *Ldap) Authenticate(r *http.Request) (*model.User, error) {
+	username, pwd, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredential
+	}
+	// an empty password would be an unauthenticated bind, which always succeeds
+	if username == "" || pwd == "" {
+		return nil, ErrInvalidCredential
+	}
+
+	mac := hmac.New(sha256.New, l.cacheKey)
+	mac.Write([]byte(pwd))
+	key := ldapCacheKey{username: username, digest: string(mac.Sum(nil))}
+	if user, ok := l.cache.Get(key); ok {
+		return user, nil
+	}
+
+	user, err := l.authenticate(username, pwd)
+	if err != nil {
+		return nil, err
+	}
+	l.cache.Add(key, user)
+
+	return user, nil
+}
+
+func (l *Ldap) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(l.cfg.Url,
+		ldap.DialWithDialer(&net.Dialer{Timeout: l.timeout}),
+		ldap.DialWithTLSConfig(l.tlsConfig),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("dial ldap error: %w", err)
+	}
+	conn.SetTimeout(l.timeout)
+	if l.cfg.StartTls {
+		if err := conn.StartTLS(l.tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap start tls error: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+func (l *Ldap) bindService(conn *ldap.Conn) error {
+	if l.cfg.BindDn == "" {
+		return nil
+	}
+	if err := conn.Bind(l.cfg.BindDn, l.cfg.BindPassword); err != nil {
+		return fmt.Errorf("ldap bind service account error: %w", err)
+	}
+	return nil
+}
+
+func (l *Ldap) authenticate(username, pwd string) (*model.User, error) {
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := l.bindService(conn); err != nil {
+		return nil, err
+	}
+
+	userAttribute := l.cfg.UsernameAttribute
+	if userAttribute == "" {
+		userAttribute = defaultLdapUserAttribute
+	}
+	attributes := []string{userAttribute}
+	if l.cfg.MemberOfAttribute != "" {
+		attributes = append(attributes, l.cfg.MemberOfAttribute)
+	}
+	filter := strings.ReplaceAll(l.cfg.UserFilter, "{username}", ldap.EscapeFilter(username))
+	result, err := conn.Search(ldap.NewSearchRequest(
+		l.cfg.BaseDn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		filter, attributes, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldap search user error: %w", err)
+	}
+	if len(result.Entries) == 0 {
+		return nil, ErrUserNotFound
+	}
+	if len(result.Entries) > 1 {
+		return nil, fmt.Errorf("ldap search user[%s] returned multiple entries", username)
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, pwd); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredential
+		}
+		return nil, fmt.Errorf("ldap bind user error: %w", err)
+	}
+	// the name in the directory rather than as typed, which may differ in case
+	username = entry.GetAttributeValue(userAttribute)
+	if username == "" {
+		return nil, fmt.Errorf("ldap user[%s] has no attribute %s", entry.DN, userAttribute)
+	}
+
+	var groups []string
+	if l.cfg.MemberOfAttribute != "" {
+		for _, dn := range entry.GetAttributeValues(l.cfg.MemberOfAttribute) {
+			if name := groupNameFromDN(dn); name != "" && !slices.Contains(groups, name) {
+				groups = append(groups, name)
+			}
+		}
+	}
+	if l.cfg.GroupFilter != "" {
+		// search groups as the service account, the user may not be allowed to
+		if err := l.bindService(conn); err != nil {
+			return nil, err
+		}
+		names, err := l.searchGroups(conn, username, entry.DN)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if !slices.Contains(groups, name) {
+				groups = append(groups, name)
+			}
+		}
+	}
+
+	return &model.User{
+		Username:   username,
+		Groups:     groups,
+		Attributes: map[string]string{"dn": entry.DN},
+		Scope:      l.groupScope(groups),
+	}, nil
+}
+
+func (l *Ldap) searchGroups(conn *ldap.Conn, username, dn string) ([]string, error) {
+	attribute := l.cfg.GroupAttribute
+	if attribute == "" {
+		attribute = defaultLdapGroupAttribute
+	}
+	filter := strings.NewReplacer(
+		"{username}", ldap.EscapeFilter(username),
+		"{dn}", ldap.EscapeFilter(dn),
+	).Replace(l.cfg.GroupFilter)
+	result, err := conn.Search(ldap.NewSearchRequest(
+		l.cfg.GroupBaseDn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter, []string{attribute}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldap search groups error: %w", err)
+	}
+
+	names := make([]string, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		if name := entry.GetAttributeValue(attribute); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (l *Ldap) groupScope(groups []string) []string {
+	scope := slices.Clone(l.cfg.DefaultScope)
+	for _, group := range groups {
+		for _, name := range l.cfg.GroupScope[group] {
+			if !slices.Contains(scope, name) {
+				scope = append(scope, name)
+			}
+		}
+	}
+	return scope
+}
+
+// groupNameFromDN returns the value of the first RDN, e.g. admins for
+// cn=admins,ou=groups,dc=example,dc=com.
+func groupNameFromDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return ""
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
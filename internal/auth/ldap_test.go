@@ -0,0 +1,302 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package auth
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/llklkl/webdav/conf"
+)
+
+type ldapEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// ldapStandIn is a tiny in-process LDAP server which understands simple
+// binds and searches with and/or/not/equality/present filters.
+type ldapStandIn struct {
+	ln      net.Listener
+	entries []*ldapEntry
+	binds   atomic.Int32
+}
+
+func newLdapStandIn(t *testing.T, entries []*ldapEntry) *ldapStandIn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ldapStandIn{ln: ln, entries: entries}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *ldapStandIn) Url() string {
+	return "ldap://" + s.ln.Addr().String()
+}
+
+func (s *ldapStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id, _ := p.Children[0].Value.(int64)
+		op := p.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			s.binds.Add(1)
+			name, pwd := op.Children[1].Data.String(), op.Children[2].Data.String()
+			code := int64(ldap.LDAPResultInvalidCredentials)
+			if slices.ContainsFunc(s.entries, func(e *ldapEntry) bool {
+				return strings.EqualFold(e.dn, name) && e.password != "" && e.password == pwd
+			}) {
+				code = ldap.LDAPResultSuccess
+			}
+			_, _ = conn.Write(ldapMessage(id, ldap.ApplicationBindResponse, ldapResult(code)...).Bytes())
+		case ldap.ApplicationSearchRequest:
+			base := strings.ToLower(op.Children[0].Data.String())
+			filter := op.Children[6]
+			for _, e := range s.entries {
+				if !strings.HasSuffix(strings.ToLower(e.dn), base) || !matchLdapFilter(filter, e) {
+					continue
+				}
+				attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				for name, values := range e.attrs {
+					attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+					set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					for _, v := range values {
+						set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+					}
+					attr.AppendChild(set)
+					attrs.AppendChild(attr)
+				}
+				_, _ = conn.Write(ldapMessage(id, ldap.ApplicationSearchResultEntry,
+					ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""),
+					attrs,
+				).Bytes())
+			}
+			_, _ = conn.Write(ldapMessage(id, ldap.ApplicationSearchResultDone, ldapResult(ldap.LDAPResultSuccess)...).Bytes())
+		default:
+			return
+		}
+	}
+}
+
+func ldapMessage(id int64, tag ber.Tag, children ...*ber.Packet) *ber.Packet {
+	msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	for _, c := range children {
+		op.AppendChild(c)
+	}
+	msg.AppendChild(op)
+	return msg
+}
+
+func ldapResult(code int64) []*ber.Packet {
+	return []*ber.Packet{
+		ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""),
+		ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""),
+		ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""),
+	}
+}
+
+func matchLdapFilter(f *ber.Packet, e *ldapEntry) bool {
+	switch f.Tag {
+	case ldap.FilterAnd:
+		for _, c := range f.Children {
+			if !matchLdapFilter(c, e) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, c := range f.Children {
+			if matchLdapFilter(c, e) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !matchLdapFilter(f.Children[0], e)
+	case ldap.FilterEqualityMatch:
+		name, value := f.Children[0].Data.String(), f.Children[1].Data.String()
+		for k, values := range e.attrs {
+			if strings.EqualFold(k, name) && slices.ContainsFunc(values, func(v string) bool {
+				return strings.EqualFold(v, value)
+			}) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		for k := range e.attrs {
+			if strings.EqualFold(k, f.Data.String()) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+func newLdapTestConf(url string) *conf.LdapConf {
+	return &conf.LdapConf{
+		Url:               url,
+		BindDn:            "cn=svc,dc=example,dc=com",
+		BindPassword:      "svcpw",
+		BaseDn:            "ou=people,dc=example,dc=com",
+		UserFilter:        "(&(objectClass=person)(uid={username}))",
+		GroupBaseDn:       "ou=groups,dc=example,dc=com",
+		GroupFilter:       "(&(objectClass=groupOfNames)(member={dn}))",
+		MemberOfAttribute: "memberOf",
+		GroupScope: map[string][]string{
+			"admins":  {"backup"},
+			"editors": {"media", "upload"},
+		},
+		DefaultScope: []string{"media"},
+	}
+}
+
+func basicRequest(username, pwd string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth(username, pwd)
+	return r
+}
+
+func TestLdapAuthenticate(t *testing.T) {
+	server := newLdapStandIn(t, []*ldapEntry{
+		{dn: "cn=svc,dc=example,dc=com", password: "svcpw"},
+		{dn: "uid=alice,ou=people,dc=example,dc=com", password: "alicepw", attrs: map[string][]string{
+			"objectClass": {"person"},
+			"uid":         {"alice"},
+			"memberOf":    {"cn=editors,ou=groups,dc=example,dc=com"},
+		}},
+		{dn: "uid=bob,ou=people,dc=example,dc=com", password: "bobpw", attrs: map[string][]string{
+			"objectClass": {"person"},
+			"uid":         {"bob"},
+		}},
+		{dn: "cn=admins,ou=groups,dc=example,dc=com", attrs: map[string][]string{
+			"objectClass": {"groupOfNames"},
+			"cn":          {"admins"},
+			"member":      {"uid=alice,ou=people,dc=example,dc=com"},
+		}},
+	})
+	l, err := NewLdap(newLdapTestConf(server.Url()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := l.Authenticate(basicRequest("alice", "alicepw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "alice" {
+		t.Errorf("unexpected username %s", user.Username)
+	}
+	slices.Sort(user.Groups)
+	if !slices.Equal(user.Groups, []string{"admins", "editors"}) {
+		t.Errorf("unexpected groups %v", user.Groups)
+	}
+	slices.Sort(user.Scope)
+	if !slices.Equal(user.Scope, []string{"backup", "media", "upload"}) {
+		t.Errorf("unexpected scope %v", user.Scope)
+	}
+
+	// the username is the one in the directory rather than as typed
+	if user, err := l.Authenticate(basicRequest("ALICE", "alicepw")); err != nil || user.Username != "alice" {
+		t.Errorf("canonical username %v %v", user, err)
+	}
+
+	binds := server.binds.Load()
+	if _, err := l.Authenticate(basicRequest("alice", "alicepw")); err != nil {
+		t.Fatal(err)
+	}
+	if server.binds.Load() != binds {
+		t.Error("expect the result to be cached")
+	}
+
+	user, err = l.Authenticate(basicRequest("bob", "bobpw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Groups) != 0 || !slices.Equal(user.Scope, []string{"media"}) {
+		t.Errorf("unexpected groups %v and scope %v", user.Groups, user.Scope)
+	}
+
+	for _, c := range []struct {
+		username, pwd string
+		err           error
+	}{
+		{"alice", "wrong", ErrInvalidCredential},
+		{"alice", "", ErrInvalidCredential},
+		{"carol", "carolpw", ErrUserNotFound},
+		{"*", "alicepw", ErrUserNotFound},
+	} {
+		if _, err := l.Authenticate(basicRequest(c.username, c.pwd)); !errors.Is(err, c.err) {
+			t.Errorf("%s:%s expect %v, got %v", c.username, c.pwd, c.err, err)
+		}
+	}
+
+	if _, err := l.Authenticate(httptest.NewRequest(http.MethodGet, "/", nil)); !errors.Is(err, ErrNoCredential) {
+		t.Errorf("expect no credential, got %v", err)
+	}
+}
+
+func TestLdapServiceAccountError(t *testing.T) {
+	server := newLdapStandIn(t, nil)
+	l, err := NewLdap(newLdapTestConf(server.Url()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = l.Authenticate(basicRequest("alice", "alicepw"))
+	if err == nil || errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrInvalidCredential) {
+		t.Errorf("expect service account error, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/model"
+	"github.com/llklkl/webdav/internal/pkg"
+)
+
+func init() {
+	Register("token", func(cfg *conf.Conf) (Authenticator, error) {
+		if cfg.Auth == nil || cfg.Auth.Token == nil {
+			return nil, errors.New("[auth.token] is not configured")
+		}
+		return NewToken(cfg)
+	})
+}
+
+// Token authenticates the app tokens of the users configured in [[user]],
+// which are used in place of the password with HTTP basic authentication.
+type Token struct {
+	store *TokenStore
+	users map[string][]string
+}
+
+func NewToken(cfg *conf.Conf) (*Token, error) {
+	store, err := OpenTokenStore(cfg.Auth.Token.Path)
+	if err != nil {
+		return nil, err
+	}
+	pkg.SafeG(store.watch)
+
+	t := &Token{
+		store: store,
+		users: map[string][]string{},
+	}
+	for _, u := range cfg.User {
+		t.users[u.Username] = conf.UserScope(cfg, u.Username)
+	}
+
+	return t, nil
+}
+
+func (t *Token) Name() string {
+	return "token"
+}
+
+func (t *Token) Challenge() string {
+	return `Basic realm="webdav"`
+}
+
+func (t *Token) Authenticate(r *http.Request) (*model.User, error) {
+	username, pwd, ok := r.BasicAuth()
+	if !ok || !strings.HasPrefix(pwd, AppTokenPrefix) {
+		return nil, ErrNoCredential
+	}
+	userScope, ok := t.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	token := t.store.Match(username, pwd)
+	if token == nil {
+		return nil, ErrInvalidCredential
+	}
+
+	// a token never grants more than the scopes of its user
+	scopeLimit := userScope
+	if len(token.Scope) > 0 {
+		scopeLimit = slices.DeleteFunc(slices.Clone(token.Scope), func(s string) bool {
+			return !slices.Contains(userScope, s)
+		})
+	}
+	return &model.User{
+		Username:   username,
+		Attributes: map[string]string{"token": token.Name},
+		ReadOnly:   token.ReadOnly,
+		ScopeLimit: scopeLimit,
+		Local:      true,
+	}, nil
+}
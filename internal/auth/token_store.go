@@ -0,0 +1,275 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AppTokenPrefix = "wdt_"
+
+	tokenStoreReloadInterval = 5 * time.Second
+)
+
+var (
+	ErrTokenExists   = errors.New("app token already exists")
+	ErrTokenNotFound = errors.New("app token not found")
+)
+
+type AppToken struct {
+	Name string `json:"name"`
+	// sha256 of the token, the token itself is only shown once on creation
+	Hash      string    `json:"hash"`
+	Scope     []string  `json:"scope,omitempty"`
+	ReadOnly  bool      `json:"read_only,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+func (t *AppToken) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+// TokenStore keeps the hashed app tokens of users in a json file.
+type TokenStore struct {
+	path string
+
+	mu      sync.RWMutex
+	tokens  map[string][]*AppToken
+	modTime time.Time
+	size    int64
+}
+
+// OpenTokenStore loads the store, a missing file is an empty store.
+func OpenTokenStore(path string) (*TokenStore, error) {
+	s := &TokenStore{
+		path:   path,
+		tokens: map[string][]*AppToken{},
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *TokenStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read token store error: %w", err)
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("stat token store error: %w", err)
+	}
+
+	tokens := map[string][]*AppToken{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &tokens); err != nil {
+			return fmt.Errorf("parse token store error: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	s.tokens = tokens
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *TokenStore) save() error {
+	data, err := json.MarshalIndent(s.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("write token store error: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write token store error: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write token store error: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write token store error: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("write token store error: %w", err)
+	}
+
+	return nil
+}
+
+// Create generates a new token for the user, and returns it in plaintext.
+func (s *TokenStore) Create(username, name string, scope []string, readOnly bool, expiresAt time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if slices.ContainsFunc(s.tokens[username], func(t *AppToken) bool { return t.Name == name }) {
+		return "", ErrTokenExists
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	token := AppTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	s.tokens[username] = append(s.tokens[username], &AppToken{
+		Name:      name,
+		Hash:      hashToken(token),
+		Scope:     scope,
+		ReadOnly:  readOnly,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		ExpiresAt: expiresAt,
+	})
+	if err := s.save(); err != nil {
+		s.tokens[username] = s.tokens[username][:len(s.tokens[username])-1]
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (s *TokenStore) Revoke(username, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := s.tokens[username]
+	i := slices.IndexFunc(tokens, func(t *AppToken) bool { return t.Name == name })
+	if i < 0 {
+		return ErrTokenNotFound
+	}
+	s.tokens[username] = slices.Delete(slices.Clone(tokens), i, i+1)
+	if len(s.tokens[username]) == 0 {
+		delete(s.tokens, username)
+	}
+	if err := s.save(); err != nil {
+		s.tokens[username] = tokens
+		return err
+	}
+
+	return nil
+}
+
+func (s *TokenStore) Users() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]string, 0, len(s.tokens))
+	for username := range s.tokens {
+		users = append(users, username)
+	}
+	sort.Strings(users)
+	return users
+}
+
+func (s *TokenStore) List(username string) []*AppToken {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.tokens[username])
+}
+
+// Match returns the unexpired token of the user which matches.
+func (s *TokenStore) Match(username, token string) *AppToken {
+	if !strings.HasPrefix(token, AppTokenPrefix) {
+		return nil
+	}
+	hash := hashToken(token)
+	now := time.Now()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.tokens[username] {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 && !t.Expired(now) {
+			return t
+		}
+	}
+
+	return nil
+}
+
+func (s *TokenStore) changed() bool {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	if err != nil {
+		slog.Warn("stat token store error", slog.String("path", s.path), slog.Any("err", err))
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return !info.ModTime().Equal(s.modTime) || info.Size() != s.size
+}
+
+// watch reloads the store when it is modified by the token command.
+func (s *TokenStore) watch() {
+	ticker := time.NewTicker(tokenStoreReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !s.changed() {
+			continue
+		}
+		if err := s.load(); err != nil {
+			slog.Error("failed to reload token store", slog.String("path", s.path), slog.Any("err", err))
+			continue
+		}
+		slog.Info("token store reloaded", slog.String("path", s.path))
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/llklkl/webdav/conf"
+)
+
+func TestTokenAuthenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	store, err := OpenTokenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := store.Create("alice", "full", nil, false, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited, err := store.Create("alice", "limited", []string{"media", "other"}, true, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := store.Create("alice", "expired", nil, false, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Create("alice", "full", nil, false, time.Time{}); !errors.Is(err, ErrTokenExists) {
+		t.Errorf("expect token exists, got %v", err)
+	}
+
+	tk, err := NewToken(&conf.Conf{
+		User: []*conf.UserConf{{Username: "alice", Scope: []string{"media", "backup"}}},
+		Auth: &conf.AuthConf{Token: &conf.TokenConf{Path: path}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := tk.Authenticate(basicRequest("alice", full))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ReadOnly || !slices.Equal(user.ScopeLimit, []string{"media", "backup"}) {
+		t.Errorf("unexpected user %+v", user)
+	}
+	user, err = tk.Authenticate(basicRequest("alice", limited))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.ReadOnly || !slices.Equal(user.ScopeLimit, []string{"media"}) {
+		t.Errorf("unexpected user %+v", user)
+	}
+
+	for _, c := range []struct {
+		username, pwd string
+		err           error
+	}{
+		{"alice", expired, ErrInvalidCredential},
+		{"alice", AppTokenPrefix + "unknown", ErrInvalidCredential},
+		{"bob", full, ErrUserNotFound},
+		{"alice", "password", ErrNoCredential},
+	} {
+		if _, err := tk.Authenticate(basicRequest(c.username, c.pwd)); !errors.Is(err, c.err) {
+			t.Errorf("%s:%s expect %v, got %v", c.username, c.pwd, c.err, err)
+		}
+	}
+
+	if err := store.Revoke("alice", "full"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Revoke("alice", "full"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expect token not found, got %v", err)
+	}
+	if err := tk.store.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tk.Authenticate(basicRequest("alice", full)); !errors.Is(err, ErrInvalidCredential) {
+		t.Errorf("expect revoked token to be rejected, got %v", err)
+	}
+}
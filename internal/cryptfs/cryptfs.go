@@ -0,0 +1,303 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+// Package cryptfs encrypts the files of a webdav.FileSystem at rest.
+//
+// The contents are split into chunks of 64KiB, each sealed with AES-256-GCM,
+// so that a range can be read without decrypting the whole file. A file starts
+// with a header of a random salt, from which the key of the file is derived,
+// the nonce of a chunk is its index, and the last chunk is marked so that a
+// truncated file is detected. The names are optionally encrypted with a
+// synthetic nonce, the same name is always encrypted to the same name, so that
+// a path can be looked up without listing its directory.
+package cryptfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	KeySize   = 32
+	chunkSize = 64 * 1024
+	tagSize   = 16
+	saltSize  = 32
+	magic     = "WDC\x01"
+	// headerSize is the size of the header of an encrypted file
+	headerSize = len(magic) + saltSize
+)
+
+var (
+	errInvalid = errors.New("the file is not encrypted by the key")
+	// names are case insensitive on some file systems
+	nameEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+)
+
+// Cipher encrypts the contents, and optionally the names of files.
+type Cipher struct {
+	contentKey []byte
+	// nil when the names are not encrypted
+	nameMAC  []byte
+	nameAEAD cipher.AEAD
+}
+
+// LoadKey reads the master key from a file of 32 bytes, raw or hex encoded.
+func LoadKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key file error: %w", err)
+	}
+	if len(data) == KeySize {
+		return data, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != KeySize {
+		return nil, fmt.Errorf("the key file %s should contain %d bytes, raw or hex encoded", path, KeySize)
+	}
+	return key, nil
+}
+
+// DeriveKey derives the master key from a passphrase with argon2id.
+func DeriveKey(passphrase, salt string) []byte {
+	return argon2.IDKey([]byte(passphrase), []byte(salt), 3, 64*1024, 4, KeySize)
+}
+
+func NewCipher(master []byte, names bool) (*Cipher, error) {
+	if len(master) != KeySize {
+		return nil, fmt.Errorf("the master key should be %d bytes", KeySize)
+	}
+	c := &Cipher{}
+	var err error
+	if c.contentKey, err = hkdf.Key(sha256.New, master, nil, "webdav content", KeySize); err != nil {
+		return nil, err
+	}
+	if !names {
+		return c, nil
+	}
+	if c.nameMAC, err = hkdf.Key(sha256.New, master, nil, "webdav name mac", KeySize); err != nil {
+		return nil, err
+	}
+	nameKey, err := hkdf.Key(sha256.New, master, nil, "webdav name", KeySize)
+	if err != nil {
+		return nil, err
+	}
+	if c.nameAEAD, err = newAEAD(nameKey); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// fileAEAD returns the cipher of the contents of a file with the salt.
+func (c *Cipher) fileAEAD(salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, c.contentKey, salt, "webdav file", KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
+
+// encryptName encrypts a segment of path, the nonce is the MAC of the name.
+func (c *Cipher) encryptName(name string) string {
+	mac := hmac.New(sha256.New, c.nameMAC)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:c.nameAEAD.NonceSize()]
+	return strings.ToLower(nameEncoding.EncodeToString(c.nameAEAD.Seal(nonce, nonce, []byte(name), nil)))
+}
+
+func (c *Cipher) decryptName(name string) (string, bool) {
+	data, err := nameEncoding.DecodeString(strings.ToUpper(name))
+	size := c.nameAEAD.NonceSize()
+	if err != nil || len(data) < size+tagSize {
+		return "", false
+	}
+	plain, err := c.nameAEAD.Open(nil, data[:size], data[size:], nil)
+	if err != nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, c.nameMAC)
+	mac.Write(plain)
+	if !hmac.Equal(mac.Sum(nil)[:size], data[:size]) {
+		return "", false
+	}
+	return string(plain), true
+}
+
+// Path returns the path of name in the underlying file system.
+func (c *Cipher) Path(name string) string {
+	if c.nameAEAD == nil {
+		return name
+	}
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		if segment != "" && segment != "." && segment != ".." {
+			segments[i] = c.encryptName(segment)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// encryptedSize returns the size of the encrypted contents of size bytes, the
+// last chunk is shorter than a chunk, and may be empty.
+func encryptedSize(size int64) int64 {
+	return int64(headerSize) + size + (size/chunkSize+1)*tagSize
+}
+
+// plainSize returns the size of the contents of an encrypted file, an empty
+// file is empty.
+func plainSize(size int64) (int64, bool) {
+	if size == 0 {
+		return 0, true
+	}
+	size -= int64(headerSize)
+	if size < tagSize {
+		return 0, false
+	}
+	chunks := (size + chunkSize + tagSize - 1) / (chunkSize + tagSize)
+	return size - chunks*tagSize, true
+}
+
+func chunkNonce(aead cipher.AEAD, index int64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	if last {
+		nonce[0] = 1
+	}
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] = byte(index >> (8 * i))
+	}
+	return nonce
+}
+
+// FileSystem encrypts the files of the underlying file system.
+type FileSystem struct {
+	fsys   webdav.FileSystem
+	cipher *Cipher
+}
+
+func New(fsys webdav.FileSystem, c *Cipher) *FileSystem {
+	return &FileSystem{fsys: fsys, cipher: c}
+}
+
+func (fsys *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return fsys.fsys.Mkdir(ctx, fsys.cipher.Path(name), perm)
+}
+
+func (fsys *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	realName := fsys.cipher.Path(name)
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 && flag&os.O_CREATE != 0 {
+		// a new file, or an empty file, is written from the start
+		info, err := fsys.fsys.Stat(ctx, realName)
+		if os.IsNotExist(err) || err == nil && info.Mode().IsRegular() && info.Size() == 0 {
+			flag |= os.O_TRUNC
+		}
+	}
+	f, err := fsys.fsys.OpenFile(ctx, realName, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&os.O_TRUNC != 0 {
+		return fsys.create(f, name)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		return withProps(&dirFile{File: f, fsys: fsys, name: name}, f), nil
+	}
+	return withProps(&readFile{File: f, cipher: fsys.cipher, name: name}, f), nil
+}
+
+func (fsys *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	return fsys.fsys.RemoveAll(ctx, fsys.cipher.Path(name))
+}
+
+func (fsys *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	return fsys.fsys.Rename(ctx, fsys.cipher.Path(oldName), fsys.cipher.Path(newName))
+}
+
+func (fsys *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := fsys.fsys.Stat(ctx, fsys.cipher.Path(name))
+	if err != nil {
+		return nil, err
+	}
+	return fsys.plainInfo(info, plainBase(name, info)), nil
+}
+
+// plainBase returns the name of the file info of a path.
+func plainBase(name string, info os.FileInfo) string {
+	name = strings.TrimSuffix(name, "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 && name[i+1:] != "" {
+		return name[i+1:]
+	}
+	return info.Name()
+}
+
+// plainInfo reports the plain name and size of an encrypted file.
+func (fsys *FileSystem) plainInfo(info os.FileInfo, name string) os.FileInfo {
+	size := info.Size()
+	if info.Mode().IsRegular() {
+		size, _ = plainSize(size)
+	}
+	return &fileInfo{FileInfo: info, name: name, size: size}
+}
+
+type fileInfo struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+// checkMagic reports whether the header is written by this package.
+func checkMagic(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(magic))
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package cryptfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func newCipher(t *testing.T, names bool) *Cipher {
+	t.Helper()
+	c, err := NewCipher(bytes.Repeat([]byte{7}, KeySize), names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func putFile(t *testing.T, fsys webdav.FileSystem, name string, data []byte) {
+	t.Helper()
+	f, err := fsys.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// written in pieces across the chunks
+	for len(data) > 0 {
+		n := min(len(data), 50000)
+		if _, err := f.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getFile(fsys webdav.FileSystem, name string, offset int64) ([]byte, error) {
+	f, err := fsys.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(f)
+}
+
+func TestFiles(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	fsys := New(webdav.Dir(root), newCipher(t, false))
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 5} {
+		data := bytes.Repeat([]byte("secret!"), size/7+1)[:size]
+		putFile(t, fsys, "/a.txt", data)
+
+		raw, err := os.ReadFile(filepath.Join(root, "a.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(raw)) != encryptedSize(int64(size)) || size > 0 && bytes.Contains(raw, []byte("secret!")) {
+			t.Fatalf("size %d is stored in %d bytes", size, len(raw))
+		}
+		if info, err := fsys.Stat(ctx, "/a.txt"); err != nil || info.Size() != int64(size) || info.Name() != "a.txt" {
+			t.Fatalf("stat size %d: %v %v", size, info, err)
+		}
+		for _, offset := range []int64{0, chunkSize - 3, chunkSize + 2, int64(size)} {
+			if offset > int64(size) {
+				continue
+			}
+			got, err := getFile(fsys, "/a.txt", offset)
+			if err != nil || !bytes.Equal(got, data[offset:]) {
+				t.Fatalf("read size %d from %d: %d bytes %v", size, offset, len(got), err)
+			}
+		}
+	}
+
+	if err := fsys.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := fsys.OpenFile(ctx, "/", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	infos, err := dir.Readdir(-1)
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("readdir: %v %v", infos, err)
+	}
+	for _, info := range infos {
+		if !info.IsDir() && info.Size() != 3*chunkSize+5 {
+			t.Errorf("listed size %d", info.Size())
+		}
+	}
+
+	// a file is replaced rather than modified in place
+	f, err := fsys.OpenFile(ctx, "/a.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Errorf("wrote in place")
+	}
+	f.Close()
+}
+
+func TestTampered(t *testing.T) {
+	ctx := context.Background()
+	mem := webdav.NewMemFS()
+	fsys := New(mem, newCipher(t, false))
+	data := bytes.Repeat([]byte{1}, 2*chunkSize)
+	putFile(t, fsys, "/a", data)
+	raw, err := getFile(mem, "/a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := NewCipher(bytes.Repeat([]byte{8}, KeySize), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getFile(New(mem, other), "/a", 0); err == nil {
+		t.Errorf("read with another key")
+	}
+	flipped := bytes.Clone(raw)
+	flipped[len(flipped)-1] ^= 1
+	putFile(t, mem, "/a", flipped)
+	if _, err := getFile(fsys, "/a", 0); err == nil {
+		t.Errorf("read a modified file")
+	}
+	// the last full chunk is not marked as the last one
+	putFile(t, mem, "/a", raw[:encryptedSize(chunkSize)])
+	if _, err := getFile(fsys, "/a", 0); err == nil {
+		t.Errorf("read a truncated file")
+	}
+	putFile(t, mem, "/a", []byte("plain"))
+	if _, err := getFile(fsys, "/a", 0); err == nil {
+		t.Errorf("read a plain file")
+	}
+	if _, err := fsys.Stat(ctx, "/a"); err != nil {
+		t.Errorf("stat a plain file: %v", err)
+	}
+}
+
+func TestNames(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	c := newCipher(t, true)
+	fsys := New(webdav.Dir(root), c)
+	if err := fsys.Mkdir(ctx, "/Docs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, fsys, "/Docs/report.txt", []byte("data"))
+	if err := fsys.Rename(ctx, "/Docs/report.txt", "/Docs/final.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "foreign"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), "Docs") {
+			t.Errorf("plain name %s is stored", entry.Name())
+		}
+	}
+	if c.Path("/Docs/final.txt") != c.Path("/Docs")+"/"+c.encryptName("final.txt") {
+		t.Errorf("path %s", c.Path("/Docs/final.txt"))
+	}
+
+	for name, want := range map[string][]string{"/": {"Docs"}, "/Docs": {"final.txt"}} {
+		dir, err := fsys.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos, err := dir.Readdir(-1)
+		dir.Close()
+		if err != nil || len(infos) != len(want) || infos[0].Name() != want[0] {
+			t.Errorf("readdir %s: %v %v", name, infos, err)
+		}
+	}
+	if got, err := getFile(fsys, "/Docs/final.txt", 0); err != nil || string(got) != "data" {
+		t.Errorf("read %q %v", got, err)
+	}
+	if info, err := fsys.Stat(ctx, "/Docs/final.txt"); err != nil || info.Name() != "final.txt" {
+		t.Errorf("stat %v %v", info, err)
+	}
+}
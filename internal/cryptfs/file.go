@@ -0,0 +1,304 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package cryptfs
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+
+	"golang.org/x/net/webdav"
+)
+
+// withProps keeps the dead properties held by the underlying file, e.g. of the
+// memory storage.
+func withProps(f webdav.File, underlying webdav.File) webdav.File {
+	if holder, ok := underlying.(webdav.DeadPropsHolder); ok {
+		return &propsFile{File: f, DeadPropsHolder: holder}
+	}
+	return f
+}
+
+type propsFile struct {
+	webdav.File
+	webdav.DeadPropsHolder
+}
+
+type dirFile struct {
+	webdav.File
+	fsys *FileSystem
+	name string
+}
+
+// Readdir decrypts the names of the entries, the entries whose names are not
+// encrypted by the key are skipped.
+func (f *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	if err != nil {
+		return nil, err
+	}
+	filtered := infos[:0]
+	for _, info := range infos {
+		name := info.Name()
+		if f.fsys.cipher.nameAEAD != nil {
+			plain, ok := f.fsys.cipher.decryptName(name)
+			if !ok {
+				continue
+			}
+			name = plain
+		}
+		filtered = append(filtered, f.fsys.plainInfo(info, name))
+	}
+	return filtered, nil
+}
+
+func (f *dirFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return f.fsys.plainInfo(info, plainBase(f.name, info)), nil
+}
+
+// readFile decrypts the chunk of the offset on read, writes are rejected
+// unless the file is truncated.
+type readFile struct {
+	webdav.File
+	cipher *Cipher
+	name   string
+
+	aead cipher.AEAD
+	// plain size of the file
+	size   int64
+	sized  bool
+	offset int64
+	// the decrypted chunk
+	index int64
+	chunk []byte
+}
+
+func (f *readFile) init() error {
+	if f.sized {
+		return nil
+	}
+	info, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	size, ok := plainSize(info.Size())
+	if !ok {
+		return &os.PathError{Op: "read", Path: f.name, Err: errInvalid}
+	}
+	if info.Size() > 0 {
+		header := make([]byte, headerSize)
+		if _, err := f.File.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(f.File, header); err != nil {
+			return err
+		}
+		if !checkMagic(header) {
+			return &os.PathError{Op: "read", Path: f.name, Err: errInvalid}
+		}
+		if f.aead, err = f.cipher.fileAEAD(header[len(magic):]); err != nil {
+			return err
+		}
+	}
+	f.size, f.sized, f.index = size, true, -1
+	return nil
+}
+
+func (f *readFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+}
+
+func (f *readFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size, _ := plainSize(info.Size())
+	return &fileInfo{FileInfo: info, name: path.Base(f.name), size: size}, nil
+}
+
+func (f *readFile) Read(p []byte) (int, error) {
+	if err := f.init(); err != nil {
+		return 0, err
+	}
+	if f.offset >= f.size {
+		// the last chunk is verified, so that a truncated file is detected
+		if last := f.size / chunkSize; f.aead != nil && f.index != last {
+			if err := f.load(last); err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.EOF
+	}
+	index := f.offset / chunkSize
+	if index != f.index {
+		if err := f.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.chunk[f.offset-index*chunkSize:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+// load reads and decrypts the chunk of the index.
+func (f *readFile) load(index int64) error {
+	last := f.size / chunkSize
+	size := chunkSize + tagSize
+	if index == last {
+		size = int(f.size%chunkSize) + tagSize
+	}
+	if _, err := f.File.Seek(int64(headerSize)+index*(chunkSize+tagSize), io.SeekStart); err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(f.File, buf); err != nil {
+		return err
+	}
+	chunk, err := f.aead.Open(buf[:0], chunkNonce(f.aead, index, index == last), buf, nil)
+	if err != nil {
+		return &os.PathError{Op: "read", Path: f.name, Err: errInvalid}
+	}
+	f.index, f.chunk = index, chunk
+	return nil
+}
+
+func (f *readFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.init(); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *readFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: errors.New("an encrypted file can only be replaced")}
+}
+
+// writeFile encrypts a new file, a chunk is written when the following
+// writes show that it is not the last one.
+type writeFile struct {
+	webdav.File
+	name  string
+	aead  cipher.AEAD
+	index int64
+	buf   []byte
+	size  int64
+	err   error
+}
+
+func (fsys *FileSystem) create(f webdav.File, name string) (webdav.File, error) {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	if _, err := rand.Read(header[len(magic):]); err != nil {
+		f.Close()
+		return nil, err
+	}
+	aead, err := fsys.cipher.fileAEAD(header[len(magic):])
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return withProps(&writeFile{File: f, name: name, aead: aead}, f), nil
+}
+
+func (f *writeFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+}
+
+func (f *writeFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{FileInfo: info, name: path.Base(f.name), size: f.size}, nil
+}
+
+func (f *writeFile) Read(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: f.name, Err: errors.New("the file is opened for writing")}
+}
+
+func (f *writeFile) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && (whence == io.SeekCurrent || whence == io.SeekEnd) {
+		return f.size, nil
+	}
+	return 0, &os.PathError{Op: "seek", Path: f.name, Err: errors.New("an encrypted file can only be appended")}
+}
+
+func (f *writeFile) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	f.buf = append(f.buf, p...)
+	f.size += int64(len(p))
+	for len(f.buf) > chunkSize {
+		if f.err = f.seal(f.buf[:chunkSize], false); f.err != nil {
+			return 0, f.err
+		}
+		f.buf = append(f.buf[:0], f.buf[chunkSize:]...)
+	}
+	return len(p), nil
+}
+
+// seal encrypts and writes the next chunk.
+func (f *writeFile) seal(chunk []byte, last bool) error {
+	_, err := f.File.Write(f.aead.Seal(nil, chunkNonce(f.aead, f.index, last), chunk, nil))
+	f.index++
+	return err
+}
+
+func (f *writeFile) Close() error {
+	err := f.err
+	if err == nil && len(f.buf) == chunkSize {
+		err = f.seal(f.buf, false)
+		f.buf = f.buf[:0]
+	}
+	if err == nil {
+		err = f.seal(f.buf, true)
+	}
+	if closeErr := f.File.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
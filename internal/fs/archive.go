@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package fs
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/llklkl/webdav/internal/archive"
+)
+
+const defaultArchiveSuffix = "!"
+
+// archiveInfo is the collection of an archive.
+type archiveInfo struct {
+	// the file info of the archive
+	os.FileInfo
+	name string
+}
+
+func (fi *archiveInfo) Name() string      { return fi.name }
+func (fi *archiveInfo) Size() int64       { return 0 }
+func (fi *archiveInfo) Mode() os.FileMode { return os.ModeDir | 0o555 }
+func (fi *archiveInfo) IsDir() bool       { return true }
+
+// splitArchive splits a path in the collection of an archive into the path of
+// the archive and the path of the member.
+func (f *Fs) splitArchive(name string) (string, string, bool) {
+	if f.archives == nil {
+		return "", "", false
+	}
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		base, ok := strings.CutSuffix(segment, f.archiveSuffix)
+		if ok && archive.Supported(base) {
+			dir := strings.Join(segments[:i], "/")
+			return path.Join("/", dir, base), "/" + strings.Join(segments[i+1:], "/"), true
+		}
+	}
+	return "", "", false
+}
+
+// inArchive reports whether the path is in the collection of an existing
+// archive, rather than a file with the same name.
+func (f *Fs) inArchive(ctx context.Context, name string) bool {
+	archivePath, _, ok := f.splitArchive(name)
+	if !ok {
+		return false
+	}
+	fsys, _, err := f.fileSystem(ctx)
+	if err != nil {
+		return false
+	}
+	info, err := fsys.Stat(ctx, archivePath)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// statArchive stats a member of an archive, which the user needs the
+// permission to read the archive.
+func (f *Fs) statArchive(ctx context.Context, name string) (os.FileInfo, error) {
+	archivePath, member, _ := f.splitArchive(name)
+	if err := f.checkPermission(ctx, archivePath, PermRead); err != nil {
+		return nil, err
+	}
+	fsys, root, err := f.fileSystem(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if member == "/" {
+		info, err := fsys.Stat(ctx, archivePath)
+		if err != nil {
+			return nil, err
+		}
+		return &archiveInfo{FileInfo: info, name: path.Base(name)}, nil
+	}
+	idx, err := f.archives.Index(ctx, fsys, string(root), archivePath)
+	if err != nil {
+		return nil, err
+	}
+	return idx.Stat(member)
+}
+
+// openArchive opens a member of an archive for reading.
+func (f *Fs) openArchive(ctx context.Context, name string, flag int) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, denied(ctx)
+	}
+	archivePath, member, _ := f.splitArchive(name)
+	if err := f.checkPermission(ctx, archivePath, PermRead); err != nil {
+		return nil, err
+	}
+	fsys, root, err := f.fileSystem(ctx)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := f.archives.Index(ctx, fsys, string(root), archivePath)
+	if err != nil {
+		return nil, err
+	}
+	return idx.Open(ctx, fsys, archivePath, member)
+}
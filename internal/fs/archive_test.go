@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package fs
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/model"
+)
+
+func TestArchive(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a.zip", "private/b.zip"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		out, err := os.Create(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw := zip.NewWriter(out)
+		w, err := zw.Create("dir/hello.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("hello"))
+		zw.Close()
+		out.Close()
+	}
+	lib := &conf.LibraryConf{Name: "shared", MountPoint: root, Archive: &conf.ArchiveConf{}}
+	cfg := &conf.Conf{
+		Library: []*conf.LibraryConf{lib},
+		Scope: []*conf.ScopeConf{
+			{Name: "public", Library: "shared", Include: []string{"dir:/"}, Exclude: []string{"dir:/private"}, Permission: []string{"*"}},
+		},
+		User: []*conf.UserConf{{Username: "alice", Scope: []string{"public"}}},
+	}
+	f := NewFs(cfg, lib, Options{})
+	ctx := model.SetUser(context.Background(), &model.User{Username: "alice", Local: true})
+
+	dir, err := f.OpenFile(ctx, "/", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if slices.Sort(names); !slices.Equal(names, []string{"a.zip", "a.zip!"}) {
+		t.Errorf("root lists %v", names)
+	}
+	if info, err := f.Stat(ctx, "/a.zip!"); err != nil || !info.IsDir() || info.Name() != "a.zip!" {
+		t.Errorf("stat collection: %v %v", info, err)
+	}
+
+	file, err := f.OpenFile(ctx, "/a.zip!/dir/hello.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(file); err != nil || string(data) != "hello" {
+		t.Errorf("read member %q %v", data, err)
+	}
+	file.Close()
+
+	if _, err := f.OpenFile(ctx, "/a.zip!/dir/new.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); !os.IsPermission(err) {
+		t.Errorf("create in archive: %v", err)
+	}
+	if err := f.Mkdir(ctx, "/a.zip!/new", 0755); !os.IsPermission(err) {
+		t.Errorf("mkdir in archive: %v", err)
+	}
+	if err := f.RemoveAll(ctx, "/a.zip!/dir"); !os.IsPermission(err) {
+		t.Errorf("remove in archive: %v", err)
+	}
+	if _, err := f.Stat(ctx, "/private/b.zip!/dir/hello.txt"); !os.IsPermission(err) {
+		t.Errorf("stat in archive without the permission: %v", err)
+	}
+	if _, err := f.Stat(ctx, "/missing.zip!/dir"); !os.IsNotExist(err) {
+		t.Errorf("stat in missing archive: %v", err)
+	}
+}
+
+func TestArchiveWalk(t *testing.T) {
+	root := t.TempDir()
+	out, err := os.Create(filepath.Join(root, "a.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(out)
+	w, err := zw.Create("dir/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hello"))
+	zw.Close()
+	out.Close()
+	if err := os.WriteFile(filepath.Join(root, "broken.zip"), []byte("not a zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lib := &conf.LibraryConf{Name: "shared", MountPoint: root, Archive: &conf.ArchiveConf{}}
+	cfg := &conf.Conf{
+		Library: []*conf.LibraryConf{lib},
+		Scope:   []*conf.ScopeConf{{Name: "all", Library: "shared", Include: []string{"dir:/"}, Permission: []string{"*"}}},
+		User:    []*conf.UserConf{{Username: "alice", Scope: []string{"all"}}},
+	}
+	h := &webdav.Handler{FileSystem: NewFs(cfg, lib, Options{}), LockSystem: webdav.NewMemLS()}
+
+	// the broken archive is skipped rather than aborting the walk
+	req := httptest.NewRequest("PROPFIND", "/", nil)
+	req.Header.Set("Depth", "infinity")
+	req = req.WithContext(model.SetUser(req.Context(), &model.User{Username: "alice", Local: true}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	body := rec.Body.String()
+	if rec.Code != http.StatusMultiStatus || !strings.Contains(body, "/broken.zip<") ||
+		!strings.Contains(body, "/a.zip%21/dir/hello.txt<") || strings.Contains(body, "/broken.zip%21") {
+		t.Errorf("propfind: %d %s", rec.Code, body)
+	}
+}
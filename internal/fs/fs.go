@@ -25,17 +25,31 @@ package fs
 
 import (
 	"context"
+	"encoding/xml"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/net/webdav"
 
 	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/archive"
+	"github.com/llklkl/webdav/internal/cryptfs"
 	"github.com/llklkl/webdav/internal/model"
+	"github.com/llklkl/webdav/internal/pkg"
+	"github.com/llklkl/webdav/internal/props"
+	"github.com/llklkl/webdav/internal/quota"
+	"github.com/llklkl/webdav/internal/trash"
+	"github.com/llklkl/webdav/internal/unionfs"
+	"github.com/llklkl/webdav/internal/versions"
 )
 
+const defaultCreateMode os.FileMode = 0o700
+
 func clearPath(path string) string {
 	if path == "" || path[0] != '/' {
 		path = "/" + path
@@ -48,73 +62,316 @@ type Fs struct {
 	mountPoint string
 
 	root webdav.Dir
+	// the root of each user is created on first access when the mount point
+	// is a template
+	template   bool
+	createMode os.FileMode
+	created    sync.Map
+
+	// storage serves the files of a library which is not a local directory
+	storage webdav.FileSystem
+	quota   *quota.Tracker
+	props   *props.Props
+	// cipher is nil when the files are not encrypted
+	cipher *cryptfs.Cipher
+	// the read only layers below the storage
+	lower []webdav.FileSystem
+	// archives is nil when archives are not browsable
+	archives      *archive.Cache
+	archiveSuffix string
+
+	// trash is nil when deleted files are removed permanently
+	trash          *conf.TrashConf
+	trashRetention time.Duration
+	trashAdmins    map[string]bool
+	// versions is nil when overwritten files are not kept
+	versions *versions.Policy
+
+	denyPrecedence bool
+	scopes         map[string]*Scope
+	// scopes of the users in [[user]], and of the members of the groups
+	userScope   map[string]ScopeGroup
+	memberScope map[string]ScopeGroup
+	groupScope  map[string]ScopeGroup
+}
 
-	userScope map[string]ScopeGroup
+// Options are the optional services of a file system.
+type Options struct {
+	// Quota is nil when no quota is configured
+	Quota *quota.Tracker
+	// Props is nil when dead properties are disabled
+	Props *props.Props
+	// Storage serves the files when the library is not a local directory,
+	// quotas and dead properties are only supported by local directories
+	Storage webdav.FileSystem
+	// Cipher is nil when the files are not encrypted
+	Cipher *cryptfs.Cipher
 }
 
-func NewFs(cfg *conf.Conf, library *conf.LibraryConf) *Fs {
+func NewFs(cfg *conf.Conf, library *conf.LibraryConf, opts Options) *Fs {
 	fs := &Fs{
-		name:       library.Name,
-		mountPoint: clearPath(library.MountPoint),
-		root:       webdav.Dir(library.MountPoint),
-		userScope:  map[string]ScopeGroup{},
+		name:           library.Name,
+		mountPoint:     clearPath(library.MountPoint),
+		root:           webdav.Dir(library.MountPoint),
+		template:       conf.IsTemplate(library.MountPoint),
+		createMode:     defaultCreateMode,
+		storage:        opts.Storage,
+		cipher:         opts.Cipher,
+		denyPrecedence: library.DenyPrecedence,
+		scopes:         map[string]*Scope{},
+		userScope:      map[string]ScopeGroup{},
+		memberScope:    map[string]ScopeGroup{},
+		groupScope:     map[string]ScopeGroup{},
+	}
+
+	if library.CreateMode != 0 {
+		fs.createMode = os.FileMode(library.CreateMode)
+	}
+	if opts.Storage == nil {
+		fs.quota, fs.props = opts.Quota, opts.Props
+	}
+	if library.Trash != nil {
+		fs.trash, fs.trashRetention = library.Trash, library.Trash.Retention
+		if fs.trashRetention == 0 {
+			fs.trashRetention = trash.DefaultRetention
+		}
+		fs.trashAdmins = map[string]bool{}
+		for _, admin := range library.Trash.Admins {
+			fs.trashAdmins[admin] = true
+		}
+		for _, group := range cfg.Group {
+			if slices.Contains(library.Trash.AdminGroups, group.Name) {
+				for _, member := range group.Members {
+					fs.trashAdmins[member] = true
+				}
+			}
+		}
+	}
+	if library.Union != nil {
+		for _, dir := range library.Union.Lower {
+			fs.lower = append(fs.lower, webdav.Dir(dir))
+		}
+	}
+	if library.Archive != nil {
+		fs.archives, fs.archiveSuffix = archive.NewCache(library.Archive.Cache, library.Archive.Entries), library.Archive.Suffix
+		if fs.archiveSuffix == "" {
+			fs.archiveSuffix = defaultArchiveSuffix
+		}
+	}
+	if library.Versions != nil {
+		fs.versions = &versions.Policy{Keep: library.Versions.Keep, MaxAge: library.Versions.MaxAge}
+	}
+	if fs.quota != nil {
+		pkg.SafeG(fs.registerQuota)
 	}
 
 	for _, scp := range cfg.Scope {
 		if scp.Library != library.Name {
 			continue
 		}
-		for _, user := range cfg.User {
-			if !slices.Contains(user.Scope, scp.Name) {
-				continue
-			}
-			fs.userScope[user.Username] = append(fs.userScope[user.Username], NewScope(scp))
+		fs.scopes[scp.Name] = NewScope(scp)
+	}
+	for _, user := range cfg.User {
+		fs.userScope[user.Username] = fs.addScope(fs.userScope[user.Username], user.Scope)
+	}
+	for _, group := range cfg.Group {
+		fs.groupScope[group.Name] = fs.addScope(fs.groupScope[group.Name], group.Scope)
+		for _, member := range group.Members {
+			fs.userScope[member] = fs.addScope(fs.userScope[member], group.Scope)
+			fs.memberScope[member] = fs.addScope(fs.memberScope[member], group.Scope)
 		}
 	}
 
 	return fs
 }
 
+// addScope appends the scopes of this library by names to the group.
+func (f *Fs) addScope(group ScopeGroup, names []string) ScopeGroup {
+	for _, name := range names {
+		if scope, ok := f.scopes[name]; ok && !slices.Contains(group, scope) {
+			group = append(group, scope)
+		}
+	}
+	return group
+}
+
+// dir returns the root of the user in the context.
+func (f *Fs) dir(ctx context.Context) (webdav.Dir, error) {
+	if !f.template {
+		return f.root, nil
+	}
+
+	user := model.GetUser(ctx)
+	if user == nil || user.Anonymous || !validHomeName(user.Username) {
+		model.MarkDenied(ctx)
+		return "", os.ErrPermission
+	}
+	root := strings.ReplaceAll(string(f.root), conf.UsernamePlaceholder, user.Username)
+	if _, ok := f.created.Load(root); !ok {
+		if err := os.MkdirAll(root, f.createMode); err != nil {
+			return "", err
+		}
+		if f.quota != nil {
+			f.quota.Register(f.name, root)
+		}
+		f.created.Store(root, struct{}{})
+	}
+	return webdav.Dir(root), nil
+}
+
+// fileSystem returns the storage of the user in the context, root is empty
+// when the library is not a local directory.
+func (f *Fs) fileSystem(ctx context.Context) (webdav.FileSystem, webdav.Dir, error) {
+	if f.storage != nil {
+		return f.view(f.storage), "", nil
+	}
+	root, err := f.dir(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	return f.view(root), root, nil
+}
+
+// view returns the files of the library in the storage, which is the upper
+// layer of the union, and may be encrypted.
+func (f *Fs) view(fsys webdav.FileSystem) webdav.FileSystem {
+	if len(f.lower) > 0 {
+		fsys = unionfs.New(fsys, f.lower...)
+	}
+	if f.cipher != nil {
+		fsys = cryptfs.New(fsys, f.cipher)
+	}
+	return fsys
+}
+
+// registerQuota tracks the usage of the existing roots of the library.
+func (f *Fs) registerQuota() {
+	if !f.template {
+		f.quota.Register(f.name, string(f.root))
+		return
+	}
+	roots, err := filepath.Glob(strings.ReplaceAll(string(f.root), conf.UsernamePlaceholder, "*"))
+	if err != nil {
+		slog.Warn("find the roots of library error", slog.String("library", f.name), slog.Any("err", err))
+		return
+	}
+	for _, root := range roots {
+		f.quota.Register(f.name, root)
+	}
+}
+
+// validHomeName reports whether the username can be a directory name.
+func validHomeName(username string) bool {
+	return username != "" && username != "." && username != ".." &&
+		!strings.ContainsAny(username, "/\\\x00")
+}
+
 func (f *Fs) getScope(ctx context.Context) ScopeGroup {
 	user := model.GetUser(ctx)
-	return f.userScope[user.Username]
+	var group ScopeGroup
+	if user.Local {
+		group = f.userScope[user.Username]
+	} else if !user.Anonymous {
+		group = f.memberScope[user.Username]
+	}
+	if len(user.Scope) == 0 && len(user.Groups) == 0 && user.ScopeLimit == nil {
+		return group
+	}
+
+	group = f.addScope(slices.Clone(group), user.Scope)
+	for _, name := range user.Groups {
+		for _, scope := range f.groupScope[name] {
+			if !slices.Contains(group, scope) {
+				group = append(group, scope)
+			}
+		}
+	}
+	if user.ScopeLimit != nil {
+		group = slices.DeleteFunc(group, func(scope *Scope) bool {
+			return !slices.Contains(user.ScopeLimit, scope.name)
+		})
+	}
+	return group
 }
 
 func (f *Fs) checkPermission(ctx context.Context, name string, needPerm Perm) error {
-	scope := f.getScope(ctx)
-	if matched, permission := scope.Match(name, needPerm); matched && permission {
-		return nil
-	} else if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
-		slog.Debug("permission forbidden", slog.String("name", name),
-			slog.Bool("matched", matched),
+	if user := model.GetUser(ctx); user.ReadOnly && needPerm&^PermRead != 0 {
+		slog.Debug("permission forbidden for read only user", slog.String("name", name),
 			slog.String("needPerm", needPerm.String()))
+		model.MarkDenied(ctx)
+		return os.ErrPermission
+	}
+
+	var allowed bool
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		var steps []Step
+		allowed, steps = f.Explain(ctx, name, needPerm)
+		trace := make([]string, len(steps))
+		for i := range steps {
+			trace[i] = steps[i].String()
+		}
+		slog.Debug("permission evaluated", slog.String("library", f.name),
+			slog.String("username", model.GetUser(ctx).Username),
+			slog.String("name", name),
+			slog.String("needPerm", needPerm.String()),
+			slog.Bool("allowed", allowed),
+			slog.Any("trace", trace))
+	} else {
+		allowed = f.getScope(ctx).Check(name, needPerm, f.denyPrecedence)
+	}
+	if allowed {
+		return nil
 	}
 
+	model.MarkDenied(ctx)
 	return os.ErrPermission
 }
 
+// Explain evaluates the permissions of the user in the context on the path,
+// and returns the decisions of its scopes.
+func (f *Fs) Explain(ctx context.Context, name string, needPerm Perm) (bool, []Step) {
+	return f.getScope(ctx).Explain(clearPath(name), needPerm, f.denyPrecedence)
+}
+
 func (f *Fs) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
 	const needPerm = PermCreateFolder
 
 	name = clearPath(name)
+	if f.trash != nil && trash.Contains(name) || f.versions != nil && versions.Contains(name) || f.inArchive(ctx, name) {
+		return denied(ctx)
+	}
 	if err := f.checkPermission(ctx, name, needPerm); err != nil {
 		return err
 	}
 
-	return f.root.Mkdir(ctx, name, perm)
+	fsys, _, err := f.fileSystem(ctx)
+	if err != nil {
+		return err
+	}
+	return fsys.Mkdir(ctx, name, perm)
 }
 
 type fileFilter struct {
 	webdav.File
-	dir   string
-	scope ScopeGroup
+	dir            string
+	scope          ScopeGroup
+	denyPrecedence bool
+	quotaProps     func() map[xml.Name]webdav.Property
+	// path in the file system, and the backend of its dead properties
+	path  string
+	props props.Backend
+	// the directories not listed, e.g. the trash directory in the root
+	hidden []string
+	// the archives are listed with their collections named by the suffix
+	archiveSuffix string
 }
 
-func newFileFilter(dir string, f webdav.File, scope ScopeGroup) *fileFilter {
+func newFileFilter(dir string, f webdav.File, scope ScopeGroup, denyPrecedence bool) *fileFilter {
 	return &fileFilter{
-		File:  f,
-		dir:   dir,
-		scope: scope,
+		File:           f,
+		dir:            dir,
+		scope:          scope,
+		denyPrecedence: denyPrecedence,
 	}
 }
 
@@ -124,12 +381,20 @@ func (f *fileFilter) Readdir(n int) ([]os.FileInfo, error) {
 		return nil, err
 	}
 	filtered := infos[:0]
+	var collections []os.FileInfo
 	for i := range infos {
-		if matched, _ := f.scope.Match(filepath.Join(f.dir, infos[i].Name()), PermRead); matched {
+		if slices.Contains(f.hidden, "/"+infos[i].Name()) {
+			continue
+		}
+		if f.scope.Check(filepath.Join(f.dir, infos[i].Name()), PermRead, f.denyPrecedence) {
 			filtered = append(filtered, infos[i])
+			if f.archiveSuffix != "" && infos[i].Mode().IsRegular() && archive.Supported(infos[i].Name()) {
+				collections = append(collections, &archiveInfo{FileInfo: infos[i], name: infos[i].Name() + f.archiveSuffix})
+			}
 		}
 	}
-	return infos, nil
+	// appended after the loop, which reuses the slice
+	return append(filtered, collections...), nil
 }
 
 func (f *Fs) filterDir(ctx context.Context, name string) (string, error) {
@@ -143,59 +408,212 @@ func (f *Fs) filterDir(ctx context.Context, name string) (string, error) {
 
 func (f *Fs) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
 	name = clearPath(name)
-
-	needPerm := PermRead
-	if flag&os.O_WRONLY != 0 {
-		needPerm |= PermWrite
+	if f.trash != nil && trash.Contains(name) {
+		return f.openTrash(ctx, name, flag)
 	}
-	if flag&os.O_RDWR != 0 {
-		needPerm |= PermWrite
+	if f.versions != nil && versions.Contains(name) {
+		return f.openVersions(ctx, name, flag)
 	}
-	if flag&os.O_CREATE != 0 {
-		needPerm |= PermCreateFile
+	if f.inArchive(ctx, name) {
+		return f.openArchive(ctx, name, flag)
 	}
 
+	needPerm := FlagPerm(flag)
+
 	if err := f.checkPermission(ctx, name, needPerm); err != nil {
 		return nil, err
 	}
 
-	file, err := f.root.OpenFile(ctx, name, flag, perm)
+	fsys, root, err := f.fileSystem(ctx)
 	if err != nil {
+		return nil, err
+	}
+	// PROPPATCH opens the resource with O_RDWR, while a directory can only be
+	// opened for reading
+	if flag == os.O_RDWR {
+		if info, err := fsys.Stat(ctx, name); err == nil && info.IsDir() {
+			flag = os.O_RDONLY
+		}
+	}
+	var putBack func()
+	if flag&os.O_TRUNC != 0 {
+		if putBack, err = f.setAside(ctx, fsys, root, name); err != nil {
+			return nil, err
+		}
+	}
+	var file webdav.File
+	if f.quota != nil && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		file, err = f.openQuota(ctx, fsys, root, name, flag, perm)
+	} else {
+		file, err = fsys.OpenFile(ctx, name, flag, perm)
+	}
+	if err != nil {
+		if putBack != nil {
+			putBack()
+		}
 		return file, err
 	}
+	if putBack != nil {
+		file = &replacingFile{File: file, ctx: ctx, putBack: putBack}
+	}
 
-	return newFileFilter(filepath.Dir(name), file, f.getScope(ctx)), nil
+	filter := newFileFilter(name, file, f.getScope(ctx), f.denyPrecedence)
+	if f.archives != nil {
+		filter.archiveSuffix = f.archiveSuffix
+	}
+	if name == "/" {
+		if f.trash != nil {
+			filter.hidden = append(filter.hidden, trash.Dir)
+		}
+		if f.versions != nil {
+			filter.hidden = append(filter.hidden, versions.Dir)
+		}
+	}
+	if f.quota != nil {
+		filter.quotaProps = func() map[xml.Name]webdav.Property { return f.quotaProps(ctx) }
+	}
+	if backend := f.propsBackend(root); backend != nil {
+		path := f.resolve(root, name)
+		// the files of the lower layers have no properties until copied up
+		if _, err := os.Lstat(path); err == nil || len(f.lower) == 0 {
+			filter.path, filter.props = path, backend
+		}
+	}
+	return filter, nil
 }
 
 func (f *Fs) RemoveAll(ctx context.Context, name string) error {
 	name = clearPath(name)
+	if f.trash != nil && trash.Contains(name) {
+		return f.removeTrash(ctx, name)
+	}
+	if f.versions != nil && versions.Contains(name) || f.inArchive(ctx, name) {
+		return denied(ctx)
+	}
 	needPerm := PermDelete
 
 	if err := f.checkPermission(ctx, name, needPerm); err != nil {
 		return err
 	}
 
-	return f.root.RemoveAll(ctx, name)
+	fsys, root, err := f.fileSystem(ctx)
+	if err != nil {
+		return err
+	}
+	// the destination replaced by a COPY or MOVE is kept as a version
+	if f.versions != nil && model.IsOverwrite(ctx) {
+		if version, err := f.saveVersion(ctx, fsys, root, name); version != "" || err != nil {
+			return err
+		}
+	}
+	if f.trash != nil {
+		_, err := trash.New(f.unchecked(fsys, root)).Move(ctx, name, owner(ctx), false)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return f.removeAll(ctx, fsys, root, name)
+}
+
+// removeAll removes the file with its quota usage and dead properties,
+// without checking the permission.
+func (f *Fs) removeAll(ctx context.Context, fsys webdav.FileSystem, root webdav.Dir, name string) error {
+	if f.quota != nil {
+		f.removeQuota(root, name)
+	}
+	if err := fsys.RemoveAll(ctx, name); err != nil {
+		return err
+	}
+	if backend := f.propsBackend(root); backend != nil {
+		if err := backend.Remove(f.resolve(root, name)); err != nil {
+			slog.Warn("remove dead properties error", slog.String("name", name), slog.Any("err", err))
+		}
+	}
+	return nil
 }
 
 func (f *Fs) Rename(ctx context.Context, oldName, newName string) error {
-	oldName = clearPath(oldName)
+	oldName, newName = clearPath(oldName), clearPath(newName)
+	if f.trash != nil && trash.Contains(oldName) {
+		return f.restoreTrash(ctx, oldName, newName)
+	}
+	if f.trash != nil && trash.Contains(newName) {
+		return denied(ctx)
+	}
+	if f.versions != nil && (versions.Contains(oldName) || versions.Contains(newName)) {
+		return denied(ctx)
+	}
+	if f.inArchive(ctx, oldName) || f.inArchive(ctx, newName) {
+		return denied(ctx)
+	}
 	needPerm := PermRename
 
 	if err := f.checkPermission(ctx, oldName, needPerm); err != nil {
 		return err
 	}
 
-	return f.root.Rename(ctx, oldName, newName)
+	fsys, root, err := f.fileSystem(ctx)
+	if err != nil {
+		return err
+	}
+	var putBack func()
+	if f.versions != nil {
+		version, err := f.saveVersion(ctx, fsys, root, newName)
+		if err != nil {
+			return err
+		}
+		if version != "" {
+			putBack = func() {
+				f.putBack(ctx, fsys, root, newName, func(ctx context.Context, u *unchecked) error {
+					return u.Rename(ctx, version, newName)
+				})
+			}
+		}
+	}
+	if err := f.rename(ctx, fsys, root, oldName, newName); err != nil {
+		if putBack != nil {
+			putBack()
+		}
+		return err
+	}
+	return nil
+}
+
+// rename moves the file with its dead properties, without checking the
+// permission.
+func (f *Fs) rename(ctx context.Context, fsys webdav.FileSystem, root webdav.Dir, oldName, newName string) error {
+	if err := fsys.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	if backend := f.propsBackend(root); backend != nil {
+		if err := backend.Move(f.resolve(root, oldName), f.resolve(root, newName)); err != nil {
+			slog.Warn("move dead properties error", slog.String("name", oldName), slog.Any("err", err))
+		}
+	}
+	return nil
 }
 
 func (f *Fs) Stat(ctx context.Context, name string) (os.FileInfo, error) {
 	name = clearPath(name)
+	if f.trash != nil && trash.Contains(name) {
+		return f.statTrash(ctx, name)
+	}
+	if f.versions != nil && versions.Contains(name) {
+		return f.statVersions(ctx, name)
+	}
+	if f.inArchive(ctx, name) {
+		return f.statArchive(ctx, name)
+	}
 	needPerm := PermRead
 
 	if err := f.checkPermission(ctx, name, needPerm); err != nil {
 		return nil, err
 	}
 
-	return f.root.Stat(ctx, name)
+	fsys, _, err := f.fileSystem(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.Stat(ctx, name)
 }
@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/model"
+)
+
+func TestReaddirFiltered(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"music", "secret", "music/private", "music/rock"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &conf.Conf{
+		Scope: []*conf.ScopeConf{{Name: "public", Library: "lib", Include: []string{"dir:/"},
+			Exclude: []string{"dir:/secret", "dir:/music/private"}, Permission: []string{"read"}}},
+		User: []*conf.UserConf{{Username: "alice", Scope: []string{"public"}}},
+	}
+	f := NewFs(cfg, &conf.LibraryConf{Name: "lib", MountPoint: root}, Options{})
+	ctx := model.SetUser(context.Background(), &model.User{Username: "alice", Local: true})
+
+	list := func(name string) []string {
+		t.Helper()
+		file, err := f.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		infos, err := file.Readdir(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	if got := list("/"); !slices.Equal(got, []string{"music"}) {
+		t.Errorf("root lists %v", got)
+	}
+	// the entries are checked in the listed directory rather than its parent
+	if got := list("/music"); !slices.Equal(got, []string{"rock"}) {
+		t.Errorf("music lists %v", got)
+	}
+}
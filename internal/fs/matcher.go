@@ -26,39 +26,16 @@ package fs
 import (
 	"errors"
 	"path/filepath"
+	"regexp"
 	"strings"
+
+	"github.com/llklkl/webdav/internal/glob"
 )
 
 type Matcher interface {
 	Match(path string) bool
 }
 
-type MatchGroup []Matcher
-
-func NewMatchGroup(patterns []string) (MatchGroup, error) {
-	var firstErr error
-	mg := make(MatchGroup, 0, len(patterns))
-	for _, p := range patterns {
-		if m, err := NewMatcher(p); err == nil {
-			mg = append(mg, m)
-		} else if firstErr == nil {
-			firstErr = err
-		}
-	}
-
-	return mg, firstErr
-}
-
-func (m MatchGroup) Match(path string) bool {
-	for i := range m {
-		if m[i].Match(path) {
-			return true
-		}
-	}
-
-	return false
-}
-
 func NewMatcher(pattern string) (Matcher, error) {
 	if strings.HasPrefix(pattern, "file:") {
 		pattern = pattern[5:]
@@ -66,6 +43,18 @@ func NewMatcher(pattern string) (Matcher, error) {
 	} else if strings.HasPrefix(pattern, "dir:") {
 		pattern = pattern[4:]
 		return newMatchDir(pattern), nil
+	} else if strings.HasPrefix(pattern, "glob:") {
+		re, err := glob.Compile(pattern[5:])
+		if err != nil {
+			return nil, err
+		}
+		return &MatchRegexp{re}, nil
+	} else if strings.HasPrefix(pattern, "re:") {
+		re, err := glob.CompileRegexp(pattern[3:])
+		if err != nil {
+			return nil, err
+		}
+		return &MatchRegexp{re}, nil
 	}
 
 	return nil, errors.New("unsupported pattern")
@@ -108,3 +97,12 @@ func newMatchDir(pattern string) MatchDir {
 func (m MatchDir) Match(path string) bool {
 	return strings.HasPrefix(path, string(m))
 }
+
+// MatchRegexp matches the paths with a compiled glob or regular expression.
+type MatchRegexp struct {
+	re *regexp.Regexp
+}
+
+func (m *MatchRegexp) Match(path string) bool {
+	return m.re.MatchString(path)
+}
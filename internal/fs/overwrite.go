@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package fs
+
+import (
+	"context"
+	"log/slog"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/llklkl/webdav/internal/trash"
+)
+
+// setAside keeps the file which is replaced by an upload as a version, or in
+// the trash, and returns the function which puts it back when the upload
+// fails, nil when nothing is kept.
+func (f *Fs) setAside(ctx context.Context, fsys webdav.FileSystem, root webdav.Dir, name string) (func(), error) {
+	if f.versions != nil {
+		version, err := f.saveVersion(ctx, fsys, root, name)
+		if version == "" || err != nil {
+			return nil, err
+		}
+		return func() {
+			f.putBack(ctx, fsys, root, name, func(ctx context.Context, u *unchecked) error {
+				return u.Rename(ctx, version, name)
+			})
+		}, nil
+	}
+	if f.trash != nil {
+		item, err := f.trashOverwritten(ctx, fsys, root, name)
+		if item == nil || err != nil {
+			return nil, err
+		}
+		return func() {
+			f.putBack(ctx, fsys, root, name, func(ctx context.Context, u *unchecked) error {
+				return trash.New(u).Restore(ctx, item, "")
+			})
+		}, nil
+	}
+	return nil, nil
+}
+
+// putBack restores the file which is set aside, replacing what a failed write
+// left at its path.
+func (f *Fs) putBack(ctx context.Context, fsys webdav.FileSystem, root webdav.Dir, name string,
+	restore func(ctx context.Context, u *unchecked) error) {
+	// the request may be aborted already
+	ctx = context.WithoutCancel(ctx)
+	u := f.unchecked(fsys, root)
+	if err := u.RemoveAll(ctx, name); err != nil {
+		slog.Warn("remove failed upload error", slog.String("name", name), slog.Any("err", err))
+	}
+	if err := restore(ctx, u); err != nil {
+		slog.Warn("restore replaced file error", slog.String("name", name), slog.Any("err", err))
+	}
+}
+
+// replacingFile is an upload replacing a file which is set aside, the file is
+// put back when the upload fails, i.e. a write fails or the request is
+// aborted.
+type replacingFile struct {
+	webdav.File
+	ctx     context.Context
+	failed  bool
+	putBack func()
+}
+
+func (f *replacingFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if err != nil {
+		f.failed = true
+	}
+	return n, err
+}
+
+func (f *replacingFile) Close() error {
+	err := f.File.Close()
+	if err != nil || f.failed || f.ctx.Err() != nil {
+		f.putBack()
+	}
+	return err
+}
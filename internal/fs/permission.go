@@ -24,6 +24,8 @@
 package fs
 
 import (
+	"net/http"
+	"os"
 	"strings"
 )
 
@@ -37,8 +39,12 @@ const (
 	PermCreateFolder Perm = 1 << 4
 	PermCreateFile   Perm = 1 << 5
 	PermRename       Perm = 1 << 6
+
+	PermAll = PermRead | PermWrite | PermDelete | PermCreateFolder | PermCreateFile | PermRename
 )
 
+var perms = []Perm{PermRead, PermWrite, PermDelete, PermCreateFolder, PermCreateFile, PermRename}
+
 func (p *Perm) String() string {
 	b := strings.Builder{}
 	b.Grow(64)
@@ -49,7 +55,7 @@ func (p *Perm) String() string {
 		b.WriteString(s)
 	}
 	var s string
-	for _, x := range []Perm{PermRead, PermWrite, PermDelete, PermCreateFolder, PermCreateFile, PermRename} {
+	for _, x := range perms {
 		if x&*p == 0 {
 			continue
 		}
@@ -82,13 +88,13 @@ func (p *Perm) FromString(perms []string) {
 		case "delete":
 			*p |= PermDelete
 		case "create_file":
-			*p |= PermCreateFolder
+			*p |= PermCreateFile
 		case "create_folder":
 			*p |= PermCreateFolder
 		case "rename":
 			*p |= PermRename
 		case "*":
-			*p |= PermRead | PermWrite | PermDelete | PermCreateFile | PermCreateFolder | PermRename
+			*p |= PermAll
 		}
 	}
 }
@@ -96,3 +102,38 @@ func (p *Perm) FromString(perms []string) {
 func (p *Perm) Check(needPerm Perm) bool {
 	return *p&needPerm == needPerm
 }
+
+// FlagPerm returns the permissions needed to open a file with the flag.
+func FlagPerm(flag int) Perm {
+	perm := PermRead
+	if flag&os.O_WRONLY != 0 {
+		perm |= PermWrite
+	}
+	if flag&os.O_RDWR != 0 {
+		perm |= PermWrite
+	}
+	if flag&os.O_CREATE != 0 {
+		perm |= PermCreateFile
+	}
+	return perm
+}
+
+// MethodPerm returns the permissions needed on the target of a WebDAV method,
+// as the file system operations of the webdav handler check them.
+func MethodPerm(method string) (Perm, bool) {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodOptions, "PROPFIND", "COPY":
+		return PermRead, true
+	case http.MethodPut, "LOCK":
+		return FlagPerm(os.O_RDWR | os.O_CREATE | os.O_TRUNC), true
+	case "PROPPATCH":
+		return FlagPerm(os.O_RDWR), true
+	case http.MethodDelete:
+		return PermDelete, true
+	case "MKCOL":
+		return PermCreateFolder, true
+	case "MOVE":
+		return PermRename, true
+	}
+	return PermNone, false
+}
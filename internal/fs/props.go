@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package fs
+
+import (
+	"encoding/xml"
+	"maps"
+	"net/http"
+	"path/filepath"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/llklkl/webdav/internal/props"
+)
+
+// resolve returns the path of name in the file system, whose names may be
+// encrypted.
+func (f *Fs) resolve(root webdav.Dir, name string) string {
+	if f.cipher != nil {
+		name = f.cipher.Path(name)
+	}
+	return filepath.Join(string(root), filepath.FromSlash(name))
+}
+
+// propsBackend returns nil when the dead properties of the root can not be
+// stored.
+func (f *Fs) propsBackend(root webdav.Dir) props.Backend {
+	if f.props == nil {
+		return nil
+	}
+	return f.props.Backend(string(root))
+}
+
+// DeadProps reports the stored properties, and the quota properties of
+// collections. The properties of a storage which is not a local directory are
+// kept by its files, e.g. of the memory storage.
+func (f *fileFilter) DeadProps() (map[xml.Name]webdav.Property, error) {
+	var deadProps map[xml.Name]webdav.Property
+	if f.props != nil {
+		stored, err := f.props.Props(f.path)
+		if err != nil {
+			return nil, err
+		}
+		deadProps = stored
+	} else if holder, ok := f.File.(webdav.DeadPropsHolder); ok {
+		held, err := holder.DeadProps()
+		if err != nil {
+			return nil, err
+		}
+		deadProps = maps.Clone(held)
+	}
+	if f.quotaProps != nil {
+		if info, err := f.File.Stat(); err == nil && info.IsDir() {
+			if deadProps == nil {
+				deadProps = map[xml.Name]webdav.Property{}
+			}
+			maps.Copy(deadProps, f.quotaProps())
+		}
+	}
+	return deadProps, nil
+}
+
+func (f *fileFilter) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if f.props == nil {
+		if holder, ok := f.File.(webdav.DeadPropsHolder); ok && f.quotaProps == nil {
+			return holder.Patch(patches)
+		}
+		return rejectPatch(patches, nil), nil
+	}
+	// the quota properties are computed, and can not be set
+	protected := func(name xml.Name) bool { return name == quotaAvailableBytes || name == quotaUsedBytes }
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			if protected(p.XMLName) {
+				return rejectPatch(patches, protected), nil
+			}
+		}
+	}
+
+	if err := f.props.Patch(f.path, patches); err != nil {
+		return nil, err
+	}
+	pstat := webdav.Propstat{Status: http.StatusOK}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
+
+// rejectPatch rejects all patches, the properties which can not be set fail
+// with 403 and the others with 424. All properties are forbidden when
+// forbidden is nil.
+func rejectPatch(patches []webdav.Proppatch, forbidden func(xml.Name) bool) []webdav.Propstat {
+	forbiddenStat := webdav.Propstat{
+		Status:   http.StatusForbidden,
+		XMLError: `<D:cannot-modify-protected-property xmlns:D="DAV:"/>`,
+	}
+	failedStat := webdav.Propstat{Status: http.StatusFailedDependency}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			if forbidden == nil || forbidden(p.XMLName) {
+				forbiddenStat.Props = append(forbiddenStat.Props, webdav.Property{XMLName: p.XMLName})
+			} else {
+				failedStat.Props = append(failedStat.Props, webdav.Property{XMLName: p.XMLName})
+			}
+		}
+	}
+	pstats := []webdav.Propstat{forbiddenStat}
+	if len(failedStat.Props) > 0 {
+		pstats = append(pstats, failedStat)
+	}
+	return pstats
+}
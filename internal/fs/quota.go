@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package fs
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/model"
+	"github.com/llklkl/webdav/internal/quota"
+)
+
+var (
+	quotaAvailableBytes = xml.Name{Space: "DAV:", Local: "quota-available-bytes"}
+	quotaUsedBytes      = xml.Name{Space: "DAV:", Local: "quota-used-bytes"}
+)
+
+// owner returns the user whose usage the writes of the context count for.
+func owner(ctx context.Context) string {
+	user := model.GetUser(ctx)
+	if user == nil || user.Anonymous {
+		return ""
+	}
+	return user.Username
+}
+
+// CheckQuota reports an error when the quotas of the users can not be
+// enforced in the library, whose owners of files are recorded in extended
+// attributes.
+func (f *Fs) CheckQuota() error {
+	if f.quota == nil || !f.quota.UserLimited(f.name) {
+		return nil
+	}
+	dir := string(f.root)
+	if f.template {
+		dir, _, _ = strings.Cut(dir, conf.UsernamePlaceholder)
+	}
+	// the roots of a template, or the mount point, may not exist yet
+	for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	if !quota.OwnerSupported(dir) {
+		return fmt.Errorf("the user quotas of library[%s] require extended attributes, which %s does not support", f.name, dir)
+	}
+	return nil
+}
+
+// openQuota opens a file for writing, and tracks the bytes it uses.
+func (f *Fs) openQuota(ctx context.Context, fsys webdav.FileSystem, root webdav.Dir, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	path := f.resolve(root, name)
+	var oldSize int64
+	var oldOwner string
+	if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+		oldSize, oldOwner = info.Size(), quota.Owner(path)
+	}
+
+	file, err := fsys.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&os.O_TRUNC != 0 && oldSize > 0 {
+		f.quota.Add(string(root), oldOwner, -oldSize)
+		oldSize = 0
+	}
+
+	return &quotaFile{
+		File:    file,
+		tracker: f.quota,
+		root:    string(root),
+		path:    path,
+		user:    owner(ctx),
+		owner:   oldOwner,
+		// the owners are only needed by the quotas of the users
+		ownerRequired: f.quota.UserLimited(f.name),
+		size:          oldSize,
+		exceed: func() {
+			model.MarkQuotaExceeded(ctx)
+			model.Abort(ctx, quota.ErrExceeded)
+		},
+	}, nil
+}
+
+// removeQuota releases the usage of the files under name before they are
+// removed.
+func (f *Fs) removeQuota(root webdav.Dir, name string) {
+	path := f.resolve(root, name)
+	_ = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			f.quota.Add(string(root), quota.Owner(p), -info.Size())
+		}
+		return nil
+	})
+}
+
+// quotaProps returns the RFC 4331 properties of the user in the context.
+func (f *Fs) quotaProps(ctx context.Context) map[xml.Name]webdav.Property {
+	available, used := f.quota.Usage(f.name, owner(ctx))
+	if available < 0 {
+		return nil
+	}
+	return map[xml.Name]webdav.Property{
+		quotaAvailableBytes: {XMLName: quotaAvailableBytes, InnerXML: []byte(strconv.FormatInt(available, 10))},
+		quotaUsedBytes:      {XMLName: quotaUsedBytes, InnerXML: []byte(strconv.FormatInt(used, 10))},
+	}
+}
+
+// quotaFile reserves the bytes a write adds to the file, and transfers the
+// file to the user who writes it.
+type quotaFile struct {
+	webdav.File
+	tracker *quota.Tracker
+	root    string
+	path    string
+	user    string
+	owner   string
+	size    int64
+	// a failure to record the owner is logged as a warning when required
+	ownerRequired bool
+	exceed        func()
+	exceeded      bool
+}
+
+func (f *quotaFile) Write(p []byte) (int, error) {
+	pos, err := f.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if f.owner != f.user {
+		f.tracker.Transfer(f.root, f.owner, f.user, f.size)
+		f.owner = f.user
+		if f.user != "" {
+			if err := quota.SetOwner(f.path, f.user); err != nil {
+				level := slog.LevelDebug
+				if f.ownerRequired {
+					level = slog.LevelWarn
+				}
+				slog.Log(context.Background(), level, "record the owner of file error",
+					slog.String("path", f.path), slog.Any("err", err))
+			}
+		}
+	}
+	grow := max(pos+int64(len(p))-f.size, 0)
+	if grow > 0 && !f.tracker.Reserve(f.root, f.owner, grow) {
+		f.exceeded = true
+		f.exceed()
+		return 0, quota.ErrExceeded
+	}
+
+	n, err := f.File.Write(p)
+	if written := max(pos+int64(n)-f.size, 0); written < grow {
+		f.tracker.Add(f.root, f.owner, written-grow)
+	}
+	f.size = max(f.size, pos+int64(n))
+	return n, err
+}
+
+// Close removes the file when a write exceeded the quota, so that no partial
+// upload is left.
+func (f *quotaFile) Close() error {
+	err := f.File.Close()
+	if f.exceeded {
+		if rmErr := os.Remove(f.path); rmErr == nil || errors.Is(rmErr, fs.ErrNotExist) {
+			f.tracker.Add(f.root, f.owner, -f.size)
+		}
+	}
+	return err
+}
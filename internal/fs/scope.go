@@ -24,67 +24,169 @@
 package fs
 
 import (
+	"fmt"
 	"log/slog"
 
 	"github.com/llklkl/webdav/conf"
 )
 
-type Scope struct {
-	name    string
-	include MatchGroup
-	exclude MatchGroup
-	perm    Perm
+// Rule allows or denies its permissions on the paths matching its patterns.
+type Rule struct {
+	// where the rule comes from, rule[i], exclude or include
+	source   string
+	allow    bool
+	patterns []string
+	matchers []Matcher
+	perm     Perm
 }
 
-type ScopeGroup []*Scope
+func NewRule(source string, allow bool, patterns []string, perm Perm) *Rule {
+	r := &Rule{
+		source: source,
+		allow:  allow,
+		perm:   perm,
+	}
+	for _, pattern := range patterns {
+		m, err := NewMatcher(pattern)
+		if err != nil {
+			slog.Warn("pattern syntax error", slog.String("pattern", pattern), slog.Any("err", err))
+			continue
+		}
+		r.patterns = append(r.patterns, pattern)
+		r.matchers = append(r.matchers, m)
+	}
+	return r
+}
 
-func (s ScopeGroup) Match(path string, perm Perm) (bool, bool) {
-	hasMatched := false
-	hasPermission := false
-	for _, scope := range s {
-		matched, permission := scope.Match(path, perm)
-		hasMatched = hasMatched || matched
-		hasPermission = hasPermission || permission
-		if matched && permission {
-			break
+// match returns the pattern matching the path.
+func (r *Rule) match(path string) (string, bool) {
+	for i, m := range r.matchers {
+		if m.Match(path) {
+			return r.patterns[i], true
 		}
 	}
+	return "", false
+}
 
-	return hasMatched, hasPermission
+type Scope struct {
+	name  string
+	rules []*Rule
 }
 
+// NewScope builds the rules of the scope, the include and exclude patterns are
+// translated to an allow rule of the permissions of the scope, preceded by a
+// deny rule of all permissions.
 func NewScope(scp *conf.ScopeConf) *Scope {
-	include, err := NewMatchGroup(scp.Include)
-	if err != nil {
-		slog.Warn("include syntax error", slog.Any("include", scp.Include), slog.Any("err", err))
+	s := &Scope{
+		name: scp.Name,
 	}
-	exclude, err := NewMatchGroup(scp.Exclude)
-	if err != nil {
-		slog.Warn("exclude syntax error", slog.Any("exclude", scp.Exclude), slog.Any("err", err))
+	for i, rc := range scp.Rule {
+		perm := PermAll
+		if len(rc.Perms) > 0 {
+			perm = PermNone
+			perm.FromString(rc.Perms)
+		}
+		s.rules = append(s.rules, NewRule(fmt.Sprintf("rule[%d]", i), rc.Action == "allow", rc.Paths, perm))
 	}
-	s := &Scope{
-		name:    scp.Name,
-		include: include,
-		exclude: exclude,
+	if len(scp.Exclude) > 0 {
+		s.rules = append(s.rules, NewRule("exclude", false, scp.Exclude, PermAll))
+	}
+	if len(scp.Include) > 0 {
+		var perm Perm
+		perm.FromString(scp.Permission)
+		s.rules = append(s.rules, NewRule("include", true, scp.Include, perm))
 	}
-	s.perm.FromString(scp.Permission)
 	return s
 }
 
-func (s *Scope) Match(name string, perm Perm) (matched, permission bool) {
-	if !s.perm.Check(perm) {
-		return
+// decide returns the first rule of the scope covering the permission and
+// matching the path, with the matched pattern.
+func (s *Scope) decide(path string, perm Perm) (*Rule, string) {
+	for _, rule := range s.rules {
+		if rule.perm&perm == 0 {
+			continue
+		}
+		if pattern, ok := rule.match(path); ok {
+			return rule, pattern
+		}
 	}
-	permission = true
+	return nil, ""
+}
+
+type ScopeGroup []*Scope
 
-	if s.exclude.Match(name) {
-		return
+// Step is the decision of a scope on a single permission.
+type Step struct {
+	Perm    Perm
+	Scope   string
+	Rule    string
+	Pattern string
+	Allow   bool
+}
+
+func (s Step) String() string {
+	if s.Rule == "" {
+		return fmt.Sprintf("%s: scope[%s] no match", s.Perm.String(), s.Scope)
+	}
+	action := "deny"
+	if s.Allow {
+		action = "allow"
 	}
+	return fmt.Sprintf("%s: scope[%s] %s pattern[%s] %s", s.Perm.String(), s.Scope, s.Rule, s.Pattern, action)
+}
 
-	if s.include.Match(name) {
-		matched = true
-		return
+// Check reports whether all the permissions are allowed on the path. Each
+// permission is allowed by any scope allowing it, or, with deny precedence,
+// when no scope denies it either.
+func (s ScopeGroup) Check(path string, need Perm, denyPrecedence bool) bool {
+	return s.evaluate(path, need, denyPrecedence, nil)
+}
+
+// Explain is Check which also returns the decisions of the scopes.
+func (s ScopeGroup) Explain(path string, need Perm, denyPrecedence bool) (bool, []Step) {
+	var steps []Step
+	allowed := s.evaluate(path, need, denyPrecedence, &steps)
+	return allowed, steps
+}
+
+func (s ScopeGroup) evaluate(path string, need Perm, denyPrecedence bool, steps *[]Step) bool {
+	allowed := true
+	for _, perm := range perms {
+		if need&perm == 0 {
+			continue
+		}
+		permAllowed := false
+		for _, scope := range s {
+			rule, pattern := scope.decide(path, perm)
+			if steps != nil {
+				step := Step{Perm: perm, Scope: scope.name, Pattern: pattern}
+				if rule != nil {
+					step.Rule = rule.source
+					step.Allow = rule.allow
+				}
+				*steps = append(*steps, step)
+			}
+			if rule == nil {
+				continue
+			}
+			if !rule.allow && denyPrecedence {
+				permAllowed = false
+				break
+			}
+			if rule.allow {
+				permAllowed = true
+				if !denyPrecedence {
+					break
+				}
+			}
+		}
+		if !permAllowed {
+			allowed = false
+			if steps == nil {
+				break
+			}
+		}
 	}
 
-	return
+	return allowed
 }
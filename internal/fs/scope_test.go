@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package fs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/model"
+)
+
+func TestScopeRules(t *testing.T) {
+	scope := NewScope(&conf.ScopeConf{
+		Name: "media",
+		Rule: []*conf.RuleConf{
+			{Action: "deny", Paths: []string{"glob:*.tmp"}, Perms: []string{"read"}},
+			{Action: "allow", Paths: []string{"dir:/upload"}, Perms: []string{"write", "create_file"}},
+		},
+		Include:    []string{"dir:/"},
+		Exclude:    []string{"dir:/private"},
+		Permission: []string{"read"},
+	})
+	group := ScopeGroup{scope}
+
+	tests := []struct {
+		path  string
+		need  Perm
+		allow bool
+	}{
+		{"/music/a.flac", PermRead, true},
+		{"/music/a.tmp", PermRead, false},
+		{"/private/a.flac", PermRead, false},
+		{"/music/a.flac", PermWrite, false},
+		{"/upload/a.flac", PermWrite | PermCreateFile, true},
+		{"/upload/a.flac", PermRead | PermWrite | PermCreateFile, true},
+		{"/upload/a.flac", PermDelete, false},
+	}
+	for _, tt := range tests {
+		if got := group.Check(tt.path, tt.need, false); got != tt.allow {
+			t.Errorf("%s %s: got %v, want %v", tt.path, tt.need.String(), got, tt.allow)
+		}
+	}
+}
+
+func TestScopeGroupDenyPrecedence(t *testing.T) {
+	group := ScopeGroup{
+		NewScope(&conf.ScopeConf{
+			Name:       "all",
+			Include:    []string{"dir:/"},
+			Permission: []string{"*"},
+		}),
+		NewScope(&conf.ScopeConf{
+			Name: "no-secrets",
+			Rule: []*conf.RuleConf{{Action: "deny", Paths: []string{"dir:/secret"}}},
+		}),
+	}
+
+	if !group.Check("/secret/a", PermRead, false) {
+		t.Error("the allow of another scope should win without deny precedence")
+	}
+	if group.Check("/secret/a", PermRead, true) {
+		t.Error("the deny should win with deny precedence")
+	}
+	if !group.Check("/public/a", PermRead|PermWrite, true) {
+		t.Error("expect allowed without any deny")
+	}
+
+	allowed, steps := group.Explain("/secret/a", PermRead, true)
+	if allowed || len(steps) != 2 {
+		t.Fatalf("unexpected explain %v %+v", allowed, steps)
+	}
+	if steps[0].Rule != "include" || !steps[0].Allow || steps[1].Rule != "rule[0]" || steps[1].Allow ||
+		steps[1].Pattern != "dir:/secret" {
+		t.Errorf("unexpected steps %+v", steps)
+	}
+}
+
+func TestUserScopeProvider(t *testing.T) {
+	cfg := &conf.Conf{
+		Scope: []*conf.ScopeConf{
+			{Name: "all", Library: "lib", Include: []string{"dir:/"}, Permission: []string{"*"}},
+			{Name: "read", Library: "lib", Include: []string{"dir:/"}, Permission: []string{"read"}},
+		},
+		User:  []*conf.UserConf{{Username: "alice", Scope: []string{"all"}}},
+		Group: []*conf.GroupConf{{Name: "staff", Members: []string{"alice"}, Scope: []string{"read"}}},
+	}
+	f := NewFs(cfg, &conf.LibraryConf{Name: "lib", MountPoint: t.TempDir()}, Options{})
+
+	local := model.SetUser(context.Background(), &model.User{Username: "alice", Local: true})
+	if err := f.checkPermission(local, "/a.txt", PermWrite); err != nil {
+		t.Errorf("local user: %v", err)
+	}
+	// e.g. an LDAP user named like the local one only has the scopes of the groups
+	external := model.SetUser(context.Background(), &model.User{Username: "alice"})
+	if err := f.checkPermission(external, "/a.txt", PermWrite); err == nil {
+		t.Error("external user got the scopes of the local user")
+	}
+	if err := f.checkPermission(external, "/a.txt", PermRead); err != nil {
+		t.Errorf("external user lost the scopes of the group: %v", err)
+	}
+}
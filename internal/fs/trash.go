@@ -0,0 +1,328 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package fs
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/model"
+	"github.com/llklkl/webdav/internal/pkg"
+	"github.com/llklkl/webdav/internal/trash"
+)
+
+const maxPurgeInterval = time.Hour
+
+// unchecked is the file system of a root without the permission checks, it
+// keeps the quota usage and the dead properties of the files.
+type unchecked struct {
+	f    *Fs
+	fsys webdav.FileSystem
+	root webdav.Dir
+}
+
+func (f *Fs) unchecked(fsys webdav.FileSystem, root webdav.Dir) *unchecked {
+	return &unchecked{f: f, fsys: fsys, root: root}
+}
+
+func (u *unchecked) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return u.fsys.Mkdir(ctx, name, perm)
+}
+
+func (u *unchecked) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if u.f.quota != nil && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return u.f.openQuota(ctx, u.fsys, u.root, name, flag, perm)
+	}
+	return u.fsys.OpenFile(ctx, name, flag, perm)
+}
+
+func (u *unchecked) RemoveAll(ctx context.Context, name string) error {
+	return u.f.removeAll(ctx, u.fsys, u.root, name)
+}
+
+func (u *unchecked) Rename(ctx context.Context, oldName, newName string) error {
+	return u.f.rename(ctx, u.fsys, u.root, oldName, newName)
+}
+
+func (u *unchecked) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return u.fsys.Stat(ctx, name)
+}
+
+// Bin returns the trash of the user in the context.
+func (f *Fs) Bin(ctx context.Context) (*trash.Bin, error) {
+	bin, _, err := f.bin(ctx)
+	return bin, err
+}
+
+// bin returns the trash, and the file system which reads it.
+func (f *Fs) bin(ctx context.Context) (*trash.Bin, webdav.FileSystem, error) {
+	if f.trash == nil {
+		return nil, nil, errors.New("the trash of library is disabled")
+	}
+	fsys, root, err := f.fileSystem(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return trash.New(f.unchecked(fsys, root)), fsys, nil
+}
+
+// trashAdmin reports whether the user in the context can access the items of
+// all users.
+func (f *Fs) trashAdmin(ctx context.Context) bool {
+	user := model.GetUser(ctx)
+	if user == nil || user.Anonymous {
+		return false
+	}
+	if f.trashAdmins[user.Username] {
+		return true
+	}
+	return slices.ContainsFunc(user.Groups, func(group string) bool {
+		return slices.Contains(f.trash.AdminGroups, group)
+	})
+}
+
+// trashVisible reports whether the user in the context can access the item.
+func (f *Fs) trashVisible(ctx context.Context, item *trash.Item) bool {
+	if f.trashAdmin(ctx) {
+		return true
+	}
+	user := model.GetUser(ctx)
+	return user != nil && !user.Anonymous && item.User == user.Username
+}
+
+func denied(ctx context.Context) error {
+	model.MarkDenied(ctx)
+	return os.ErrPermission
+}
+
+// trashItem returns the item of a path in the trash, which is not found when
+// the user can not access it.
+func (f *Fs) trashItem(ctx context.Context, bin *trash.Bin, name string) (*trash.Item, string, error) {
+	id, rest := trash.Split(name)
+	item, err := bin.Get(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+	if !f.trashVisible(ctx, item) {
+		return nil, "", &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return item, rest, nil
+}
+
+func (f *Fs) statTrash(ctx context.Context, name string) (os.FileInfo, error) {
+	bin, fsys, err := f.bin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if name == trash.Dir {
+		if err := bin.Ensure(ctx); err != nil {
+			return nil, err
+		}
+	} else if _, _, err := f.trashItem(ctx, bin, name); err != nil {
+		return nil, err
+	}
+	return fsys.Stat(ctx, name)
+}
+
+// openTrash opens the trash for reading, the trash directory only lists the
+// items which the user can access.
+func (f *Fs) openTrash(ctx context.Context, name string, flag int) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, denied(ctx)
+	}
+	bin, fsys, err := f.bin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if name != trash.Dir {
+		if _, _, err := f.trashItem(ctx, bin, name); err != nil {
+			return nil, err
+		}
+		return fsys.OpenFile(ctx, name, os.O_RDONLY, 0)
+	}
+
+	if err := bin.Ensure(ctx); err != nil {
+		return nil, err
+	}
+	file, err := fsys.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &trashDir{File: file, visible: func(id string) bool {
+		item, err := bin.Get(ctx, id)
+		return err == nil && f.trashVisible(ctx, item)
+	}}, nil
+}
+
+// removeTrash purges an item, the files within an item can not be removed.
+func (f *Fs) removeTrash(ctx context.Context, name string) error {
+	bin, err := f.Bin(ctx)
+	if err != nil {
+		return err
+	}
+	if name == trash.Dir {
+		return denied(ctx)
+	}
+	item, rest, err := f.trashItem(ctx, bin, name)
+	if err != nil {
+		return err
+	}
+	if rest != "" {
+		return denied(ctx)
+	}
+	return bin.Purge(ctx, item.ID)
+}
+
+// restoreTrash moves the deleted file of an item to a path, which the user
+// needs the permission to create.
+func (f *Fs) restoreTrash(ctx context.Context, oldName, newName string) error {
+	bin, err := f.Bin(ctx)
+	if err != nil {
+		return err
+	}
+	if trash.Contains(newName) {
+		return denied(ctx)
+	}
+	item, rest, err := f.trashItem(ctx, bin, oldName)
+	if err != nil {
+		return err
+	}
+	if rest != "/"+path.Base(item.Path) {
+		return denied(ctx)
+	}
+	needPerm := PermCreateFile
+	if item.IsDir {
+		needPerm = PermCreateFolder
+	}
+	if err := f.checkPermission(ctx, newName, needPerm); err != nil {
+		return err
+	}
+	return bin.Restore(ctx, item, newName)
+}
+
+// trashOverwritten moves the file which is replaced by an upload into the
+// trash, and returns the item, nil when it is not kept. Empty files are not
+// kept.
+func (f *Fs) trashOverwritten(ctx context.Context, fsys webdav.FileSystem, root webdav.Dir, name string) (*trash.Item, error) {
+	info, err := fsys.Stat(ctx, name)
+	if err != nil || info.IsDir() || info.Size() == 0 {
+		return nil, nil
+	}
+	return trash.New(f.unchecked(fsys, root)).Move(ctx, name, owner(ctx), true)
+}
+
+// trashDir lists the items of the trash directory.
+type trashDir struct {
+	webdav.File
+	visible func(id string) bool
+}
+
+func (d *trashDir) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	if err != nil {
+		return nil, err
+	}
+	filtered := infos[:0]
+	for _, info := range infos {
+		if info.IsDir() && d.visible(info.Name()) {
+			filtered = append(filtered, info)
+		}
+	}
+	return filtered, nil
+}
+
+// StartPurge purges the expired items of the trash, and the expired versions
+// in the background.
+func (f *Fs) StartPurge() {
+	if f.trash == nil && (f.versions == nil || f.versions.MaxAge == 0) {
+		return
+	}
+	interval := maxPurgeInterval
+	if f.trash != nil {
+		interval = min(interval, f.trashRetention)
+	}
+	if f.versions != nil && f.versions.MaxAge > 0 {
+		interval = min(interval, f.versions.MaxAge)
+	}
+	pkg.SafeG(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			f.purge()
+			<-ticker.C
+		}
+	})
+}
+
+// purge purges the expired items and versions of the roots of the library.
+func (f *Fs) purge() {
+	ctx := context.Background()
+	type root struct {
+		fsys webdav.FileSystem
+		dir  webdav.Dir
+	}
+	var roots []root
+	switch {
+	case f.storage != nil:
+		roots = append(roots, root{f.view(f.storage), ""})
+	case !f.template:
+		roots = append(roots, root{f.view(f.root), f.root})
+	default:
+		dirs, err := filepath.Glob(strings.ReplaceAll(string(f.root), conf.UsernamePlaceholder, "*"))
+		if err != nil {
+			slog.Warn("find the roots of library error", slog.String("library", f.name), slog.Any("err", err))
+			return
+		}
+		for _, dir := range dirs {
+			roots = append(roots, root{f.view(webdav.Dir(dir)), webdav.Dir(dir)})
+		}
+	}
+
+	for _, r := range roots {
+		if f.versions != nil && f.versions.MaxAge > 0 {
+			if err := f.versionStore(r.fsys, r.dir).Expire(ctx); err != nil {
+				slog.Warn("purge versions error", slog.String("library", f.name), slog.Any("err", err))
+			}
+		}
+		if f.trash == nil {
+			continue
+		}
+		n, err := trash.New(f.unchecked(r.fsys, r.dir)).Expire(ctx, time.Now().Add(-f.trashRetention))
+		if err != nil {
+			slog.Warn("purge trash error", slog.String("library", f.name), slog.Any("err", err))
+		}
+		if n > 0 {
+			slog.Info("purged trash", slog.String("library", f.name), slog.Int("items", n))
+		}
+	}
+}
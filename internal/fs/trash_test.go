@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/model"
+	"github.com/llklkl/webdav/internal/trash"
+)
+
+func TestTrash(t *testing.T) {
+	root := t.TempDir()
+	lib := &conf.LibraryConf{
+		Name:       "shared",
+		MountPoint: root,
+		Trash:      &conf.TrashConf{AdminGroups: []string{"ops"}},
+	}
+	cfg := &conf.Conf{
+		Library: []*conf.LibraryConf{lib},
+		Scope: []*conf.ScopeConf{
+			{Name: "all", Library: "shared", Include: []string{"dir:/"}, Exclude: []string{"dir:/archive"}, Permission: []string{"*"}},
+		},
+		User: []*conf.UserConf{
+			{Username: "alice", Scope: []string{"all"}},
+			{Username: "bob", Scope: []string{"all"}},
+			{Username: "carol", Scope: []string{"all"}},
+		},
+		Group: []*conf.GroupConf{{Name: "ops", Members: []string{"carol"}}},
+	}
+	f := NewFs(cfg, lib, Options{})
+	as := func(username string) context.Context {
+		return model.SetUser(context.Background(), &model.User{Username: username, Local: true})
+	}
+	put := func(ctx context.Context, name, data string) {
+		t.Helper()
+		file, err := f.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+	list := func(ctx context.Context, name string) []string {
+		t.Helper()
+		file, err := f.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		infos, err := file.Readdir(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	alice, bob, carol := as("alice"), as("bob"), as("carol")
+	put(alice, "/a.txt", "v1")
+	put(alice, "/a.txt", "v2")
+	put(bob, "/b.txt", "b")
+	if err := f.RemoveAll(bob, "/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "b.txt")); !os.IsNotExist(err) {
+		t.Fatalf("deleted file left: %v", err)
+	}
+
+	if got := list(alice, "/"); !slices.Equal(got, []string{"a.txt"}) {
+		t.Errorf("root lists %v", got)
+	}
+	aliceItems, bobItems := list(alice, trash.Dir), list(bob, trash.Dir)
+	if len(aliceItems) != 1 || len(bobItems) != 1 || len(list(carol, trash.Dir)) != 2 {
+		t.Fatalf("items of alice %v, of bob %v", aliceItems, bobItems)
+	}
+	if _, err := f.Stat(alice, trash.Dir+"/"+bobItems[0]+"/b.txt"); !os.IsNotExist(err) {
+		t.Errorf("alice stats the item of bob: %v", err)
+	}
+	if _, err := f.OpenFile(bob, trash.Dir+"/"+bobItems[0]+"/b.txt", os.O_RDWR, 0); !os.IsPermission(err) {
+		t.Errorf("open item for writing: %v", err)
+	}
+	if err := f.Mkdir(bob, trash.Dir+"/x", 0755); !os.IsPermission(err) {
+		t.Errorf("mkdir in trash: %v", err)
+	}
+
+	// the overwritten version is restored by an admin beside the current one
+	if err := f.Rename(carol, trash.Dir+"/"+aliceItems[0]+"/a.txt", "/archive/a.txt"); !os.IsPermission(err) {
+		t.Errorf("restore without the permission: %v", err)
+	}
+	if err := f.Rename(carol, trash.Dir+"/"+aliceItems[0]+"/a.txt", "/a.v1.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "a.v1.txt")); string(data) != "v1" {
+		t.Errorf("restored %q", data)
+	}
+	if err := f.RemoveAll(bob, trash.Dir+"/"+bobItems[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got := list(carol, trash.Dir); len(got) != 0 {
+		t.Errorf("items left %v", got)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package fs
+
+import (
+	"context"
+	"os"
+	"path"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/llklkl/webdav/internal/versions"
+)
+
+func (f *Fs) versionStore(fsys webdav.FileSystem, root webdav.Dir) *versions.Store {
+	return versions.New(f.unchecked(fsys, root), *f.versions)
+}
+
+// saveVersion moves the file which is being replaced into its versions, and
+// returns the path of the version, empty when it is not kept. Directories and
+// empty files are not kept.
+func (f *Fs) saveVersion(ctx context.Context, fsys webdav.FileSystem, root webdav.Dir, name string) (string, error) {
+	info, err := fsys.Stat(ctx, name)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return "", nil
+	}
+	return f.versionStore(fsys, root).Save(ctx, name)
+}
+
+// versionsOriginal returns the path in the library of a path in the versions
+// directory, i.e. the file of a version, or the directory of a directory.
+func versionsOriginal(info os.FileInfo, name string) string {
+	if info.IsDir() {
+		return versions.Original(name)
+	}
+	return versions.Original(path.Dir(name))
+}
+
+// statVersions stats a path in the versions directory, which the user needs
+// the permission to read its original path.
+func (f *Fs) statVersions(ctx context.Context, name string) (os.FileInfo, error) {
+	fsys, root, err := f.fileSystem(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if name == versions.Dir {
+		if err := f.versionStore(fsys, root).Ensure(ctx); err != nil {
+			return nil, err
+		}
+	}
+	info, err := fsys.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.checkPermission(ctx, versionsOriginal(info, name), PermRead); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// openVersions opens the versions for reading, the directories only list the
+// versions of the files which the user can read.
+func (f *Fs) openVersions(ctx context.Context, name string, flag int) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, denied(ctx)
+	}
+	info, err := f.statVersions(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	fsys, _, err := f.fileSystem(ctx)
+	if err != nil {
+		return nil, err
+	}
+	file, err := fsys.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil || !info.IsDir() {
+		return file, err
+	}
+	scope := f.getScope(ctx)
+	return &versionsDir{File: file, visible: func(info os.FileInfo) bool {
+		return scope.Check(versionsOriginal(info, path.Join(name, info.Name())), PermRead, f.denyPrecedence)
+	}}, nil
+}
+
+// versionsDir lists a directory in the versions directory.
+type versionsDir struct {
+	webdav.File
+	visible func(info os.FileInfo) bool
+}
+
+func (d *versionsDir) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	if err != nil {
+		return nil, err
+	}
+	filtered := infos[:0]
+	for _, info := range infos {
+		if d.visible(info) {
+			filtered = append(filtered, info)
+		}
+	}
+	return filtered, nil
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package fs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/model"
+	"github.com/llklkl/webdav/internal/versions"
+)
+
+func TestVersions(t *testing.T) {
+	root := t.TempDir()
+	lib := &conf.LibraryConf{
+		Name:       "shared",
+		MountPoint: root,
+		Versions:   &conf.VersionsConf{Keep: 2},
+	}
+	cfg := &conf.Conf{
+		Library: []*conf.LibraryConf{lib},
+		Scope: []*conf.ScopeConf{
+			{Name: "all", Library: "shared", Include: []string{"dir:/"}, Permission: []string{"*"}},
+			{Name: "public", Library: "shared", Include: []string{"dir:/"}, Exclude: []string{"dir:/private"}, Permission: []string{"*"}},
+		},
+		User: []*conf.UserConf{
+			{Username: "alice", Scope: []string{"all"}},
+			{Username: "bob", Scope: []string{"public"}},
+		},
+	}
+	f := NewFs(cfg, lib, Options{})
+	alice := model.SetUser(context.Background(), &model.User{Username: "alice", Local: true})
+	bob := model.SetUser(context.Background(), &model.User{Username: "bob", Local: true})
+	put := func(name, data string) {
+		t.Helper()
+		file, err := f.OpenFile(alice, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+	read := func(ctx context.Context, name string) string {
+		t.Helper()
+		file, err := f.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	list := func(ctx context.Context, name string) []string {
+		t.Helper()
+		file, err := f.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		infos, err := file.Readdir(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	for _, data := range []string{"v1", "v2", "v3"} {
+		put("/a.txt", data)
+	}
+	if err := f.Mkdir(alice, "/private", 0755); err != nil {
+		t.Fatal(err)
+	}
+	put("/private/b.txt", "secret")
+	put("/private/b.txt", "")
+
+	if got := list(alice, "/"); !slices.Equal(got, []string{"a.txt", "private"}) {
+		t.Errorf("root lists %v", got)
+	}
+	if got := list(bob, versions.Dir); !slices.Equal(got, []string{"a.txt"}) {
+		t.Errorf("bob lists versions %v", got)
+	}
+	if got := list(alice, versions.Dir); !slices.Equal(got, []string{"a.txt", "private"}) {
+		t.Errorf("alice lists versions %v", got)
+	}
+	if _, err := f.Stat(bob, versions.Path("/private/b.txt")); !os.IsPermission(err) {
+		t.Errorf("bob stats the versions of private: %v", err)
+	}
+	saved := list(bob, versions.Path("/a.txt"))
+	if len(saved) != 2 || read(bob, path.Join(versions.Path("/a.txt"), saved[1])) != "v2" {
+		t.Fatalf("versions of a.txt %v", saved)
+	}
+	if _, err := f.OpenFile(alice, path.Join(versions.Path("/a.txt"), saved[1]), os.O_RDWR, 0); !os.IsPermission(err) {
+		t.Errorf("open version for writing: %v", err)
+	}
+	if err := f.RemoveAll(alice, versions.Path("/a.txt")); !os.IsPermission(err) {
+		t.Errorf("remove versions: %v", err)
+	}
+
+	// a COPY back removes the current file as a version first
+	data := read(bob, path.Join(versions.Path("/a.txt"), saved[1]))
+	if err := f.RemoveAll(model.SetOverwrite(bob), "/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	put("/a.txt", data)
+	if got := read(bob, "/a.txt"); got != "v2" {
+		t.Errorf("restored %q", got)
+	}
+	saved = list(bob, versions.Path("/a.txt"))
+	if len(saved) != 2 || read(bob, path.Join(versions.Path("/a.txt"), saved[1])) != "v3" {
+		t.Errorf("versions after restore %v", saved)
+	}
+
+	// a rename over an existing file keeps it as a version
+	put("/c.txt", "c")
+	if err := f.Rename(alice, "/c.txt", "/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	saved = list(bob, versions.Path("/a.txt"))
+	if len(saved) != 2 || read(bob, path.Join(versions.Path("/a.txt"), saved[1])) != "v2" {
+		t.Errorf("versions after rename %v", saved)
+	}
+	if err := f.RemoveAll(alice, "/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("deleted file left: %v", err)
+	}
+}
+
+func TestFailedUpload(t *testing.T) {
+	for _, lib := range []*conf.LibraryConf{
+		{Name: "versions", Versions: &conf.VersionsConf{}},
+		{Name: "trash", Trash: &conf.TrashConf{}},
+	} {
+		root := t.TempDir()
+		lib.MountPoint = root
+		cfg := &conf.Conf{
+			Library: []*conf.LibraryConf{lib},
+			Scope:   []*conf.ScopeConf{{Name: "all", Library: lib.Name, Include: []string{"dir:/"}, Permission: []string{"*"}}},
+			User:    []*conf.UserConf{{Username: "alice", Scope: []string{"all"}}},
+		}
+		f := NewFs(cfg, lib, Options{})
+		ctx := model.SetUser(context.Background(), &model.User{Username: "alice", Local: true})
+		if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("original"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		check := func(when string) {
+			t.Helper()
+			if data, err := os.ReadFile(filepath.Join(root, "a.txt")); string(data) != "original" {
+				t.Errorf("%s: a.txt after %s: %q %v", lib.Name, when, data, err)
+			}
+		}
+
+		// the file is set aside before the open, which fails without O_CREATE
+		if _, err := f.OpenFile(ctx, "/a.txt", os.O_RDWR|os.O_TRUNC, 0); err == nil {
+			t.Fatalf("%s: open succeeded", lib.Name)
+		}
+		check("a failed open")
+
+		aborted, cancel := context.WithCancel(ctx)
+		file, err := f.OpenFile(aborted, "/a.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write([]byte("partial")); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		file.Close()
+		check("an aborted upload")
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+// Package glob translates gitignore style glob patterns to regular expressions.
+package glob
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Compile compiles a glob pattern with gitignore semantics to a regular
+// expression matching slash separated absolute paths:
+//
+//   - a pattern without a slash but at the end matches at any depth, otherwise
+//     it is relative to the root
+//   - "*" matches anything but a slash, "?" a single character but a slash,
+//     "[...]" a character class, "[!...]" its negation
+//   - a leading "**/" matches in all directories, a trailing "/**" everything
+//     inside, "/**/" zero or more directories
+//   - a trailing slash is ignored
+//
+// A path also matches when one of its parent directories matches.
+func Compile(pattern string) (*regexp.Regexp, error) {
+	pattern = strings.TrimSuffix(pattern, "/")
+	if strings.Trim(pattern, "/") == "" {
+		return nil, errors.New("empty glob pattern")
+	}
+
+	var b strings.Builder
+	if strings.Contains(pattern, "/") {
+		b.WriteString("^/")
+	} else {
+		b.WriteString("^(?:.*/)?")
+	}
+
+	segments := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	needSep := false
+	for i, seg := range segments {
+		if seg == "**" {
+			switch {
+			case i == len(segments)-1 && i == 0:
+				b.WriteString(".*")
+			case i == len(segments)-1:
+				b.WriteString("/.*")
+			case i == 0:
+				b.WriteString("(?:.*/)?")
+				needSep = false
+			default:
+				b.WriteString("(?:/.*)?")
+				needSep = true
+			}
+			continue
+		}
+		if needSep {
+			b.WriteByte('/')
+		}
+		if err := translate(&b, seg); err != nil {
+			return nil, err
+		}
+		needSep = true
+	}
+	b.WriteString("(?:/.*)?$")
+
+	return regexp.Compile(b.String())
+}
+
+// CompileRegexp compiles an expression which must match the whole path.
+func CompileRegexp(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+func translate(b *strings.Builder, seg string) error {
+	for i := 0; i < len(seg); i++ {
+		switch c := seg[i]; c {
+		case '*':
+			for i+1 < len(seg) && seg[i+1] == '*' {
+				i++
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '\\':
+			if i+1 == len(seg) {
+				return errors.New("trailing backslash in glob pattern")
+			}
+			i++
+			b.WriteString(regexp.QuoteMeta(seg[i : i+1]))
+		case '[':
+			end := classEnd(seg, i)
+			if end < 0 {
+				return errors.New("unterminated character class in glob pattern")
+			}
+			class := seg[i+1 : end]
+			b.WriteByte('[')
+			if class[0] == '!' || class[0] == '^' {
+				b.WriteByte('^')
+				class = class[1:]
+			}
+			for j := 0; j < len(class); j++ {
+				switch class[j] {
+				case '\\':
+					j++
+					b.WriteString(regexp.QuoteMeta(class[j : j+1]))
+				case '[', ']', '^':
+					b.WriteByte('\\')
+					b.WriteByte(class[j])
+				default:
+					b.WriteByte(class[j])
+				}
+			}
+			b.WriteByte(']')
+			i = end
+		default:
+			b.WriteString(regexp.QuoteMeta(seg[i : i+1]))
+		}
+	}
+	return nil
+}
+
+// classEnd returns the index of the bracket closing the class at start, a
+// bracket right after the opening one or its negation is a member.
+func classEnd(seg string, start int) int {
+	i := start + 1
+	if i < len(seg) && (seg[i] == '!' || seg[i] == '^') {
+		i++
+	}
+	if i < len(seg) && seg[i] == ']' {
+		i++
+	}
+	for ; i < len(seg); i++ {
+		switch seg[i] {
+		case '\\':
+			i++
+		case ']':
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package glob
+
+import (
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		pattern string
+		match   []string
+		noMatch []string
+	}{
+		{"node_modules", []string{"/node_modules", "/a/node_modules", "/a/node_modules/b/c.js"}, []string{"/node_modules2", "/a/xnode_modules"}},
+		{"node_modules/", []string{"/a/node_modules/b"}, []string{"/a/b"}},
+		{"*.tmp", []string{"/a.tmp", "/x/y/b.tmp", "/c.tmp/d"}, []string{"/a.tmpx", "/atmp"}},
+		{"/cache/**/*.tmp", []string{"/cache/a.tmp", "/cache/x/y/a.tmp"}, []string{"/a.tmp", "/x/cache/a.tmp", "/cache/a.txt"}},
+		{"cache/*.tmp", []string{"/cache/a.tmp"}, []string{"/cache/x/a.tmp", "/x/cache/a.tmp"}},
+		{"**/logs", []string{"/logs", "/a/b/logs", "/a/logs/x"}, []string{"/a/logsx"}},
+		{"docs/**", []string{"/docs/a", "/docs/a/b"}, []string{"/docs", "/a/docs/b"}},
+		{"a/**/b", []string{"/a/b", "/a/x/b", "/a/x/y/b/c"}, []string{"/a/xb", "/b"}},
+		{"**", []string{"/", "/a", "/a/b"}, nil},
+		{"file?.txt", []string{"/file1.txt"}, []string{"/file10.txt", "/file/.txt"}},
+		{"[abc].md", []string{"/a.md", "/x/c.md"}, []string{"/d.md"}},
+		{"[!abc].md", []string{"/d.md"}, []string{"/a.md"}},
+		{`\*.md`, []string{"/*.md"}, []string{"/a.md"}},
+		{"a+b(1).txt", []string{"/a+b(1).txt"}, []string{"/aab1.txt"}},
+	}
+	for _, tt := range tests {
+		re, err := Compile(tt.pattern)
+		if err != nil {
+			t.Errorf("%s: %v", tt.pattern, err)
+			continue
+		}
+		for _, path := range tt.match {
+			if !re.MatchString(path) {
+				t.Errorf("%s should match %s (%s)", tt.pattern, path, re)
+			}
+		}
+		for _, path := range tt.noMatch {
+			if re.MatchString(path) {
+				t.Errorf("%s should not match %s (%s)", tt.pattern, path, re)
+			}
+		}
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	for _, pattern := range []string{"", "/", "[abc", `abc\`, "[z-a]"} {
+		if _, err := Compile(pattern); err == nil {
+			t.Errorf("%q: expect error", pattern)
+		}
+	}
+}
+
+func TestCompileRegexp(t *testing.T) {
+	re, err := CompileRegexp(`/[a-z]+\.log`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !re.MatchString("/app.log") || re.MatchString("/x/app.log") || re.MatchString("/app.log.1") {
+		t.Errorf("the regexp should be anchored: %s", re)
+	}
+	if _, err := CompileRegexp("(a"); err == nil {
+		t.Error("expect error")
+	}
+}
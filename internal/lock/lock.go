@@ -0,0 +1,442 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+// Package lock implements a webdav.LockSystem whose locks are stored in a
+// file, so that they survive restarts.
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/webdav"
+)
+
+type Lock struct {
+	Token   string `json:"token"`
+	Library string `json:"library"`
+	// owner of the files when the library is per user, empty otherwise
+	User      string `json:"user,omitempty"`
+	Root      string `json:"root"`
+	ZeroDepth bool   `json:"zero_depth,omitempty"`
+	OwnerXML  string `json:"owner_xml,omitempty"`
+	// negative when the lock never expires
+	Duration  time.Duration `json:"duration"`
+	CreatedAt time.Time     `json:"created_at"`
+	ExpiresAt time.Time     `json:"expires_at,omitzero"`
+
+	// transient locks are only kept in memory
+	transient bool
+}
+
+func (l *Lock) Expired(now time.Time) bool {
+	return !l.ExpiresAt.IsZero() && !now.Before(l.ExpiresAt)
+}
+
+func (l *Lock) details() webdav.LockDetails {
+	return webdav.LockDetails{
+		Root:      l.Root,
+		Duration:  l.Duration,
+		OwnerXML:  l.OwnerXML,
+		ZeroDepth: l.ZeroDepth,
+	}
+}
+
+// covers reports whether the lock applies to the resource.
+func (l *Lock) covers(name string) bool {
+	return name == l.Root || (!l.ZeroDepth && isDescendant(name, l.Root))
+}
+
+// Store keeps the locks of all libraries in a json file. The file is reloaded
+// when it is modified by the lock command.
+type Store struct {
+	path string
+
+	mu      sync.Mutex
+	locks   map[string]*Lock
+	held    map[string]bool
+	modTime time.Time
+	size    int64
+}
+
+// OpenStore loads the store, a missing file is an empty store.
+func OpenStore(path string) (*Store, error) {
+	s := &Store{
+		path:  path,
+		locks: map[string]*Lock{},
+		held:  map[string]bool{},
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Store) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read lock store error: %w", err)
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("stat lock store error: %w", err)
+	}
+
+	var locks []*Lock
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &locks); err != nil {
+			return fmt.Errorf("parse lock store error: %w", err)
+		}
+	}
+	for token, l := range s.locks {
+		if !l.transient {
+			delete(s.locks, token)
+		}
+	}
+	for _, l := range locks {
+		s.locks[l.Token] = l
+	}
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+
+	return nil
+}
+
+// reload loads the store again when it is modified by another process.
+func (s *Store) reload() {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		slog.Warn("stat lock store error", slog.String("path", s.path), slog.Any("err", err))
+		return
+	}
+	if info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return
+	}
+	if err := s.load(); err != nil {
+		slog.Error("failed to reload lock store", slog.String("path", s.path), slog.Any("err", err))
+	}
+}
+
+func (s *Store) save() error {
+	locks := s.sorted()
+	data, err := json.MarshalIndent(locks, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("write lock store error: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write lock store error: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write lock store error: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write lock store error: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("write lock store error: %w", err)
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+		s.size = info.Size()
+	}
+
+	return nil
+}
+
+// sorted returns the locks which are saved.
+func (s *Store) sorted() []*Lock {
+	locks := make([]*Lock, 0, len(s.locks))
+	for _, l := range s.locks {
+		if !l.transient {
+			locks = append(locks, l)
+		}
+	}
+	slices.SortFunc(locks, func(a, b *Lock) int {
+		return strings.Compare(a.Library+"\x00"+a.User+"\x00"+a.Root, b.Library+"\x00"+b.User+"\x00"+b.Root)
+	})
+	return locks
+}
+
+// collectExpired removes the expired locks which are not held, and reports
+// whether any lock was removed.
+func (s *Store) collectExpired(now time.Time) bool {
+	removed := false
+	for token, l := range s.locks {
+		if l.Expired(now) && !s.held[token] {
+			delete(s.locks, token)
+			removed = removed || !l.transient
+		}
+	}
+	return removed
+}
+
+// prepare brings the locks up to date before an operation.
+func (s *Store) prepare(now time.Time) {
+	s.reload()
+	if s.collectExpired(now) {
+		if err := s.save(); err != nil {
+			slog.Error("failed to save lock store", slog.String("path", s.path), slog.Any("err", err))
+		}
+	}
+}
+
+// List returns the unexpired locks.
+func (s *Store) List() []*Lock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reload()
+	now := time.Now()
+	return slices.DeleteFunc(s.sorted(), func(l *Lock) bool { return l.Expired(now) })
+}
+
+// Unlock removes the lock regardless of its owner, it is used to recover
+// from the locks abandoned by clients.
+func (s *Store) Unlock(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reload()
+	l, ok := s.locks[token]
+	if !ok || l.transient {
+		return webdav.ErrNoSuchLock
+	}
+	delete(s.locks, token)
+	if err := s.save(); err != nil {
+		s.locks[token] = l
+		return err
+	}
+
+	return nil
+}
+
+// System returns the lock system of the library, user is the owner of the
+// files when each user of the library has its own files. The locks created by
+// a durable system are saved, the others are only kept in memory, e.g. the
+// temporary locks the webdav handler takes for the requests without an If
+// header.
+func (s *Store) System(library, user string, durable bool) webdav.LockSystem {
+	return &system{store: s, library: library, user: user, durable: durable}
+}
+
+type system struct {
+	store   *Store
+	library string
+	user    string
+	durable bool
+}
+
+func (ls *system) owns(l *Lock) bool {
+	return l.Library == ls.library && l.User == ls.user
+}
+
+// lookup returns the lock of the conditions which covers the resource and is
+// not held.
+func (ls *system) lookup(name string, conditions ...webdav.Condition) *Lock {
+	for _, c := range conditions {
+		l := ls.store.locks[c.Token]
+		if l == nil || !ls.owns(l) || ls.store.held[l.Token] {
+			continue
+		}
+		if l.covers(name) {
+			return l
+		}
+	}
+	return nil
+}
+
+func (ls *system) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	s := ls.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prepare(now)
+
+	var tokens []string
+	for _, name := range []string{name0, name1} {
+		if name == "" {
+			continue
+		}
+		name = slashClean(name)
+		if l := ls.lookup(name, conditions...); l != nil {
+			if !slices.Contains(tokens, l.Token) {
+				tokens = append(tokens, l.Token)
+			}
+			continue
+		}
+		// a resource without locks needs no condition
+		if !ls.canCreate(name, true) {
+			return nil, webdav.ErrConfirmationFailed
+		}
+	}
+
+	for _, token := range tokens {
+		s.held[token] = true
+	}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, token := range tokens {
+			delete(s.held, token)
+		}
+	}, nil
+}
+
+// canCreate reports whether a lock at name conflicts with no existing lock.
+func (ls *system) canCreate(name string, zeroDepth bool) bool {
+	for _, l := range ls.store.locks {
+		if !ls.owns(l) {
+			continue
+		}
+		if l.covers(name) || (!zeroDepth && isDescendant(l.Root, name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ls *system) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	s := ls.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prepare(now)
+
+	details.Root = slashClean(details.Root)
+	if !ls.canCreate(details.Root, details.ZeroDepth) {
+		return "", webdav.ErrLocked
+	}
+	l := &Lock{
+		Token:     "urn:uuid:" + uuid.NewString(),
+		Library:   ls.library,
+		User:      ls.user,
+		Root:      details.Root,
+		ZeroDepth: details.ZeroDepth,
+		OwnerXML:  details.OwnerXML,
+		Duration:  details.Duration,
+		CreatedAt: now.UTC(),
+		transient: !ls.durable,
+	}
+	if details.Duration >= 0 {
+		l.ExpiresAt = now.Add(details.Duration).UTC()
+	}
+	s.locks[l.Token] = l
+	if l.transient {
+		return l.Token, nil
+	}
+	if err := s.save(); err != nil {
+		delete(s.locks, l.Token)
+		return "", err
+	}
+
+	return l.Token, nil
+}
+
+func (ls *system) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	s := ls.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prepare(now)
+
+	l := s.locks[token]
+	if l == nil || !ls.owns(l) {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	if s.held[token] {
+		return webdav.LockDetails{}, webdav.ErrLocked
+	}
+	old := *l
+	l.Duration = duration
+	l.ExpiresAt = time.Time{}
+	if duration >= 0 {
+		l.ExpiresAt = now.Add(duration).UTC()
+	}
+	if l.transient {
+		return l.details(), nil
+	}
+	if err := s.save(); err != nil {
+		*l = old
+		return webdav.LockDetails{}, err
+	}
+
+	return l.details(), nil
+}
+
+func (ls *system) Unlock(now time.Time, token string) error {
+	s := ls.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prepare(now)
+
+	l := s.locks[token]
+	if l == nil || !ls.owns(l) {
+		return webdav.ErrNoSuchLock
+	}
+	if s.held[token] {
+		return webdav.ErrLocked
+	}
+	delete(s.locks, token)
+	if l.transient {
+		return nil
+	}
+	if err := s.save(); err != nil {
+		s.locks[token] = l
+		return err
+	}
+
+	return nil
+}
+
+// isDescendant reports whether name is strictly below root.
+func isDescendant(name, root string) bool {
+	return name != root && (root == "/" || strings.HasPrefix(name, root+"/"))
+}
+
+func slashClean(name string) string {
+	if name == "" || name[0] != '/' {
+		name = "/" + name
+	}
+	return path.Clean(name)
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package lock
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestSystem(t *testing.T) {
+	store, err := OpenStore(filepath.Join(t.TempDir(), "locks.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := store.System("media", "", true)
+	now := time.Now()
+
+	token, err := ls.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ls.Create(now, webdav.LockDetails{Root: "/a/b", Duration: time.Minute, ZeroDepth: true}); !errors.Is(err, webdav.ErrLocked) {
+		t.Errorf("lock below an infinite lock: %v", err)
+	}
+	if _, err := ls.Create(now, webdav.LockDetails{Root: "/", Duration: time.Minute}); !errors.Is(err, webdav.ErrLocked) {
+		t.Errorf("infinite lock above a lock: %v", err)
+	}
+	if _, err := store.System("backup", "", true).Create(now, webdav.LockDetails{Root: "/a"}); err != nil {
+		t.Errorf("lock of another library: %v", err)
+	}
+
+	if _, err := ls.Confirm(now, "/a/b", ""); !errors.Is(err, webdav.ErrConfirmationFailed) {
+		t.Errorf("confirm without the token: %v", err)
+	}
+	release, err := ls.Confirm(now, "/a/b", "/c", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ls.Confirm(now, "/a/b", "", webdav.Condition{Token: token}); !errors.Is(err, webdav.ErrConfirmationFailed) {
+		t.Errorf("confirm a held lock: %v", err)
+	}
+	if err := ls.Unlock(now, token); !errors.Is(err, webdav.ErrLocked) {
+		t.Errorf("unlock a held lock: %v", err)
+	}
+	release()
+
+	if _, err := ls.Refresh(now, token, time.Hour); err != nil {
+		t.Errorf("refresh: %v", err)
+	}
+	if err := ls.Unlock(now, token); err != nil {
+		t.Errorf("unlock: %v", err)
+	}
+	if _, err := ls.Confirm(now, "/a/b", ""); err != nil {
+		t.Errorf("confirm after unlock: %v", err)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locks.json")
+	store, err := OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	token, err := store.System("home", "alice", true).Create(now, webdav.LockDetails{Root: "/doc", Duration: -1, OwnerXML: "<owner/>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.System("home", "alice", false).Create(now, webdav.LockDetails{Root: "/tmp", Duration: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.System("home", "alice", true).Create(now, webdav.LockDetails{Root: "/old", Duration: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := reopened.System("home", "alice", true)
+	if _, err := ls.Create(now, webdav.LockDetails{Root: "/doc"}); !errors.Is(err, webdav.ErrLocked) {
+		t.Errorf("lock lost on restart: %v", err)
+	}
+	if _, err := ls.Create(now, webdav.LockDetails{Root: "/tmp"}); err != nil {
+		t.Errorf("transient lock saved: %v", err)
+	}
+	if _, err := reopened.System("home", "bob", true).Create(now, webdav.LockDetails{Root: "/doc"}); err != nil {
+		t.Errorf("lock of another user: %v", err)
+	}
+	if _, err := ls.Create(now.Add(2*time.Second), webdav.LockDetails{Root: "/old"}); err != nil {
+		t.Errorf("expired lock: %v", err)
+	}
+
+	// the lock command removes the lock from another store
+	if err := store.Unlock(token); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.Unlock(now, token); !errors.Is(err, webdav.ErrNoSuchLock) {
+		t.Errorf("forced unlock not reloaded: %v", err)
+	}
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+// Package memfs implements a webdav.FileSystem in memory, which limits the
+// bytes of its files, and removes the files which are not modified within a
+// TTL.
+package memfs
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/model"
+	"github.com/llklkl/webdav/internal/pkg"
+	"github.com/llklkl/webdav/internal/quota"
+)
+
+const maxEvictInterval = time.Minute
+
+type FileSystem struct {
+	fs    webdav.FileSystem
+	limit int64
+	ttl   time.Duration
+
+	mu   sync.Mutex
+	used int64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// New returns an empty file system, cfg is optional.
+func New(cfg *conf.MemoryConf) *FileSystem {
+	fsys := &FileSystem{
+		fs:   webdav.NewMemFS(),
+		stop: make(chan struct{}),
+	}
+	if cfg != nil {
+		fsys.limit, fsys.ttl = int64(cfg.Size), cfg.TTL
+	}
+	if fsys.ttl > 0 {
+		pkg.SafeG(fsys.evictLoop)
+	}
+	return fsys
+}
+
+// Limited reports whether the bytes of the files are limited.
+func (fsys *FileSystem) Limited() bool {
+	return fsys.limit > 0
+}
+
+// Used returns the bytes of the files.
+func (fsys *FileSystem) Used() int64 {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	return fsys.used
+}
+
+// Close stops the eviction.
+func (fsys *FileSystem) Close() error {
+	fsys.stopOnce.Do(func() { close(fsys.stop) })
+	return nil
+}
+
+func (fsys *FileSystem) reserve(n int64) bool {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if fsys.limit > 0 && fsys.used+n > fsys.limit {
+		return false
+	}
+	fsys.used += n
+	return true
+}
+
+func (fsys *FileSystem) add(delta int64) {
+	fsys.mu.Lock()
+	fsys.used += delta
+	fsys.mu.Unlock()
+}
+
+func (fsys *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return fsys.fs.Mkdir(ctx, name, perm)
+}
+
+func (fsys *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return fsys.fs.OpenFile(ctx, name, flag, perm)
+	}
+
+	var oldSize int64
+	if info, err := fsys.fs.Stat(ctx, name); err == nil && !info.IsDir() {
+		oldSize = info.Size()
+	}
+	f, err := fsys.fs.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&os.O_TRUNC != 0 && oldSize > 0 {
+		fsys.add(-oldSize)
+		oldSize = 0
+	}
+	return &file{
+		File:   f,
+		fsys:   fsys,
+		size:   oldSize,
+		exceed: func() { model.MarkQuotaExceeded(ctx) },
+	}, nil
+}
+
+func (fsys *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	size := fsys.size(ctx, name)
+	if err := fsys.fs.RemoveAll(ctx, name); err != nil {
+		return err
+	}
+	fsys.add(-size)
+	return nil
+}
+
+func (fsys *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	// the file replaced by the rename is released
+	replaced := fsys.size(ctx, newName)
+	if err := fsys.fs.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	fsys.add(-replaced)
+	return nil
+}
+
+func (fsys *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return fsys.fs.Stat(ctx, name)
+}
+
+// size returns the bytes of the files under name.
+func (fsys *FileSystem) size(ctx context.Context, name string) int64 {
+	var size int64
+	_ = fsys.walk(ctx, name, func(name string, info os.FileInfo) error {
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// walk calls fn with the file and its descendants, the children of a
+// directory are visited before the directory.
+func (fsys *FileSystem) walk(ctx context.Context, name string, fn func(name string, info os.FileInfo) error) error {
+	info, err := fsys.fs.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		f, err := fsys.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		children, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := fsys.walk(ctx, path.Join(name, child.Name()), fn); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return fn(name, info)
+}
+
+func (fsys *FileSystem) evictLoop() {
+	ticker := time.NewTicker(min(fsys.ttl, maxEvictInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fsys.stop:
+			return
+		case <-ticker.C:
+			fsys.evict(time.Now().Add(-fsys.ttl))
+		}
+	}
+}
+
+// evict removes the files modified before the deadline, and the empty
+// directories created before it.
+func (fsys *FileSystem) evict(deadline time.Time) {
+	ctx := context.Background()
+	err := fsys.walk(ctx, "/", func(name string, info os.FileInfo) error {
+		if name == "/" || !info.ModTime().Before(deadline) {
+			return nil
+		}
+		if info.IsDir() {
+			f, err := fsys.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+			if err != nil {
+				return nil
+			}
+			children, _ := f.Readdir(-1)
+			f.Close()
+			if len(children) > 0 {
+				return nil
+			}
+		}
+		return fsys.RemoveAll(ctx, name)
+	})
+	if err != nil {
+		slog.Warn("evict memory files error", slog.Any("err", err))
+	}
+}
+
+// file reserves the bytes a write adds to the file.
+type file struct {
+	webdav.File
+	fsys   *FileSystem
+	size   int64
+	exceed func()
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	pos, err := f.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	grow := max(pos+int64(len(p))-f.size, 0)
+	if grow > 0 && !f.fsys.reserve(grow) {
+		f.exceed()
+		return 0, quota.ErrExceeded
+	}
+
+	n, err := f.File.Write(p)
+	if written := max(pos+int64(n)-f.size, 0); written < grow {
+		f.fsys.add(written - grow)
+	}
+	f.size = max(f.size, pos+int64(n))
+	return n, err
+}
+
+// DeadProps and Patch keep the dead properties of the memory file.
+func (f *file) DeadProps() (map[xml.Name]webdav.Property, error) {
+	if holder, ok := f.File.(webdav.DeadPropsHolder); ok {
+		return holder.DeadProps()
+	}
+	return nil, nil
+}
+
+func (f *file) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if holder, ok := f.File.(webdav.DeadPropsHolder); ok {
+		return holder.Patch(patches)
+	}
+	return nil, webdav.ErrNotImplemented
+}
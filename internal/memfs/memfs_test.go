@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package memfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/model"
+	"github.com/llklkl/webdav/internal/quota"
+)
+
+func put(ctx context.Context, fsys *FileSystem, name, data string) error {
+	f, err := fsys.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(data))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func TestLimit(t *testing.T) {
+	fsys := New(&conf.MemoryConf{Size: 10})
+	defer fsys.Close()
+	ctx := context.Background()
+
+	if err := put(ctx, fsys, "/a", "12345678"); err != nil {
+		t.Fatal(err)
+	}
+	exceedCtx, exceeded := model.WithQuotaExceeded(ctx)
+	if err := put(exceedCtx, fsys, "/b", "123"); !errors.Is(err, quota.ErrExceeded) || !exceeded.Exceeded() {
+		t.Fatalf("write over the limit: %v", err)
+	}
+	if err := put(ctx, fsys, "/a", "1234567890"); err != nil {
+		t.Errorf("overwrite: %v", err)
+	}
+	if got := fsys.Used(); got != 10 {
+		t.Errorf("used %d", got)
+	}
+
+	if err := fsys.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Rename(ctx, "/a", "/dir/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(ctx, fsys, "/b", "12"); !errors.Is(err, quota.ErrExceeded) {
+		t.Errorf("write after rename: %v", err)
+	}
+	if err := fsys.RemoveAll(ctx, "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(ctx, fsys, "/b", "12"); err != nil {
+		t.Errorf("write after remove: %v", err)
+	}
+	if err := put(ctx, fsys, "/c", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	// the replaced file is released
+	if err := fsys.Rename(ctx, "/c", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fsys.Used(); got != 4 {
+		t.Errorf("used %d after replace", got)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	fsys := New(nil)
+	ctx := context.Background()
+	for _, name := range []string{"/old", "/dir/old", "/keep/new"} {
+		dir := name[:strings.LastIndex(name, "/")]
+		if dir != "" {
+			_ = fsys.Mkdir(ctx, dir, 0755)
+		}
+		if err := put(ctx, fsys, name, "data"); err != nil {
+			t.Fatal(err)
+		}
+		if name == "/dir/old" {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	fsys.evict(time.Now().Add(-5 * time.Millisecond))
+	for name, exist := range map[string]bool{"/old": false, "/dir/old": false, "/dir": false, "/keep": true, "/keep/new": true} {
+		if _, err := fsys.Stat(ctx, name); (err == nil) != exist {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if got := fsys.Used(); got != 4 {
+		t.Errorf("used %d", got)
+	}
+}
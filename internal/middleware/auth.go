@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package middleware
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/time/rate"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/auth"
+	"github.com/llklkl/webdav/internal/model"
+)
+
+const MaxUsernamePasswordLength = 256
+
+type ip struct {
+	hi uint64
+	lo uint64
+}
+
+func (i ip) IsZero() bool {
+	return i.hi == 0 && i.lo == 0
+}
+
+// Auth bans clients and users which fail too often, and passes the others to
+// the chain of authentication providers.
+type Auth struct {
+	chain     *auth.Chain
+	security  *conf.SecurityConf
+	anonymous *conf.AnonymousConf
+
+	bannedUsers *lru.Cache[string, *rate.Limiter]
+	bannedIp    *lru.Cache[ip, *rate.Limiter]
+}
+
+func NewAuth(cfg *conf.Conf) (*Auth, error) {
+	chain, err := auth.NewChain(cfg)
+	if err != nil {
+		return nil, err
+	}
+	a := &Auth{
+		chain:     chain,
+		security:  cfg.Security,
+		anonymous: cfg.Anonymous,
+	}
+	a.bannedUsers, _ = lru.New[string, *rate.Limiter](1024)
+	a.bannedIp, _ = lru.New[ip, *rate.Limiter](1024)
+
+	return a, nil
+}
+
+func (a *Auth) Name() string {
+	return "AUTH"
+}
+
+func (a *Auth) Serve(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user *model.User
+		var username, pwd string
+		var err error
+		var clientIp = model.GetClientIP(r.Context())
+		var cip = a.convertIp(clientIp)
+
+		if a.banClient(cip) {
+			slog.Info("client has been banned", slog.String("ip", clientIp.String()))
+			goto WrongPassword
+		}
+
+		_, pwd, _ = r.BasicAuth()
+		username = auth.Username(r)
+		if len(username) > MaxUsernamePasswordLength || len(pwd) > MaxUsernamePasswordLength {
+			goto MarkBanned
+		}
+		if username != "" && a.banUser(username) {
+			slog.Info("user has been banned", slog.String("username", username))
+			goto WrongPassword
+		}
+
+		user, err = a.chain.Authenticate(r)
+		if err == nil {
+			goto Next
+		} else if a.anonymous != nil && errors.Is(err, auth.ErrNoCredential) && r.Header.Get("Authorization") == "" {
+			a.serveAnonymous(next, w, r)
+			return
+		} else if errors.Is(err, auth.ErrUserNotFound) || errors.Is(err, auth.ErrStaleCredential) {
+			goto WrongPassword
+		} else if !errors.Is(err, auth.ErrNoCredential) && !errors.Is(err, auth.ErrInvalidCredential) {
+			slog.Warn("authenticate error", slog.String("username", username), slog.Any("err", err))
+		}
+
+	MarkBanned:
+		a.markBanned(cip, username)
+
+	WrongPassword:
+		for _, challenge := range a.chain.Challenges(r) {
+			w.Header().Add("WWW-Authenticate", challenge)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+
+	Next:
+		a.unmarkBanned(cip, user.Username)
+		next.ServeHTTP(w, r.WithContext(model.SetUser(r.Context(), user)))
+	})
+}
+
+// serveAnonymous serves the request as the anonymous user, and challenges the
+// client for credentials when it is denied a permission.
+func (a *Auth) serveAnonymous(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	user := &model.User{Username: "anonymous", Scope: a.anonymous.Scope, ReadOnly: true, Anonymous: true}
+	ctx, denial := model.WithDenial(model.SetUser(r.Context(), user))
+	next.ServeHTTP(&anonymousWriter{
+		ResponseWriter: w,
+		denial:         denial,
+		challenges:     func() []string { return a.chain.Challenges(r) },
+	}, r.WithContext(ctx))
+}
+
+type anonymousWriter struct {
+	http.ResponseWriter
+	denial      *model.Denial
+	challenges  func() []string
+	wroteHeader bool
+	challenged  bool
+}
+
+func (w *anonymousWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	// the webdav handler reports denials with various statuses, e.g. 404 or 405
+	if code >= http.StatusBadRequest && w.denial.Denied() {
+		w.challenged = true
+		code = http.StatusUnauthorized
+		h := w.Header()
+		h.Del("Content-Type")
+		for _, challenge := range w.challenges() {
+			h.Add("WWW-Authenticate", challenge)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *anonymousWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.challenged {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (a *Auth) markBanned(cip ip, username string) {
+	if a.security.BanIpWrongPwd && !cip.IsZero() {
+		if !a.bannedIp.Contains(cip) {
+			l := rate.NewLimiter(rate.Every(5*time.Minute/time.Duration(a.security.PasswordRetryPerFiveMinute)), 5)
+			a.bannedIp.ContainsOrAdd(cip, l)
+		}
+	}
+	if a.security.BanUserWrongPwd && len(username) > 0 {
+		if !a.bannedUsers.Contains(username) {
+			l := rate.NewLimiter(rate.Every(5*time.Minute/time.Duration(a.security.PasswordRetryPerFiveMinute)), 5)
+			a.bannedUsers.ContainsOrAdd(username, l)
+		}
+	}
+}
+
+func (a *Auth) unmarkBanned(cip ip, username string) {
+	if a.security.BanIpWrongPwd {
+		a.bannedIp.Remove(cip)
+	}
+	if a.security.BanUserWrongPwd {
+		a.bannedUsers.Remove(username)
+	}
+}
+
+func (a *Auth) banClient(cip ip) bool {
+	if !a.security.BanIpWrongPwd || cip.IsZero() {
+		return false
+	}
+	limiter, ok := a.bannedIp.Get(cip)
+	if !ok {
+		return false
+	}
+
+	return !limiter.Allow()
+}
+
+func (a *Auth) banUser(username string) bool {
+	if !a.security.BanUserWrongPwd {
+		return false
+	}
+	limiter, ok := a.bannedUsers.Get(username)
+	if !ok {
+		return false
+	}
+
+	return !limiter.Allow()
+}
+
+func (a *Auth) convertIp(i net.IP) ip {
+	r := ip{}
+	if i == nil {
+		return r
+	}
+	if len(i) == net.IPv4len {
+		r.lo = uint64(binary.BigEndian.Uint32(i))
+	} else if len(i) == net.IPv6len {
+		r.lo = binary.BigEndian.Uint64(i[:8])
+		r.hi = binary.BigEndian.Uint64(i[8:16])
+	}
+
+	return r
+}
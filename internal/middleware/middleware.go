@@ -34,9 +34,14 @@ type MiddleWare interface {
 	Serve(next http.Handler) http.Handler
 }
 
-func NewMiddleWares(cfg *conf.Conf) []MiddleWare {
+func NewMiddleWares(cfg *conf.Conf) ([]MiddleWare, error) {
+	authentication, err := NewAuth(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return []MiddleWare{
 		ClientIP{},
-		NewBasic(cfg),
-	}
+		authentication,
+	}, nil
 }
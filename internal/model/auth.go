@@ -24,5 +24,21 @@
 package model
 
 type User struct {
-	Username string
+	Username   string
+	Groups     []string
+	Attributes map[string]string
+	// Scope are the scope names granted by the authentication provider, in
+	// addition to those configured for the username.
+	Scope []string
+	// ScopeLimit restricts the effective scopes to these names when not nil.
+	ScopeLimit []string
+	// ReadOnly denies everything but reading, whatever the scopes allow.
+	ReadOnly bool
+	// Local is a user configured in [[user]], who has the scopes configured
+	// for the username. Users of the other providers only share the scopes
+	// of the groups listing the username.
+	Local bool
+	// Anonymous is the principal of requests without credentials, it only has
+	// the scopes granted in [anonymous].
+	Anonymous bool
 }
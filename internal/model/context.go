@@ -26,10 +26,36 @@ package model
 import (
 	"context"
 	"net"
+	"sync/atomic"
 )
 
 type UserCtxKey struct{}
 type ClientIPKey struct{}
+type DenialKey struct{}
+type QuotaExceededKey struct{}
+type OverwriteKey struct{}
+type AbortKey struct{}
+
+// Denial records whether the file system denied a permission while serving
+// the request.
+type Denial struct {
+	denied atomic.Bool
+}
+
+func (d *Denial) Denied() bool {
+	return d.denied.Load()
+}
+
+func WithDenial(ctx context.Context) (context.Context, *Denial) {
+	d := &Denial{}
+	return context.WithValue(ctx, DenialKey{}, d), d
+}
+
+func MarkDenied(ctx context.Context) {
+	if d, ok := ctx.Value(DenialKey{}).(*Denial); ok {
+		d.denied.Store(true)
+	}
+}
 
 func SetUser(ctx context.Context, user *User) context.Context {
 	return context.WithValue(ctx, UserCtxKey{}, user)
@@ -44,6 +70,53 @@ func GetUser(ctx context.Context) *User {
 	return nil
 }
 
+// QuotaExceeded records whether a write exceeded a quota while serving the
+// request.
+type QuotaExceeded struct {
+	exceeded atomic.Bool
+}
+
+func (q *QuotaExceeded) Exceeded() bool {
+	return q.exceeded.Load()
+}
+
+func WithQuotaExceeded(ctx context.Context) (context.Context, *QuotaExceeded) {
+	q := &QuotaExceeded{}
+	return context.WithValue(ctx, QuotaExceededKey{}, q), q
+}
+
+func MarkQuotaExceeded(ctx context.Context) {
+	if q, ok := ctx.Value(QuotaExceededKey{}).(*QuotaExceeded); ok {
+		q.exceeded.Store(true)
+	}
+}
+
+// SetOverwrite marks the request replaces its destination, e.g. a COPY or MOVE
+// which removes the existing destination first.
+func SetOverwrite(ctx context.Context) context.Context {
+	return context.WithValue(ctx, OverwriteKey{}, true)
+}
+
+func IsOverwrite(ctx context.Context) bool {
+	v, _ := ctx.Value(OverwriteKey{}).(bool)
+	return v
+}
+
+// WithAbort returns a context which is cancelled when the upload of the
+// request fails, e.g. the body can not be read, so that a storage which
+// commits the file on close discards it instead.
+func WithAbort(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancelCause(ctx)
+	return context.WithValue(ctx, AbortKey{}, cancel)
+}
+
+// Abort cancels the context returned by WithAbort with the cause.
+func Abort(ctx context.Context, cause error) {
+	if cancel, ok := ctx.Value(AbortKey{}).(context.CancelCauseFunc); ok {
+		cancel(cause)
+	}
+}
+
 func SetClientIP(ctx context.Context, ip net.IP) context.Context {
 	return context.WithValue(ctx, ClientIPKey{}, ip)
 }
@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package password
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+const (
+	apr1Magic = "$apr1$"
+	itoa64    = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// $apr1$<salt>$<hash>
+func parseApr1(hash string) (salt, sum string, err error) {
+	rest := strings.TrimPrefix(hash, apr1Magic)
+	salt, sum, ok := strings.Cut(rest, "$")
+	if !ok || salt == "" || len(salt) > 8 || len(sum) != 22 {
+		return "", "", errors.New("apr1: malformed hash")
+	}
+
+	return salt, sum, nil
+}
+
+// apr1 is the Apache variant of the md5-crypt algorithm.
+func apr1(password, salt string) string {
+	pwd := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pwd)
+	alt.Write([]byte(salt))
+	alt.Write(pwd)
+	altSum := alt.Sum(nil)
+
+	d := md5.New()
+	d.Write(pwd)
+	d.Write([]byte(apr1Magic))
+	d.Write([]byte(salt))
+	for i := len(pwd); i > 0; i -= 16 {
+		d.Write(altSum[:min(i, 16)])
+	}
+	for i := len(pwd); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pwd[:1])
+		}
+	}
+	sum := d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		d = md5.New()
+		if i&1 != 0 {
+			d.Write(pwd)
+		} else {
+			d.Write(sum)
+		}
+		if i%3 != 0 {
+			d.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			d.Write(pwd)
+		}
+		if i&1 != 0 {
+			d.Write(sum)
+		} else {
+			d.Write(pwd)
+		}
+		sum = d.Sum(nil)
+	}
+
+	b := strings.Builder{}
+	b.Grow(len(apr1Magic) + len(salt) + 23)
+	b.WriteString(apr1Magic)
+	b.WriteString(salt)
+	b.WriteByte('$')
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(sum[g[0]])<<16|uint32(sum[g[1]])<<8|uint32(sum[g[2]]), 4)
+	}
+	to64(uint32(sum[11]), 2)
+
+	return b.String()
+}
+
+// {SHA}<base64 of sha1 digest>
+func parseSha1(hash string) ([]byte, error) {
+	digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hash, "{SHA}"))
+	if err != nil {
+		return nil, err
+	}
+	if len(digest) != sha1.Size {
+		return nil, errors.New("sha1: malformed hash")
+	}
+
+	return digest, nil
+}
@@ -0,0 +1,297 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package password
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+type Algorithm string
+
+const (
+	Plaintext Algorithm = "plaintext"
+	Bcrypt    Algorithm = "bcrypt"
+	Argon2id  Algorithm = "argon2id"
+	Scrypt    Algorithm = "scrypt"
+
+	// Apr1 and Sha1 only exist for compatibility with htpasswd files, they
+	// can be verified but are never produced by Hash.
+	Apr1 Algorithm = "apr1"
+	Sha1 Algorithm = "sha1"
+)
+
+const (
+	saltLength = 16
+	keyLength  = 32
+
+	argon2Memory      = 64 * 1024
+	argon2Iterations  = 3
+	argon2Parallelism = 4
+
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+)
+
+var (
+	ErrUnsupportedAlgorithm = errors.New("unsupported password hash algorithm")
+	ErrMalformedHash        = errors.New("malformed password hash")
+)
+
+var b64 = base64.RawStdEncoding
+
+// Identify detects the algorithm of a PHC style hash string. Anything that is
+// not recognized is treated as plaintext.
+func Identify(hash string) Algorithm {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"),
+		strings.HasPrefix(hash, "$2b$"),
+		strings.HasPrefix(hash, "$2x$"),
+		strings.HasPrefix(hash, "$2y$"):
+		return Bcrypt
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return Argon2id
+	case strings.HasPrefix(hash, "$scrypt$"):
+		return Scrypt
+	case strings.HasPrefix(hash, "$apr1$"):
+		return Apr1
+	case strings.HasPrefix(hash, "{SHA}"):
+		return Sha1
+	}
+
+	return Plaintext
+}
+
+// HtpasswdOnly reports whether the algorithm is only accepted in htpasswd
+// files, it is too weak for the credentials in the configuration.
+func (a Algorithm) HtpasswdOnly() bool {
+	return a == Apr1 || a == Sha1
+}
+
+// Check reports whether a hash string is well-formed for its detected algorithm.
+func Check(hash string) error {
+	var err error
+	switch Identify(hash) {
+	case Bcrypt:
+		_, err = bcrypt.Cost([]byte(hash))
+	case Argon2id:
+		_, err = parseArgon2id(hash)
+	case Scrypt:
+		_, err = parseScrypt(hash)
+	case Apr1:
+		_, _, err = parseApr1(hash)
+	case Sha1:
+		_, err = parseSha1(hash)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedHash, err)
+	}
+
+	return nil
+}
+
+func Hash(algo Algorithm, password string) (string, error) {
+	switch algo {
+	case Bcrypt:
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(h), nil
+	case Argon2id:
+		p := &argon2idParams{
+			memory:      argon2Memory,
+			iterations:  argon2Iterations,
+			parallelism: argon2Parallelism,
+			salt:        make([]byte, saltLength),
+		}
+		if _, err := rand.Read(p.salt); err != nil {
+			return "", err
+		}
+		p.key = argon2.IDKey([]byte(password), p.salt, p.iterations, p.memory, p.parallelism, keyLength)
+		return p.String(), nil
+	case Scrypt:
+		p := &scryptParams{
+			logN: scryptLogN,
+			r:    scryptR,
+			p:    scryptP,
+			salt: make([]byte, saltLength),
+		}
+		if _, err := rand.Read(p.salt); err != nil {
+			return "", err
+		}
+		key, err := scrypt.Key([]byte(password), p.salt, 1<<p.logN, p.r, p.p, keyLength)
+		if err != nil {
+			return "", err
+		}
+		p.key = key
+		return p.String(), nil
+	}
+
+	return "", ErrUnsupportedAlgorithm
+}
+
+// Verify compares the password with the hash. Plaintext hashes are compared in
+// constant time, it is up to the caller to decide whether they are acceptable.
+func Verify(hash, password string) (bool, error) {
+	switch Identify(hash) {
+	case Bcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case Argon2id:
+		p, err := parseArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+		key := argon2.IDKey([]byte(password), p.salt, p.iterations, p.memory, p.parallelism, uint32(len(p.key)))
+		return subtle.ConstantTimeCompare(key, p.key) == 1, nil
+	case Scrypt:
+		p, err := parseScrypt(hash)
+		if err != nil {
+			return false, err
+		}
+		key, err := scrypt.Key([]byte(password), p.salt, 1<<p.logN, p.r, p.p, len(p.key))
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare(key, p.key) == 1, nil
+	case Apr1:
+		salt, _, err := parseApr1(hash)
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(hash)) == 1, nil
+	case Sha1:
+		digest, err := parseSha1(hash)
+		if err != nil {
+			return false, err
+		}
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare(sum[:], digest) == 1, nil
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1, nil
+}
+
+type argon2idParams struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func (p *argon2idParams) String() string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.memory, p.iterations, p.parallelism,
+		b64.EncodeToString(p.salt), b64.EncodeToString(p.key))
+}
+
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func parseArgon2id(hash string) (*argon2idParams, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, errors.New("argon2id: wrong number of fields")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, fmt.Errorf("argon2id: %w", err)
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("argon2id: unsupported version %d", version)
+	}
+	p := &argon2idParams{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism); err != nil {
+		return nil, fmt.Errorf("argon2id: %w", err)
+	}
+	if p.memory == 0 || p.iterations == 0 || p.parallelism == 0 {
+		return nil, errors.New("argon2id: invalid parameters")
+	}
+	var err error
+	if p.salt, err = b64.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("argon2id: %w", err)
+	}
+	if p.key, err = b64.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("argon2id: %w", err)
+	}
+	if len(p.key) == 0 {
+		return nil, errors.New("argon2id: empty key")
+	}
+
+	return p, nil
+}
+
+type scryptParams struct {
+	logN int
+	r    int
+	p    int
+	salt []byte
+	key  []byte
+}
+
+func (p *scryptParams) String() string {
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		p.logN, p.r, p.p,
+		b64.EncodeToString(p.salt), b64.EncodeToString(p.key))
+}
+
+// $scrypt$ln=15,r=8,p=1$<salt>$<key>
+func parseScrypt(hash string) (*scryptParams, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 {
+		return nil, errors.New("scrypt: wrong number of fields")
+	}
+	p := &scryptParams{}
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &p.logN, &p.r, &p.p); err != nil {
+		return nil, fmt.Errorf("scrypt: %w", err)
+	}
+	if p.logN <= 0 || p.logN >= 32 || p.r <= 0 || p.p <= 0 {
+		return nil, errors.New("scrypt: invalid parameters")
+	}
+	var err error
+	if p.salt, err = b64.DecodeString(parts[3]); err != nil {
+		return nil, fmt.Errorf("scrypt: %w", err)
+	}
+	if p.key, err = b64.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("scrypt: %w", err)
+	}
+	if len(p.key) == 0 {
+		return nil, errors.New("scrypt: empty key")
+	}
+
+	return p, nil
+}
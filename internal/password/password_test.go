@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package password
+
+import (
+	"testing"
+)
+
+func TestHashAndVerify(t *testing.T) {
+	for _, algo := range []Algorithm{Bcrypt, Argon2id, Scrypt} {
+		hash, err := Hash(algo, "secret")
+		if err != nil {
+			t.Fatalf("hash with %s: %v", algo, err)
+		}
+		if got := Identify(hash); got != algo {
+			t.Errorf("identify %s: got %s", hash, got)
+		}
+		if err := Check(hash); err != nil {
+			t.Errorf("check %s: %v", hash, err)
+		}
+		if ok, err := Verify(hash, "secret"); !ok || err != nil {
+			t.Errorf("verify %s with right password: %v, %v", algo, ok, err)
+		}
+		if ok, err := Verify(hash, "wrong"); ok || err != nil {
+			t.Errorf("verify %s with wrong password: %v, %v", algo, ok, err)
+		}
+	}
+}
+
+func TestVerifyPlaintext(t *testing.T) {
+	if Identify("secret") != Plaintext {
+		t.Fatal("expect plaintext")
+	}
+	if ok, _ := Verify("secret", "secret"); !ok {
+		t.Error("expect plaintext match")
+	}
+	if ok, _ := Verify("secret", "Secret"); ok {
+		t.Error("expect plaintext mismatch")
+	}
+}
+
+func TestCheckMalformed(t *testing.T) {
+	for _, hash := range []string{
+		"$2y$10$short",
+		"$argon2id$v=19$m=0,t=3,p=4$c2FsdA$a2V5",
+		"$argon2id$v=16$m=65536,t=3,p=4$c2FsdA$a2V5",
+		"$scrypt$ln=15,r=8$c2FsdA$a2V5",
+		"$scrypt$ln=15,r=8,p=1$!!!$a2V5",
+	} {
+		if err := Check(hash); err == nil {
+			t.Errorf("expect error for %s", hash)
+		}
+	}
+}
+
+func TestVerifyHtpasswd(t *testing.T) {
+	for _, hash := range []string{
+		"$apr1$r31NUi8F$x1Ypu2orVkQY6A.udao1T/",
+		"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+	} {
+		if err := Check(hash); err != nil {
+			t.Errorf("check %s: %v", hash, err)
+		}
+		if ok, err := Verify(hash, "password"); !ok || err != nil {
+			t.Errorf("verify %s with right password: %v, %v", hash, ok, err)
+		}
+		if ok, err := Verify(hash, "wrong"); ok || err != nil {
+			t.Errorf("verify %s with wrong password: %v, %v", hash, ok, err)
+		}
+	}
+}
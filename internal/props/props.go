@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+// Package props stores the dead properties of files, which are set by
+// PROPPATCH.
+package props
+
+import (
+	"encoding/xml"
+	"log/slog"
+	"sync"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/llklkl/webdav/conf"
+)
+
+// Backend stores the dead properties, path is the path of a file in the file
+// system.
+type Backend interface {
+	Props(path string) (map[xml.Name]webdav.Property, error)
+	Patch(path string, patches []webdav.Proppatch) error
+	// Move and Remove keep the properties together with the files, path may
+	// be a directory.
+	Move(oldPath, newPath string) error
+	Remove(path string) error
+}
+
+// property is how a property is stored.
+type property struct {
+	Space    string `json:"space"`
+	Local    string `json:"local"`
+	Lang     string `json:"lang,omitempty"`
+	InnerXML string `json:"xml"`
+}
+
+func fromProperty(p webdav.Property) property {
+	return property{Space: p.XMLName.Space, Local: p.XMLName.Local, Lang: p.Lang, InnerXML: string(p.InnerXML)}
+}
+
+func (p property) toProperty() webdav.Property {
+	return webdav.Property{
+		XMLName:  xml.Name{Space: p.Space, Local: p.Local},
+		Lang:     p.Lang,
+		InnerXML: []byte(p.InnerXML),
+	}
+}
+
+// Props selects the backend of each root directory of the libraries.
+type Props struct {
+	backend string
+	xattr   Backend
+	sidecar *Sidecar
+
+	roots sync.Map
+}
+
+// New returns nil when the dead properties are disabled, which they are
+// without [props].
+func New(cfg *conf.Conf) (*Props, error) {
+	if cfg.Props == nil || cfg.Props.Backend == "none" {
+		return nil, nil
+	}
+	p := &Props{backend: "auto", xattr: Xattr{}}
+	if cfg.Props.Backend != "" {
+		p.backend = cfg.Props.Backend
+	}
+	if cfg.Props.SidecarPath != "" {
+		sidecar, err := OpenSidecar(cfg.Props.SidecarPath)
+		if err != nil {
+			return nil, err
+		}
+		p.sidecar = sidecar
+	}
+
+	return p, nil
+}
+
+// Backend returns the backend of the root, nil when the properties of the
+// root can not be stored.
+func (p *Props) Backend(root string) Backend {
+	if v, ok := p.roots.Load(root); ok {
+		b, _ := v.(Backend)
+		return b
+	}
+
+	var b Backend
+	switch p.backend {
+	case "xattr":
+		b = p.xattr
+	case "sidecar":
+		b = p.sidecar
+	default:
+		if xattrSupported(root) {
+			b = p.xattr
+		} else if p.sidecar != nil {
+			b = p.sidecar
+		} else {
+			slog.Warn("extended attributes are not supported, dead properties are disabled", slog.String("root", root))
+		}
+	}
+	if b == nil {
+		// a nil *Sidecar must not be stored as a non-nil Backend
+		p.roots.Store(root, nil)
+		return nil
+	}
+	p.roots.Store(root, b)
+	return b
+}
+
+// apply applies the patches to the properties.
+func apply(props map[xml.Name]webdav.Property, patches []webdav.Proppatch) {
+	for _, patch := range patches {
+		for _, prop := range patch.Props {
+			if patch.Remove {
+				delete(props, prop.XMLName)
+			} else {
+				props[prop.XMLName] = prop
+			}
+		}
+	}
+}
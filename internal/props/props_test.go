@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package props
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/llklkl/webdav/conf"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	tagName  = xml.Name{Space: "http://apple.com/ns", Local: "tags"}
+	noteName = xml.Name{Space: "urn:x", Local: "note"}
+)
+
+func testBackend(t *testing.T, b Backend, dir string) {
+	t.Helper()
+	file := filepath.Join(dir, "a", "x")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := b.Patch(file, []webdav.Proppatch{{Props: []webdav.Property{
+		{XMLName: tagName, Lang: "en", InnerXML: []byte("<t>red</t>")},
+		{XMLName: noteName, InnerXML: []byte("hello")},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Patch(file, []webdav.Proppatch{{Remove: true, Props: []webdav.Property{{XMLName: noteName}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	props, err := b.Props(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(props) != 1 || string(props[tagName].InnerXML) != "<t>red</t>" || props[tagName].Lang != "en" {
+		t.Errorf("props: %v", props)
+	}
+
+	moved := filepath.Join(dir, "b")
+	if err := os.Rename(filepath.Dir(file), moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Move(filepath.Dir(file), moved); err != nil {
+		t.Fatal(err)
+	}
+	if props, _ := b.Props(filepath.Join(moved, "x")); len(props) != 1 {
+		t.Errorf("props after move: %v", props)
+	}
+	if err := b.Remove(moved); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSidecar(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "props.json")
+	s, err := OpenSidecar(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, s, dir)
+	if len(s.files) != 0 {
+		t.Errorf("props left after remove: %v", s.files)
+	}
+
+	file := filepath.Join(dir, "y")
+	if err := s.Patch(file, []webdav.Proppatch{{Props: []webdav.Property{{XMLName: noteName, InnerXML: []byte("1")}}}}); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenSidecar(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if props, _ := reopened.Props(file); string(props[noteName].InnerXML) != "1" {
+		t.Errorf("props not saved: %v", props)
+	}
+}
+
+func TestXattr(t *testing.T) {
+	dir := t.TempDir()
+	if !xattrSupported(dir) {
+		t.Skip("extended attributes are not supported")
+	}
+	testBackend(t, Xattr{}, dir)
+}
+
+func TestNew(t *testing.T) {
+	for _, c := range []struct {
+		props   *conf.PropsConf
+		enabled bool
+	}{
+		{nil, false},
+		{&conf.PropsConf{Backend: "none"}, false},
+		{&conf.PropsConf{}, true},
+		{&conf.PropsConf{Backend: "xattr"}, true},
+	} {
+		p, err := New(&conf.Conf{Props: c.props})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (p != nil) != c.enabled {
+			t.Errorf("%+v: enabled %v", c.props, p != nil)
+		}
+	}
+}
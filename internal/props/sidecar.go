@@ -0,0 +1,210 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package props
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/webdav"
+)
+
+// Sidecar stores the properties of all files in a json file, it is used
+// when the file system does not support extended attributes.
+type Sidecar struct {
+	path string
+
+	mu    sync.Mutex
+	files map[string][]property
+}
+
+// OpenSidecar loads the database, a missing file is an empty database.
+func OpenSidecar(path string) (*Sidecar, error) {
+	s := &Sidecar{
+		path:  path,
+		files: map[string][]property{},
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read props sidecar error: %w", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.files); err != nil {
+			return nil, fmt.Errorf("parse props sidecar error: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *Sidecar) save() error {
+	data, err := json.MarshalIndent(s.files, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("write props sidecar error: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write props sidecar error: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write props sidecar error: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write props sidecar error: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("write props sidecar error: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Sidecar) Props(path string) (map[xml.Name]webdav.Property, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := s.files[filepath.Clean(path)]
+	if len(stored) == 0 {
+		return nil, nil
+	}
+	props := make(map[xml.Name]webdav.Property, len(stored))
+	for _, p := range stored {
+		prop := p.toProperty()
+		props[prop.XMLName] = prop
+	}
+	return props, nil
+}
+
+func (s *Sidecar) Patch(path string, patches []webdav.Proppatch) error {
+	path = filepath.Clean(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.files[path]
+	props := make(map[xml.Name]webdav.Property, len(old))
+	for _, p := range old {
+		prop := p.toProperty()
+		props[prop.XMLName] = prop
+	}
+	apply(props, patches)
+
+	stored := make([]property, 0, len(props))
+	for _, prop := range props {
+		stored = append(stored, fromProperty(prop))
+	}
+	s.set(path, stored)
+	if err := s.save(); err != nil {
+		s.set(path, old)
+		return err
+	}
+	return nil
+}
+
+func (s *Sidecar) set(path string, stored []property) {
+	if len(stored) == 0 {
+		delete(s.files, path)
+		return
+	}
+	s.files[path] = stored
+}
+
+func (s *Sidecar) Move(oldPath, newPath string) error {
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	moved := map[string][]property{}
+	for path, stored := range s.files {
+		if _, ok := below(path, oldPath); ok {
+			moved[path] = stored
+		}
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+	for path, stored := range moved {
+		rel, _ := below(path, oldPath)
+		delete(s.files, path)
+		s.files[filepath.Join(newPath, rel)] = stored
+	}
+	if err := s.save(); err != nil {
+		for path, stored := range moved {
+			rel, _ := below(path, oldPath)
+			delete(s.files, filepath.Join(newPath, rel))
+			s.files[path] = stored
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *Sidecar) Remove(path string) error {
+	path = filepath.Clean(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := map[string][]property{}
+	for p, stored := range s.files {
+		if _, ok := below(p, path); ok {
+			removed[p] = stored
+			delete(s.files, p)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	if err := s.save(); err != nil {
+		for p, stored := range removed {
+			s.files[p] = stored
+		}
+		return err
+	}
+	return nil
+}
+
+// below returns the path relative to root when path is root or below it.
+func below(path, root string) (string, bool) {
+	if path == root {
+		return ".", true
+	}
+	if rel, ok := strings.CutPrefix(path, root+string(filepath.Separator)); ok {
+		return rel, true
+	}
+	return "", false
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package props
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"strings"
+
+	"golang.org/x/net/webdav"
+	"golang.org/x/sys/unix"
+)
+
+// xattrPrefix is followed by the encoded name of the property.
+const xattrPrefix = "user.webdav.prop."
+
+// Xattr stores the properties in the extended attributes of the files, which
+// are moved and removed together with the files.
+type Xattr struct{}
+
+func xattrName(name xml.Name) string {
+	return xattrPrefix + base64.RawURLEncoding.EncodeToString([]byte(name.Space+" "+name.Local))
+}
+
+func (Xattr) Props(path string) (map[xml.Name]webdav.Property, error) {
+	size, err := unix.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, ignoreUnsupported(err)
+	}
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(path, buf)
+	if err != nil {
+		return nil, ignoreUnsupported(err)
+	}
+
+	props := map[xml.Name]webdav.Property{}
+	for _, attr := range strings.Split(string(buf[:size]), "\x00") {
+		if !strings.HasPrefix(attr, xattrPrefix) {
+			continue
+		}
+		value, err := getxattr(path, attr)
+		if err != nil {
+			return nil, err
+		}
+		var p property
+		if json.Unmarshal(value, &p) != nil {
+			continue
+		}
+		prop := p.toProperty()
+		props[prop.XMLName] = prop
+	}
+	return props, nil
+}
+
+func (Xattr) Patch(path string, patches []webdav.Proppatch) error {
+	for _, patch := range patches {
+		for _, prop := range patch.Props {
+			name := xattrName(prop.XMLName)
+			if patch.Remove {
+				if err := unix.Removexattr(path, name); err != nil && !errors.Is(err, unix.ENODATA) {
+					return err
+				}
+				continue
+			}
+			value, err := json.Marshal(fromProperty(prop))
+			if err != nil {
+				return err
+			}
+			if err := unix.Setxattr(path, name, value, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (Xattr) Move(oldPath, newPath string) error {
+	return nil
+}
+
+func (Xattr) Remove(path string) error {
+	return nil
+}
+
+func getxattr(path, name string) ([]byte, error) {
+	size, err := unix.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Getxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+func ignoreUnsupported(err error) error {
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil
+	}
+	return err
+}
+
+// xattrSupported probes the extended attributes of the file system of root.
+func xattrSupported(root string) bool {
+	name := xattrPrefix + "probe"
+	if err := unix.Setxattr(root, name, []byte("1"), 0); err != nil {
+		return false
+	}
+	_ = unix.Removexattr(root, name)
+	return true
+}
@@ -0,0 +1,58 @@
+//go:build !linux
+
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package props
+
+import (
+	"encoding/xml"
+	"errors"
+
+	"golang.org/x/net/webdav"
+)
+
+var errUnsupported = errors.New("extended attributes are not supported")
+
+// Xattr stores the properties in extended attributes, which are only
+// supported on linux.
+type Xattr struct{}
+
+func (Xattr) Props(path string) (map[xml.Name]webdav.Property, error) {
+	return nil, nil
+}
+
+func (Xattr) Patch(path string, patches []webdav.Proppatch) error {
+	return errUnsupported
+}
+
+func (Xattr) Move(oldPath, newPath string) error {
+	return nil
+}
+
+func (Xattr) Remove(path string) error {
+	return nil
+}
+
+func xattrSupported(root string) bool {
+	return false
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package quota
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const ownerXattr = "user.webdav.owner"
+
+// Owner returns the user who wrote the file, recorded in an extended attribute.
+func Owner(path string) string {
+	buf := make([]byte, 256)
+	n, err := unix.Getxattr(path, ownerXattr, buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+func SetOwner(path, owner string) error {
+	return unix.Setxattr(path, ownerXattr, []byte(owner), 0)
+}
+
+// OwnerSupported probes whether the owners can be recorded in the file system
+// of dir.
+func OwnerSupported(dir string) bool {
+	name := ownerXattr + ".probe"
+	if err := unix.Setxattr(dir, name, []byte("1"), 0); err != nil {
+		return false
+	}
+	_ = unix.Removexattr(dir, name)
+	return true
+}
@@ -0,0 +1,303 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+// Package quota tracks the bytes used by the users in the libraries, and
+// enforces the quotas configured for them.
+package quota
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/pkg"
+)
+
+const defaultReconcileInterval = time.Hour
+
+// ErrExceeded is returned by the writes which would exceed a quota.
+var ErrExceeded = errors.New("quota exceeded")
+
+type libraryUser struct {
+	library string
+	user    string
+}
+
+// rootUsage is what a root directory of a library contributes to the usage,
+// the files without a known owner only count for the library.
+type rootUsage struct {
+	library string
+	total   int64
+	users   map[string]int64
+}
+
+type Tracker struct {
+	interval time.Duration
+
+	libraryLimit     map[string]int64
+	userLimit        map[string]int64
+	userLibraryLimit map[libraryUser]int64
+	// default limit of each user within the library
+	libraryUserLimit map[string]int64
+
+	mu          sync.Mutex
+	library     map[string]int64
+	user        map[string]int64
+	userLibrary map[libraryUser]int64
+	roots       map[string]*rootUsage
+}
+
+// NewTracker returns nil when no quota is configured.
+func NewTracker(cfg *conf.Conf) *Tracker {
+	t := &Tracker{
+		interval:         defaultReconcileInterval,
+		libraryLimit:     map[string]int64{},
+		userLimit:        map[string]int64{},
+		userLibraryLimit: map[libraryUser]int64{},
+		libraryUserLimit: map[string]int64{},
+		library:          map[string]int64{},
+		user:             map[string]int64{},
+		userLibrary:      map[libraryUser]int64{},
+		roots:            map[string]*rootUsage{},
+	}
+	if cfg.Quota != nil && cfg.Quota.ReconcileInterval > 0 {
+		t.interval = cfg.Quota.ReconcileInterval
+	}
+
+	enabled := false
+	for _, lib := range cfg.Library {
+		if lib.Quota > 0 {
+			t.libraryLimit[lib.Name] = int64(lib.Quota)
+			enabled = true
+		}
+		if lib.UserQuota > 0 {
+			t.libraryUserLimit[lib.Name] = int64(lib.UserQuota)
+			enabled = true
+		}
+	}
+	for _, user := range cfg.User {
+		if user.Quota > 0 {
+			t.userLimit[user.Username] = int64(user.Quota)
+			enabled = true
+		}
+		for library, quota := range user.LibraryQuota {
+			t.userLibraryLimit[libraryUser{library, user.Username}] = int64(quota)
+			enabled = true
+		}
+	}
+	if !enabled {
+		return nil
+	}
+
+	return t
+}
+
+// UserLimited reports whether a quota of the users applies to the library,
+// which needs the owners of its files.
+func (t *Tracker) UserLimited(library string) bool {
+	if len(t.userLimit) > 0 || t.libraryUserLimit[library] > 0 {
+		return true
+	}
+	for key := range t.userLibraryLimit {
+		if key.library == library {
+			return true
+		}
+	}
+	return false
+}
+
+// Register tracks the usage of a root directory of the library, the root is
+// scanned now and then periodically.
+func (t *Tracker) Register(library, root string) {
+	t.mu.Lock()
+	if _, ok := t.roots[root]; ok {
+		t.mu.Unlock()
+		return
+	}
+	t.roots[root] = &rootUsage{library: library, users: map[string]int64{}}
+	t.mu.Unlock()
+
+	t.Scan(root)
+}
+
+// Reconcile scans the registered roots periodically.
+func (t *Tracker) Reconcile() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.mu.Lock()
+		roots := make([]string, 0, len(t.roots))
+		for root := range t.roots {
+			roots = append(roots, root)
+		}
+		t.mu.Unlock()
+
+		for _, root := range roots {
+			t.Scan(root)
+		}
+	}
+}
+
+// Start reconciles the usage in the background.
+func (t *Tracker) Start() {
+	pkg.SafeG(t.Reconcile)
+}
+
+// Scan walks the root and replaces its usage.
+func (t *Tracker) Scan(root string) {
+	usage := &rootUsage{users: map[string]int64{}}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		usage.total += info.Size()
+		if owner := Owner(path); owner != "" {
+			usage.users[owner] += info.Size()
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("scan quota usage error", slog.String("root", root), slog.Any("err", err))
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old, ok := t.roots[root]
+	if !ok {
+		return
+	}
+	t.addLocked(old, "", usage.total-old.total)
+	for user, size := range old.users {
+		t.addUserLocked(old, user, -size)
+	}
+	for user, size := range usage.users {
+		t.addUserLocked(old, user, size)
+	}
+}
+
+// Add adds the delta to the usage of the owner, the library and the root,
+// without checking the quotas.
+func (t *Tracker) Add(root, owner string, delta int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if r, ok := t.roots[root]; ok {
+		t.addLocked(r, owner, delta)
+	}
+}
+
+// Transfer moves the usage of a file to a new owner.
+func (t *Tracker) Transfer(root, from, to string, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if r, ok := t.roots[root]; ok {
+		t.addUserLocked(r, from, -size)
+		t.addUserLocked(r, to, size)
+	}
+}
+
+// Reserve adds n bytes to the usage of the owner if no quota is exceeded.
+func (t *Tracker) Reserve(root, owner string, n int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r, ok := t.roots[root]
+	if !ok {
+		return true
+	}
+	if available, _ := t.availableLocked(r.library, owner); available >= 0 && n > available {
+		return false
+	}
+	t.addLocked(r, owner, n)
+	return true
+}
+
+// Usage returns the bytes available to the user in the library, -1 when not
+// limited, and the bytes used against the closest quota.
+func (t *Tracker) Usage(library, user string) (available, used int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.availableLocked(library, user)
+}
+
+func (t *Tracker) availableLocked(library, user string) (available, used int64) {
+	available = -1
+	check := func(limit, usage int64) {
+		remain := max(limit-usage, 0)
+		if available < 0 || remain < available {
+			available, used = remain, usage
+		}
+	}
+	if limit, ok := t.libraryLimit[library]; ok {
+		check(limit, t.library[library])
+	}
+	if user == "" {
+		return
+	}
+	key := libraryUser{library, user}
+	if limit, ok := t.userLibraryLimit[key]; ok {
+		check(limit, t.userLibrary[key])
+	} else if limit, ok := t.libraryUserLimit[library]; ok {
+		check(limit, t.userLibrary[key])
+	}
+	if limit, ok := t.userLimit[user]; ok {
+		check(limit, t.user[user])
+	}
+	if available < 0 {
+		used = t.userLibrary[key]
+	}
+	return
+}
+
+func (t *Tracker) addLocked(r *rootUsage, owner string, delta int64) {
+	r.total += delta
+	t.library[r.library] += delta
+	t.addUserLocked(r, owner, delta)
+}
+
+func (t *Tracker) addUserLocked(r *rootUsage, user string, delta int64) {
+	if user == "" || delta == 0 {
+		return
+	}
+	r.users[user] += delta
+	t.user[user] += delta
+	t.userLibrary[libraryUser{r.library, user}] += delta
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package quota
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/llklkl/webdav/conf"
+)
+
+func TestNewTracker(t *testing.T) {
+	cfg := &conf.Conf{Library: []*conf.LibraryConf{{Name: "media"}}}
+	if NewTracker(cfg) != nil {
+		t.Errorf("tracker without quota")
+	}
+	cfg.User = []*conf.UserConf{{Username: "alice", Quota: 10}}
+	if NewTracker(cfg) == nil {
+		t.Errorf("no tracker with a user quota")
+	}
+}
+
+func TestUserLimited(t *testing.T) {
+	cfg := &conf.Conf{
+		Library: []*conf.LibraryConf{{Name: "media", Quota: 100}, {Name: "backup", UserQuota: 50}, {Name: "home"}},
+		User:    []*conf.UserConf{{Username: "alice", LibraryQuota: map[string]conf.ByteSize{"home": 30}}},
+	}
+	tr := NewTracker(cfg)
+	for library, limited := range map[string]bool{"media": false, "backup": true, "home": true} {
+		if tr.UserLimited(library) != limited {
+			t.Errorf("%s: user limited %v", library, !limited)
+		}
+	}
+	cfg.User[0].Quota = 10
+	if !NewTracker(cfg).UserLimited("media") {
+		t.Error("the quota of a user limits every library")
+	}
+}
+
+func TestOwnerSupported(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := SetOwner(file, "alice")
+	if supported := OwnerSupported(dir); supported != (err == nil) {
+		t.Errorf("supported %v, but set owner: %v", supported, err)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	root := t.TempDir()
+	cfg := &conf.Conf{
+		Library: []*conf.LibraryConf{{Name: "media", Quota: 100, UserQuota: 50}},
+		User: []*conf.UserConf{
+			{Username: "alice", LibraryQuota: map[string]conf.ByteSize{"media": 30}},
+			{Username: "bob"},
+		},
+	}
+	tr := NewTracker(cfg)
+	tr.Register("media", root)
+
+	if !tr.Reserve(root, "alice", 30) {
+		t.Fatalf("alice within quota")
+	}
+	if tr.Reserve(root, "alice", 1) {
+		t.Errorf("alice over library_quota")
+	}
+	if !tr.Reserve(root, "bob", 50) {
+		t.Fatalf("bob within user_quota")
+	}
+	if tr.Reserve(root, "bob", 1) {
+		t.Errorf("bob over user_quota")
+	}
+	if available, used := tr.Usage("media", ""); available != 20 || used != 80 {
+		t.Errorf("library usage: %d %d", available, used)
+	}
+	if tr.Reserve(root, "", 21) {
+		t.Errorf("over library quota")
+	}
+
+	tr.Add(root, "bob", -50)
+	if available, used := tr.Usage("media", "bob"); available != 50 || used != 0 {
+		t.Errorf("bob usage: %d %d", available, used)
+	}
+	tr.Transfer(root, "alice", "bob", 30)
+	if available, used := tr.Usage("media", "alice"); available != 30 || used != 0 {
+		t.Errorf("alice usage: %d %d", available, used)
+	}
+	if available, used := tr.Usage("media", "bob"); available != 20 || used != 30 {
+		t.Errorf("bob usage after transfer: %d %d", available, used)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	root := t.TempDir()
+	cfg := &conf.Conf{
+		Library: []*conf.LibraryConf{{Name: "media"}, {Name: "backup"}},
+		User:    []*conf.UserConf{{Username: "alice", LibraryQuota: map[string]conf.ByteSize{"backup": 10}}},
+	}
+	tr := NewTracker(cfg)
+	tr.Register("media", root)
+	if !tr.Reserve(root, "alice", 1<<40) {
+		t.Errorf("unlimited library")
+	}
+	if available, used := tr.Usage("media", "alice"); available != -1 || used != 1<<40 {
+		t.Errorf("usage: %d %d", available, used)
+	}
+}
+
+func TestScan(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a", "x"), make([]byte, 10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "y"), make([]byte, 5), 0644); err != nil {
+		t.Fatal(err)
+	}
+	owned := SetOwner(filepath.Join(root, "a", "x"), "alice") == nil
+
+	cfg := &conf.Conf{Library: []*conf.LibraryConf{{Name: "media", Quota: 100}}}
+	tr := NewTracker(cfg)
+	tr.Register("media", root)
+	if available, used := tr.Usage("media", ""); available != 85 || used != 15 {
+		t.Errorf("usage: %d %d", available, used)
+	}
+
+	// the usage tracked by the writes is replaced by the scan
+	tr.Add(root, "alice", 40)
+	tr.Scan(root)
+	if available, used := tr.Usage("media", ""); available != 85 || used != 15 {
+		t.Errorf("usage after scan: %d %d", available, used)
+	}
+	if !owned {
+		t.Skip("extended attributes are not supported")
+	}
+	if used := tr.userLibrary[libraryUser{"media", "alice"}]; used != 10 {
+		t.Errorf("alice usage: %d", used)
+	}
+}
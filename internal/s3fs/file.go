@@ -0,0 +1,270 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package s3fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/llklkl/webdav/internal/pkg"
+)
+
+var errReadOnly = errors.New("the object can only be replaced")
+
+type dirFile struct {
+	fsys    *FileSystem
+	ctx     context.Context
+	info    *fileInfo
+	entries []os.FileInfo
+	listed  bool
+}
+
+func (f *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.listed {
+		entries, err := f.fsys.readDir(f.ctx, f.info.path)
+		if err != nil {
+			return nil, err
+		}
+		f.entries, f.listed = entries, true
+	}
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(f.entries))
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+func (f *dirFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *dirFile) Read(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: f.info.path, Err: errors.New("is a directory")}
+}
+
+func (f *dirFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (f *dirFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.info.path, Err: errors.New("is a directory")}
+}
+
+func (f *dirFile) Close() error {
+	return nil
+}
+
+// readFile downloads the object from the offset of the first read after a
+// seek, so that a range request only downloads the range.
+type readFile struct {
+	fsys   *FileSystem
+	ctx    context.Context
+	info   *fileInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *readFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.info.path, Err: errors.New("not a directory")}
+}
+
+func (f *readFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *readFile) Read(p []byte) (int, error) {
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		opts := minio.GetObjectOptions{}
+		if f.offset > 0 {
+			if err := opts.SetRange(f.offset, 0); err != nil {
+				return 0, err
+			}
+		}
+		obj, err := f.fsys.client.GetObject(f.ctx, f.fsys.bucket, f.fsys.key(f.info.path), opts)
+		if err != nil {
+			return 0, &os.PathError{Op: "read", Path: f.info.path, Err: err}
+		}
+		f.body = obj
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *readFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.info.path, Err: fs.ErrInvalid}
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *readFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.info.path, Err: errReadOnly}
+}
+
+func (f *readFile) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// writeFile buffers up to a part in memory, and uploads it with a single
+// request on close. Larger files are streamed with multipart upload.
+type writeFile struct {
+	fsys *FileSystem
+	ctx  context.Context
+	path string
+	size int64
+	// the first failed write, which aborts the upload
+	err error
+
+	buf    bytes.Buffer
+	pw     *io.PipeWriter
+	result chan error
+}
+
+func (fsys *FileSystem) create(ctx context.Context, name string) *writeFile {
+	fsys.infos.Remove(name)
+	return &writeFile{fsys: fsys, ctx: ctx, path: name}
+}
+
+func (f *writeFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.path, Err: errors.New("not a directory")}
+}
+
+func (f *writeFile) Stat() (os.FileInfo, error) {
+	return &fileInfo{path: f.path, size: f.size, modTime: time.Now()}, nil
+}
+
+func (f *writeFile) Read(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: f.path, Err: errors.New("the file is opened for writing")}
+}
+
+func (f *writeFile) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekCurrent {
+		return f.size, nil
+	}
+	return 0, &os.PathError{Op: "seek", Path: f.path, Err: errors.New("the upload can only be appended")}
+}
+
+func (f *writeFile) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, &os.PathError{Op: "write", Path: f.path, Err: f.err}
+	}
+	if f.pw != nil {
+		n, err := f.pw.Write(p)
+		f.size += int64(n)
+		if err != nil {
+			f.err = err
+		}
+		return n, err
+	}
+
+	n, _ := f.buf.Write(p)
+	f.size += int64(n)
+	if uint64(f.buf.Len()) > f.fsys.partSize {
+		f.stream()
+	}
+	return n, nil
+}
+
+// stream starts the multipart upload of the buffer and the following writes.
+func (f *writeFile) stream() {
+	pr, pw := io.Pipe()
+	f.pw = pw
+	f.result = make(chan error, 1)
+	body := io.MultiReader(&f.buf, pr)
+	pkg.SafeG(func() {
+		_, err := f.fsys.client.PutObject(f.ctx, f.fsys.bucket, f.fsys.key(f.path), body, -1,
+			minio.PutObjectOptions{PartSize: f.fsys.partSize})
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			pr.Close()
+		}
+		f.result <- err
+	})
+}
+
+func (f *writeFile) Close() error {
+	defer f.fsys.infos.Remove(f.path)
+
+	// an interrupted upload, e.g. the body of the request can not be read,
+	// does not replace the object
+	err := f.err
+	if err == nil {
+		err = context.Cause(f.ctx)
+	}
+	if f.pw != nil {
+		if err != nil {
+			f.pw.CloseWithError(err)
+		} else {
+			f.pw.Close()
+		}
+		if putErr := <-f.result; err == nil {
+			err = putErr
+		}
+		if err != nil {
+			return &os.PathError{Op: "close", Path: f.path, Err: err}
+		}
+		return nil
+	}
+	if err != nil {
+		return &os.PathError{Op: "close", Path: f.path, Err: err}
+	}
+	_, err = f.fsys.client.PutObject(f.ctx, f.fsys.bucket, f.fsys.key(f.path), bytes.NewReader(f.buf.Bytes()),
+		int64(f.buf.Len()), minio.PutObjectOptions{})
+	if err != nil {
+		return &os.PathError{Op: "close", Path: f.path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,442 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+// Package s3fs implements a webdav.FileSystem over an S3 compatible object
+// storage. Directories are synthetic: a directory exists when an object is
+// stored below it, or when it has a marker object whose key ends with a
+// slash, which is created by Mkdir.
+package s3fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"golang.org/x/net/webdav"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/pkg"
+)
+
+const (
+	defaultRegion   = "us-east-1"
+	defaultPartSize = 16 << 20
+	// objects larger than this are copied with multipart copy
+	maxCopySize = 5 << 30
+
+	// the infos of listings are reused by the stats which follow, e.g. of
+	// PROPFIND
+	infoCacheSize = 10000
+	infoCacheTTL  = 10 * time.Second
+)
+
+type FileSystem struct {
+	client   *minio.Client
+	bucket   string
+	prefix   string
+	partSize uint64
+
+	infos *expirable.LRU[string, *fileInfo]
+}
+
+func New(cfg *conf.S3Conf) (*FileSystem, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse s3 endpoint error: %w", err)
+	}
+	creds := credentials.NewEnvAWS()
+	if cfg.AccessKey != "" {
+		creds = credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, "")
+	}
+	opts := &minio.Options{
+		Creds:  creds,
+		Secure: u.Scheme == "https",
+		Region: cfg.Region,
+	}
+	if opts.Region == "" {
+		opts.Region = defaultRegion
+	}
+	if cfg.PathStyle {
+		opts.BucketLookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(u.Host, opts)
+	if err != nil {
+		return nil, fmt.Errorf("create s3 client error: %w", err)
+	}
+
+	fsys := &FileSystem{
+		client:   client,
+		bucket:   cfg.Bucket,
+		prefix:   strings.Trim(cfg.Prefix, "/"),
+		partSize: uint64(cfg.PartSize),
+		infos:    expirable.NewLRU[string, *fileInfo](infoCacheSize, nil, infoCacheTTL),
+	}
+	if fsys.prefix != "" {
+		fsys.prefix += "/"
+	}
+	if fsys.partSize == 0 {
+		fsys.partSize = defaultPartSize
+	}
+
+	return fsys, nil
+}
+
+func clean(name string) string {
+	if name == "" || name[0] != '/' {
+		name = "/" + name
+	}
+	return path.Clean(name)
+}
+
+// key returns the key of the object of the file.
+func (fsys *FileSystem) key(name string) string {
+	return fsys.prefix + strings.TrimPrefix(name, "/")
+}
+
+// dirKey returns the prefix of the objects below the directory, which is
+// also the key of its marker.
+func (fsys *FileSystem) dirKey(name string) string {
+	if name == "/" {
+		return fsys.prefix
+	}
+	return fsys.key(name) + "/"
+}
+
+func isNotFound(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.StatusCode == http.StatusNotFound || resp.Code == "NoSuchKey"
+}
+
+func pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (fsys *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := fsys.stat(ctx, clean(name))
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (fsys *FileSystem) stat(ctx context.Context, name string) (*fileInfo, error) {
+	if name == "/" {
+		return dirInfo(name, time.Time{}), nil
+	}
+	if info, ok := fsys.infos.Get(name); ok {
+		return info, nil
+	}
+
+	obj, err := fsys.client.StatObject(ctx, fsys.bucket, fsys.key(name), minio.StatObjectOptions{})
+	if err == nil {
+		info := objectInfo(name, obj)
+		fsys.infos.Add(name, info)
+		return info, nil
+	}
+	if !isNotFound(err) {
+		return nil, pathError("stat", name, err)
+	}
+
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for obj := range fsys.client.ListObjects(listCtx, fsys.bucket, minio.ListObjectsOptions{
+		Prefix:  fsys.dirKey(name),
+		MaxKeys: 1,
+	}) {
+		if obj.Err != nil {
+			return nil, pathError("stat", name, obj.Err)
+		}
+		info := dirInfo(name, obj.LastModified)
+		fsys.infos.Add(name, info)
+		return info, nil
+	}
+	return nil, pathError("stat", name, os.ErrNotExist)
+}
+
+// statParent checks the parent directory of the file which is created.
+func (fsys *FileSystem) statParent(ctx context.Context, op, name string) error {
+	info, err := fsys.stat(ctx, path.Dir(name))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return pathError(op, name, os.ErrNotExist)
+	}
+	return nil
+}
+
+// readDir lists the entries of the directory.
+func (fsys *FileSystem) readDir(ctx context.Context, name string) ([]os.FileInfo, error) {
+	dirKey := fsys.dirKey(name)
+	var infos []os.FileInfo
+	for obj := range fsys.client.ListObjects(ctx, fsys.bucket, minio.ListObjectsOptions{Prefix: dirKey}) {
+		if obj.Err != nil {
+			return nil, pathError("readdir", name, obj.Err)
+		}
+		if obj.Key == dirKey {
+			continue
+		}
+		var info *fileInfo
+		if child, ok := strings.CutSuffix(strings.TrimPrefix(obj.Key, dirKey), "/"); ok {
+			info = dirInfo(path.Join(name, child), obj.LastModified)
+		} else {
+			info = objectInfo(path.Join(name, child), obj)
+		}
+		fsys.infos.Add(info.path, info)
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (fsys *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = clean(name)
+	if _, err := fsys.stat(ctx, name); err == nil {
+		return pathError("mkdir", name, os.ErrExist)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := fsys.statParent(ctx, "mkdir", name); err != nil {
+		return err
+	}
+
+	_, err := fsys.client.PutObject(ctx, fsys.bucket, fsys.dirKey(name), strings.NewReader(""), 0, minio.PutObjectOptions{})
+	if err != nil {
+		return pathError("mkdir", name, err)
+	}
+	fsys.infos.Remove(name)
+	return nil
+}
+
+func (fsys *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = clean(name)
+	info, err := fsys.stat(ctx, name)
+	if err != nil {
+		if !os.IsNotExist(err) || flag&os.O_CREATE == 0 {
+			return nil, err
+		}
+		if err := fsys.statParent(ctx, "open", name); err != nil {
+			return nil, err
+		}
+		return fsys.create(ctx, name), nil
+	}
+
+	if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, pathError("open", name, os.ErrExist)
+	}
+	if info.IsDir() {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, pathError("open", name, errors.New("is a directory"))
+		}
+		return &dirFile{fsys: fsys, ctx: ctx, info: info}, nil
+	}
+	if flag&os.O_TRUNC != 0 {
+		return fsys.create(ctx, name), nil
+	}
+	// the files can not be modified in place
+	return &readFile{fsys: fsys, ctx: ctx, info: info}, nil
+}
+
+func (fsys *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	name = clean(name)
+	if name == "/" {
+		return pathError("remove", name, os.ErrInvalid)
+	}
+	defer fsys.infos.Purge()
+
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	objects := make(chan minio.ObjectInfo)
+	var listErr error
+	pkg.SafeG(func() {
+		defer close(objects)
+		send := func(obj minio.ObjectInfo) bool {
+			select {
+			case objects <- obj:
+				return true
+			case <-listCtx.Done():
+				return false
+			}
+		}
+		if !send(minio.ObjectInfo{Key: fsys.key(name)}) {
+			return
+		}
+		for obj := range fsys.client.ListObjects(listCtx, fsys.bucket, minio.ListObjectsOptions{
+			Prefix:    fsys.dirKey(name),
+			Recursive: true,
+		}) {
+			if obj.Err != nil {
+				listErr = obj.Err
+				return
+			}
+			if !send(obj) {
+				return
+			}
+		}
+	})
+
+	var err error
+	for e := range fsys.client.RemoveObjects(ctx, fsys.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if err == nil && !isNotFound(e.Err) {
+			err = pathError("remove", name, e.Err)
+		}
+	}
+	if err == nil && listErr != nil {
+		err = pathError("remove", name, listErr)
+	}
+	return err
+}
+
+func (fsys *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = clean(oldName), clean(newName)
+	if oldName == "/" || newName == "/" {
+		return pathError("rename", oldName, os.ErrInvalid)
+	}
+	info, err := fsys.stat(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if err := fsys.statParent(ctx, "rename", newName); err != nil {
+		return err
+	}
+	defer fsys.infos.Purge()
+
+	if !info.IsDir() {
+		if err := fsys.copy(ctx, fsys.key(oldName), fsys.key(newName), info.size); err != nil {
+			return pathError("rename", oldName, err)
+		}
+		if err := fsys.client.RemoveObject(ctx, fsys.bucket, fsys.key(oldName), minio.RemoveObjectOptions{}); err != nil {
+			return pathError("rename", oldName, err)
+		}
+		return nil
+	}
+
+	// the marker keeps the directory when it is empty
+	oldKey, newKey := fsys.dirKey(oldName), fsys.dirKey(newName)
+	_, err = fsys.client.PutObject(ctx, fsys.bucket, newKey, strings.NewReader(""), 0, minio.PutObjectOptions{})
+	if err != nil {
+		return pathError("rename", oldName, err)
+	}
+	for obj := range fsys.client.ListObjects(ctx, fsys.bucket, minio.ListObjectsOptions{Prefix: oldKey, Recursive: true}) {
+		if obj.Err != nil {
+			return pathError("rename", oldName, obj.Err)
+		}
+		if obj.Key == oldKey {
+			continue
+		}
+		if err := fsys.copy(ctx, obj.Key, newKey+strings.TrimPrefix(obj.Key, oldKey), obj.Size); err != nil {
+			return pathError("rename", oldName, err)
+		}
+	}
+	return fsys.RemoveAll(ctx, oldName)
+}
+
+// copy copies the object on the server side.
+func (fsys *FileSystem) copy(ctx context.Context, src, dst string, size int64) error {
+	srcOpts := minio.CopySrcOptions{Bucket: fsys.bucket, Object: src}
+	dstOpts := minio.CopyDestOptions{Bucket: fsys.bucket, Object: dst}
+	var err error
+	if size > maxCopySize {
+		_, err = fsys.client.ComposeObject(ctx, dstOpts, srcOpts)
+	} else {
+		_, err = fsys.client.CopyObject(ctx, dstOpts, srcOpts)
+	}
+	return err
+}
+
+// fileInfo implements webdav.ETager and webdav.ContentTyper to save the
+// requests of PROPFIND.
+type fileInfo struct {
+	path        string
+	size        int64
+	modTime     time.Time
+	dir         bool
+	etag        string
+	contentType string
+}
+
+func objectInfo(name string, obj minio.ObjectInfo) *fileInfo {
+	return &fileInfo{
+		path:        name,
+		size:        obj.Size,
+		modTime:     obj.LastModified,
+		etag:        obj.ETag,
+		contentType: obj.ContentType,
+	}
+}
+
+func dirInfo(name string, modTime time.Time) *fileInfo {
+	return &fileInfo{path: name, modTime: modTime, dir: true}
+}
+
+func (fi *fileInfo) Name() string {
+	return path.Base(fi.path)
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0o755
+	}
+	return 0o644
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.dir
+}
+
+func (fi *fileInfo) Sys() any {
+	return nil
+}
+
+func (fi *fileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.etag == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + strings.Trim(fi.etag, `"`) + `"`, nil
+}
+
+func (fi *fileInfo) ContentType(ctx context.Context) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(fi.path)); ctype != "" {
+		return ctype, nil
+	}
+	if fi.contentType != "" {
+		return fi.contentType, nil
+	}
+	return "", webdav.ErrNotImplemented
+}
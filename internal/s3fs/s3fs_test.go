@@ -0,0 +1,516 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package s3fs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/llklkl/webdav/conf"
+)
+
+// fakeS3 is an in-process stand-in of an S3 compatible server, it serves
+// one bucket with path-style requests, and does not check signatures.
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	// counts the requests by method and the first query key
+	requests map[string]int
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, string) {
+	f := &fakeS3{
+		bucket:   bucket,
+		objects:  map[string][]byte{},
+		uploads:  map[string]map[int][]byte{},
+		requests: map[string]int{},
+	}
+	svr := httptest.NewServer(f)
+	t.Cleanup(svr.Close)
+	return f, svr.URL
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[method]
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	body, err := readBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[r.Method]++
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && query.Has("location"):
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+		}{})
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, query)
+	case r.Method == http.MethodPost && key == "" && query.Has("delete"):
+		f.deleteObjects(w, body)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = map[int][]byte{}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[n] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var numbers []int
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		slices.Sort(numbers)
+		var data []byte
+		for _, n := range numbers {
+			data = append(data, parts[n]...)
+		}
+		f.objects[key] = data
+		delete(f.uploads, query.Get("uploadId"))
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: etag(data)})
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		_, srcKey, _ := strings.Cut(strings.TrimPrefix(src, "/"), "/")
+		data, ok := f.objects[srcKey]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		f.objects[key] = slices.Clone(data)
+		writeXML(w, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			ETag         string
+			LastModified string
+		}{ETag: etag(data), LastModified: time.Now().UTC().Format(time.RFC3339)})
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	type object struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		KeyCount       int
+		MaxKeys        int
+		IsTruncated    bool
+		Contents       []object
+		CommonPrefixes []commonPrefix
+	}{Name: f.bucket, Prefix: query.Get("prefix"), MaxKeys: 1000}
+
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	seen := map[string]bool{}
+	for _, key := range keys {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			p := prefix + rest[:i+len(delimiter)]
+			if !seen[p] {
+				seen[p] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: p})
+			}
+			continue
+		}
+		result.Contents = append(result.Contents, object{
+			Key:          key,
+			LastModified: time.Now().UTC().Format(time.RFC3339),
+			ETag:         etag(f.objects[key]),
+			Size:         len(f.objects[key]),
+		})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	writeXML(w, result)
+}
+
+func (f *fakeS3) deleteObjects(w http.ResponseWriter, body []byte) {
+	var req struct {
+		Object []struct {
+			Key string
+		}
+	}
+	if err := xml.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	type deleted struct {
+		Key string
+	}
+	result := struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+		Deleted []deleted
+	}{}
+	for _, obj := range req.Object {
+		delete(f.objects, obj.Key)
+		result.Deleted = append(result.Deleted, deleted{Key: obj.Key})
+	}
+	writeXML(w, result)
+}
+
+// readBody decodes the aws-chunked body of the streaming signature.
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code></Error>", code)
+}
+
+func newTestFs(t *testing.T, partSize conf.ByteSize) (*FileSystem, *fakeS3) {
+	fake, endpoint := newFakeS3(t, "bucket")
+	fsys, err := New(&conf.S3Conf{
+		Endpoint:  endpoint,
+		Bucket:    "bucket",
+		Prefix:    "lib",
+		PathStyle: true,
+		AccessKey: "key",
+		SecretKey: "secret",
+		PartSize:  partSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys, fake
+}
+
+func putFile(t *testing.T, fsys *FileSystem, name string, data []byte) {
+	t.Helper()
+	f, err := fsys.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getFile(t *testing.T, fsys *FileSystem, name string, offset int64) string {
+	t.Helper()
+	f, err := fsys.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFiles(t *testing.T) {
+	fsys, fake := newTestFs(t, 0)
+	ctx := context.Background()
+
+	if err := fsys.Mkdir(ctx, "/docs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Mkdir(ctx, "/docs", 0755); !os.IsExist(err) {
+		t.Errorf("mkdir existing: %v", err)
+	}
+	if err := fsys.Mkdir(ctx, "/a/b", 0755); !os.IsNotExist(err) {
+		t.Errorf("mkdir without parent: %v", err)
+	}
+	if _, err := fsys.OpenFile(ctx, "/a/x", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); !os.IsNotExist(err) {
+		t.Errorf("create without parent: %v", err)
+	}
+	putFile(t, fsys, "/docs/x.txt", []byte("hello world"))
+	// uploaded by another client, without a directory marker
+	fake.objects["lib/docs/sub/y.txt"] = nil
+	if _, ok := fake.objects["lib/docs/x.txt"]; !ok {
+		t.Fatalf("objects: %v", fake.objects)
+	}
+
+	if got := getFile(t, fsys, "/docs/x.txt", 6); got != "world" {
+		t.Errorf("read from offset: %q", got)
+	}
+	info, err := fsys.Stat(ctx, "/docs/sub")
+	if err != nil || !info.IsDir() {
+		t.Errorf("synthetic directory: %v %v", info, err)
+	}
+	if _, err := fsys.Stat(ctx, "/docs/none"); !os.IsNotExist(err) {
+		t.Errorf("stat missing: %v", err)
+	}
+
+	dir, err := fsys.OpenFile(ctx, "/docs", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, fmt.Sprintf("%s:%v:%d", e.Name(), e.IsDir(), e.Size()))
+	}
+	if !slices.Equal(names, []string{"x.txt:false:11", "sub:true:0"}) {
+		t.Errorf("readdir: %v", names)
+	}
+	// the stats of the entries are served by the listing
+	heads := fake.count(http.MethodHead)
+	if _, err := fsys.Stat(ctx, "/docs/x.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if fake.count(http.MethodHead) != heads {
+		t.Errorf("stat after listing requested the server")
+	}
+
+	if err := fsys.Rename(ctx, "/docs", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if got := getFile(t, fsys, "/moved/x.txt", 0); got != "hello world" {
+		t.Errorf("read moved: %q", got)
+	}
+	if _, err := fsys.Stat(ctx, "/docs"); !os.IsNotExist(err) {
+		t.Errorf("stat renamed: %v", err)
+	}
+	if err := fsys.RemoveAll(ctx, "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("objects left: %v", fake.objects)
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	fsys, fake := newTestFs(t, 5<<20)
+	data := bytes.Repeat([]byte("0123456789"), 1<<20)
+	putFile(t, fsys, "/large.bin", data)
+
+	if !bytes.Equal(fake.objects["lib/large.bin"], data) {
+		t.Fatalf("uploaded %d bytes", len(fake.objects["lib/large.bin"]))
+	}
+	if fake.count(http.MethodPost) < 2 {
+		t.Errorf("multipart upload was not used")
+	}
+	if got := getFile(t, fsys, "/large.bin", int64(len(data)-10)); got != "0123456789" {
+		t.Errorf("read tail: %q", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	fsys, _ := newTestFs(t, 0)
+	svr := httptest.NewServer(&webdav.Handler{FileSystem: fsys, LockSystem: webdav.NewMemLS()})
+	t.Cleanup(svr.Close)
+
+	do := func(method, name, body string, header ...string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, svr.URL+name, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	expect := func(resp *http.Response, status int) {
+		t.Helper()
+		if resp.StatusCode != status {
+			t.Errorf("%s %s: %d, want %d", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, status)
+		}
+	}
+
+	expect(do("MKCOL", "/dir", ""), http.StatusCreated)
+	expect(do(http.MethodPut, "/dir/a.txt", "content"), http.StatusCreated)
+	expect(do("COPY", "/dir", "", "Destination", svr.URL+"/copy"), http.StatusCreated)
+	expect(do("MOVE", "/copy/a.txt", "", "Destination", svr.URL+"/b.txt"), http.StatusCreated)
+
+	resp := do("PROPFIND", "/", "", "Depth", "1")
+	expect(resp, http.StatusMultiStatus)
+	data, _ := io.ReadAll(resp.Body)
+	for _, href := range []string{"<D:href>/dir/</D:href>", "<D:href>/copy/</D:href>", "<D:href>/b.txt</D:href>"} {
+		if !strings.Contains(string(data), href) {
+			t.Errorf("propfind misses %s: %s", href, data)
+		}
+	}
+
+	resp = do(http.MethodGet, "/b.txt", "", "Range", "bytes=3-")
+	expect(resp, http.StatusPartialContent)
+	if data, _ := io.ReadAll(resp.Body); string(data) != "tent" {
+		t.Errorf("get range: %q", data)
+	}
+	expect(do(http.MethodDelete, "/dir", ""), http.StatusNoContent)
+	expect(do(http.MethodGet, "/dir/a.txt", ""), http.StatusNotFound)
+}
+
+func TestAbortedUpload(t *testing.T) {
+	fsys, fake := newTestFs(t, 5<<20)
+	putFile(t, fsys, "/a.bin", []byte("original"))
+
+	for _, size := range []int{1 << 10, 6 << 20} {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		f, err := fsys.OpenFile(ctx, "/a.bin", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(bytes.Repeat([]byte("x"), size)); err != nil {
+			t.Fatal(err)
+		}
+		cancel(io.ErrUnexpectedEOF)
+		if err := f.Close(); err == nil {
+			t.Errorf("%d: close of an aborted upload succeeded", size)
+		}
+		if got := string(fake.objects["lib/a.bin"]); got != "original" {
+			t.Errorf("%d: object replaced by %d bytes", size, len(got))
+		}
+	}
+	if len(fake.uploads) != 0 {
+		t.Errorf("multipart uploads left: %d", len(fake.uploads))
+	}
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/pkg"
+)
+
+const crlReloadInterval = time.Minute
+
+func setupClientAuth(cfg *conf.Conf, tlsCfg *tls.Config) error {
+	if cfg.TlsClientAuth == "" {
+		return nil
+	}
+
+	caPem, err := os.ReadFile(cfg.TlsClientCaPath)
+	if err != nil {
+		return fmt.Errorf("read client ca error: %w", err)
+	}
+	var cas []*x509.Certificate
+	for _, der := range pemBlocks(caPem, "CERTIFICATE") {
+		ca, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("parse client ca error: %w", err)
+		}
+		cas = append(cas, ca)
+	}
+	if len(cas) == 0 {
+		return errors.New("no certificate found in the client ca file")
+	}
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		pool.AddCert(ca)
+	}
+	tlsCfg.ClientCAs = pool
+	if cfg.TlsClientAuth == "require" {
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if cfg.TlsClientCrlPath != "" {
+		c := &crl{path: cfg.TlsClientCrlPath, cas: cas}
+		if err := c.load(); err != nil {
+			return err
+		}
+		pkg.SafeG(c.watch)
+		// VerifyConnection also runs on resumed sessions, unlike VerifyPeerCertificate
+		tlsCfg.VerifyConnection = c.verify
+	}
+
+	return nil
+}
+
+type revokedKey struct {
+	issuer string
+	serial string
+}
+
+// crl rejects the client certificates revoked by a certificate revocation
+// list, the file is reloaded when it changes.
+type crl struct {
+	path string
+	cas  []*x509.Certificate
+
+	mu      sync.RWMutex
+	revoked map[revokedKey]struct{}
+	modTime time.Time
+}
+
+func (c *crl) load() error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return fmt.Errorf("stat crl file error: %w", err)
+	}
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return fmt.Errorf("read crl file error: %w", err)
+	}
+
+	ders := pemBlocks(data, "X509 CRL")
+	if len(ders) == 0 {
+		// DER encoded
+		ders = [][]byte{data}
+	}
+	revoked := map[revokedKey]struct{}{}
+	for _, der := range ders {
+		rl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return fmt.Errorf("parse crl error: %w", err)
+		}
+		if err := c.checkSignature(rl); err != nil {
+			return err
+		}
+		for _, entry := range rl.RevokedCertificateEntries {
+			revoked[revokedKey{issuer: string(rl.RawIssuer), serial: entry.SerialNumber.String()}] = struct{}{}
+		}
+	}
+
+	c.mu.Lock()
+	c.revoked = revoked
+	c.modTime = info.ModTime()
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *crl) checkSignature(rl *x509.RevocationList) error {
+	for _, ca := range c.cas {
+		if string(ca.RawSubject) == string(rl.RawIssuer) && rl.CheckSignatureFrom(ca) == nil {
+			return nil
+		}
+	}
+	return errors.New("the crl is not signed by any client ca")
+}
+
+func (c *crl) verify(cs tls.ConnectionState) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			key := revokedKey{issuer: string(cert.RawIssuer), serial: cert.SerialNumber.String()}
+			if _, ok := c.revoked[key]; ok {
+				return fmt.Errorf("client certificate[%s] is revoked", cert.Subject)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *crl) watch() {
+	ticker := time.NewTicker(crlReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		info, err := os.Stat(c.path)
+		if err != nil {
+			slog.Warn("stat crl file error", slog.String("path", c.path), slog.Any("err", err))
+			continue
+		}
+		c.mu.RLock()
+		changed := !info.ModTime().Equal(c.modTime)
+		c.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := c.load(); err != nil {
+			slog.Error("failed to reload crl file", slog.String("path", c.path), slog.Any("err", err))
+			continue
+		}
+		slog.Info("crl file reloaded", slog.String("path", c.path))
+	}
+}
+
+func pemBlocks(data []byte, typ string) [][]byte {
+	var ders [][]byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return ders
+		}
+		if block.Type == typ {
+			ders = append(ders, block.Bytes)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package server
+
+import (
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/llklkl/webdav/internal/lock"
+)
+
+// lockSystems returns the lock system of a library for a request, user is the
+// owner of the files when each user of the library has its own files.
+type lockSystems interface {
+	get(r *http.Request, user string) webdav.LockSystem
+}
+
+// memLocks keeps the locks in memory, they are lost on restart.
+type memLocks struct {
+	systems sync.Map
+}
+
+func (m *memLocks) get(_ *http.Request, user string) webdav.LockSystem {
+	v, _ := m.systems.LoadOrStore(user, webdav.NewMemLS())
+	return v.(webdav.LockSystem)
+}
+
+// storeLocks keeps the locks of LOCK requests in the lock store.
+type storeLocks struct {
+	store   *lock.Store
+	library string
+}
+
+func (s *storeLocks) get(r *http.Request, user string) webdav.LockSystem {
+	return s.store.System(s.library, user, r.Method == "LOCK")
+}
+
+// lockHandler serves a library with the lock system of each request.
+type lockHandler struct {
+	handler webdav.Handler
+	locks   lockSystems
+}
+
+func (h *lockHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler := h.handler
+	handler.LockSystem = h.locks.get(r, "")
+	handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package server
+
+import (
+	"net/http"
+
+	"github.com/llklkl/webdav/internal/model"
+)
+
+// overwriteHandler marks the COPY and MOVE requests which replace their
+// destination, whose removal keeps the replaced file as a version.
+type overwriteHandler struct {
+	next http.Handler
+}
+
+func (h *overwriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// like the webdav handler, a MOVE only replaces with an explicit header
+	overwrite := r.Header.Get("Overwrite")
+	if r.Method == "COPY" && overwrite != "F" || r.Method == "MOVE" && overwrite == "T" {
+		r = r.WithContext(model.SetOverwrite(r.Context()))
+	}
+	h.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package server
+
+import (
+	"net/http"
+
+	"github.com/llklkl/webdav/internal/model"
+)
+
+// quotaHandler reports 507 Insufficient Storage when a write of the request
+// exceeds a quota.
+type quotaHandler struct {
+	next http.Handler
+}
+
+func (h *quotaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, exceeded := model.WithQuotaExceeded(r.Context())
+	h.next.ServeHTTP(&quotaWriter{ResponseWriter: w, exceeded: exceeded}, r.WithContext(ctx))
+}
+
+type quotaWriter struct {
+	http.ResponseWriter
+	exceeded    *model.QuotaExceeded
+	wroteHeader bool
+	replaced    bool
+}
+
+func (w *quotaWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	// the webdav handler reports failed writes with various statuses, e.g. 405
+	if code >= http.StatusBadRequest && w.exceeded.Exceeded() {
+		w.replaced = true
+		code = http.StatusInsufficientStorage
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.ResponseWriter.WriteHeader(code)
+		w.ResponseWriter.Write([]byte(http.StatusText(code) + "\n"))
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *quotaWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -31,6 +31,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -39,9 +40,16 @@ import (
 	"golang.org/x/net/webdav"
 
 	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/cryptfs"
 	"github.com/llklkl/webdav/internal/fs"
+	"github.com/llklkl/webdav/internal/lock"
+	"github.com/llklkl/webdav/internal/memfs"
 	"github.com/llklkl/webdav/internal/middleware"
 	"github.com/llklkl/webdav/internal/pkg"
+	"github.com/llklkl/webdav/internal/props"
+	"github.com/llklkl/webdav/internal/quota"
+	"github.com/llklkl/webdav/internal/s3fs"
+	"github.com/llklkl/webdav/internal/sftpfs"
 )
 
 type Server struct {
@@ -66,8 +74,9 @@ func NewServer(cfg *conf.Conf) (*Server, error) {
 }
 
 func (s *Server) buildServer() error {
-	s.buildWebdavHandler()
-
+	if err := s.buildWebdavHandler(); err != nil {
+		return err
+	}
 	if err := s.buildHttpServer(); err != nil {
 		return err
 	}
@@ -78,9 +87,15 @@ func (s *Server) buildServer() error {
 	return nil
 }
 
-func (s *Server) buildWebdavHandler() {
+func (s *Server) buildWebdavHandler() error {
 	for i := 0; i < len(s.cfg.Library); i++ {
+		if !s.cfg.Library[i].IsLocal() {
+			continue
+		}
 		for j := i + 1; j < len(s.cfg.Library); j++ {
+			if !s.cfg.Library[j].IsLocal() {
+				continue
+			}
 			pi := filepath.Clean(s.cfg.Library[i].MountPoint)
 			pj := filepath.Clean(s.cfg.Library[j].MountPoint)
 			if strings.HasPrefix(pi, pj) || strings.HasPrefix(pj, pi) {
@@ -92,18 +107,78 @@ func (s *Server) buildWebdavHandler() {
 		}
 	}
 
+	tracker := quota.NewTracker(s.cfg)
+	if tracker != nil {
+		tracker.Start()
+	}
+
+	deadProps, err := props.New(s.cfg)
+	if err != nil {
+		return err
+	}
+
+	var lockStore *lock.Store
+	if s.cfg.Lock != nil {
+		store, err := lock.OpenStore(s.cfg.Lock.Path)
+		if err != nil {
+			return err
+		}
+		lockStore = store
+	}
+
 	s.mux = http.NewServeMux()
 	for _, lib := range s.cfg.Library {
 		prefix := cleanPrefix(lib.Prefix)
-		s.mux.Handle(prefix, &webdav.Handler{
-			Prefix:     "",
-			FileSystem: fs.NewFs(s.cfg, lib),
-			LockSystem: webdav.NewMemLS(),
-			Logger:     nil,
-		})
+		var locks lockSystems = &memLocks{}
+		if lockStore != nil {
+			locks = &storeLocks{store: lockStore, library: lib.Name}
+		}
+		storage, err := NewStorage(lib)
+		if err != nil {
+			return err
+		}
+		cipher, err := NewCipher(lib)
+		if err != nil {
+			return err
+		}
+		fileSystem := fs.NewFs(s.cfg, lib, fs.Options{Quota: tracker, Props: deadProps, Storage: storage, Cipher: cipher})
+		if err := fileSystem.CheckQuota(); err != nil {
+			return err
+		}
+		fileSystem.StartPurge()
+		var handler http.Handler
+		if conf.IsTemplate(lib.Prefix) || conf.IsTemplate(lib.MountPoint) {
+			handler = newUserHandler(prefix, fileSystem, conf.IsTemplate(lib.MountPoint), locks)
+		} else {
+			handlerPrefix := ""
+			if lib.StripPrefix {
+				handlerPrefix = strings.TrimSuffix(prefix, "/")
+			}
+			handler = &lockHandler{
+				handler: webdav.Handler{
+					Prefix:     handlerPrefix,
+					FileSystem: fileSystem,
+				},
+				locks: locks,
+			}
+		}
+		if lib.Versions != nil {
+			handler = &overwriteHandler{next: handler}
+		}
+		if mem, ok := storage.(*memfs.FileSystem); tracker != nil || ok && mem.Limited() {
+			handler = &quotaHandler{next: handler}
+		}
+		handler = &uploadHandler{next: handler}
+		s.mux.Handle(prefix, handler)
+	}
+
+	middleWares, err := middleware.NewMiddleWares(s.cfg)
+	if err != nil {
+		return err
 	}
+	s.middleWares = middleWares
 
-	s.middleWares = middleware.NewMiddleWares(s.cfg)
+	return nil
 }
 
 func (s *Server) buildHttpsServer() error {
@@ -136,19 +211,24 @@ func (s *Server) buildHttpsServer() error {
 		return errors.New("the TLS certificate is not specified")
 	}
 
+	tlsCfg := &tls.Config{
+		Certificates: certs,
+	}
+	if err := setupClientAuth(s.cfg, tlsCfg); err != nil {
+		return err
+	}
+
 	s.httpsSvr = &http.Server{
 		Addr: s.cfg.HttpsListen,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			var h http.Handler
 			h = s.mux
-			for i := range s.middleWares {
+			for i := len(s.middleWares) - 1; i >= 0; i-- {
 				h = s.middleWares[i].Serve(h)
 			}
 			h.ServeHTTP(w, r)
 		}),
-		TLSConfig: &tls.Config{
-			Certificates: certs,
-		},
+		TLSConfig: tlsCfg,
 	}
 
 	return nil
@@ -174,6 +254,51 @@ func (s *Server) buildHttpServer() error {
 	return nil
 }
 
+// NewStorage returns the storage of a library which is not a local
+// directory, nil for a local directory.
+func NewStorage(lib *conf.LibraryConf) (webdav.FileSystem, error) {
+	switch lib.Backend {
+	case conf.BackendS3:
+		storage, err := s3fs.New(lib.S3)
+		if err != nil {
+			return nil, fmt.Errorf("library[%s]: %w", lib.Name, err)
+		}
+		return storage, nil
+	case conf.BackendSFTP:
+		storage, err := sftpfs.New(lib.SFTP)
+		if err != nil {
+			return nil, fmt.Errorf("library[%s]: %w", lib.Name, err)
+		}
+		return storage, nil
+	case conf.BackendMemory:
+		return memfs.New(lib.Memory), nil
+	}
+	return nil, nil
+}
+
+// NewCipher returns the cipher of the files of a library, nil when they are
+// not encrypted.
+func NewCipher(lib *conf.LibraryConf) (*cryptfs.Cipher, error) {
+	cfg := lib.Encryption
+	if cfg == nil {
+		return nil, nil
+	}
+	var key []byte
+	if cfg.KeyFile != "" {
+		var err error
+		if key, err = cryptfs.LoadKey(cfg.KeyFile); err != nil {
+			return nil, fmt.Errorf("library[%s]: %w", lib.Name, err)
+		}
+	} else {
+		key = cryptfs.DeriveKey(cfg.Passphrase, cfg.Salt)
+	}
+	cipher, err := cryptfs.NewCipher(key, cfg.Names)
+	if err != nil {
+		return nil, fmt.Errorf("library[%s]: %w", lib.Name, err)
+	}
+	return cipher, nil
+}
+
 func cleanPrefix(prefix string) string {
 	prefix = strings.Trim(prefix, "/")
 	prefix = "/" + prefix
@@ -184,6 +309,33 @@ func cleanPrefix(prefix string) string {
 	return prefix + "/"
 }
 
+// MatchLibrary returns the library serving the url path to the user like the
+// mux does, and the path in the library, which keeps the prefix unless the
+// library strips it.
+func MatchLibrary(cfg *conf.Conf, username, urlPath string) (*conf.LibraryConf, string, bool) {
+	urlPath = path.Clean("/" + urlPath)
+	var matched *conf.LibraryConf
+	var matchedPrefix string
+	for _, lib := range cfg.Library {
+		prefix := strings.TrimSuffix(cleanPrefix(lib.Prefix), "/")
+		prefix = strings.ReplaceAll(prefix, conf.UsernamePlaceholder, username)
+		if urlPath != prefix && !strings.HasPrefix(urlPath, prefix+"/") {
+			continue
+		}
+		if matched == nil || len(prefix) > len(matchedPrefix) {
+			matched, matchedPrefix = lib, prefix
+		}
+	}
+	if matched == nil {
+		return nil, "", false
+	}
+	if matched.StripPrefix || conf.IsTemplate(matched.Prefix) || conf.IsTemplate(matched.MountPoint) {
+		return matched, path.Clean("/" + strings.TrimPrefix(urlPath, matchedPrefix)), true
+	}
+
+	return matched, urlPath, true
+}
+
 func (s *Server) Start() {
 	if s.httpSvr != nil {
 		pkg.SafeG(func() {
@@ -0,0 +1,267 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/llklkl/webdav/conf"
+)
+
+func TestMatchLibrary(t *testing.T) {
+	cfg := &conf.Conf{
+		Library: []*conf.LibraryConf{
+			{Name: "root", Prefix: "/"},
+			{Name: "media", Prefix: "webdav", StripPrefix: true},
+			{Name: "music", Prefix: "/webdav/music/", StripPrefix: true},
+			{Name: "home", Prefix: "/home/{username}"},
+			{Name: "legacy", Prefix: "legacy"},
+		},
+	}
+	tests := []struct {
+		urlPath string
+		library string
+		name    string
+	}{
+		{"/a.txt", "root", "/a.txt"},
+		{"/webdav", "media", "/"},
+		{"/webdav/x/y.txt", "media", "/x/y.txt"},
+		{"/webdavx/y.txt", "root", "/webdavx/y.txt"},
+		{"/webdav/music/x.flac", "music", "/x.flac"},
+		{"webdav/../music/x.flac", "root", "/music/x.flac"},
+		{"/home/alice/a.txt", "home", "/a.txt"},
+		{"/home/bob/a.txt", "root", "/home/bob/a.txt"},
+		{"/legacy/x/y.txt", "legacy", "/legacy/x/y.txt"},
+	}
+	for _, tt := range tests {
+		lib, name, ok := MatchLibrary(cfg, "alice", tt.urlPath)
+		if !ok || lib.Name != tt.library || name != tt.name {
+			t.Errorf("%s: got %v %s", tt.urlPath, lib, name)
+		}
+	}
+
+	if _, _, ok := MatchLibrary(&conf.Conf{Library: cfg.Library[1:]}, "alice", "/a.txt"); ok {
+		t.Error("expect no library")
+	}
+}
+
+func TestMemoryLibrary(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(cfgPath, []byte(`
+http_enable = true
+http_listen = "127.0.0.1:0"
+
+[[library]]
+name = "tmp"
+backend = "memory"
+prefix = "tmp"
+strip_prefix = true
+[library.memory]
+size = "16B"
+
+[[scope]]
+name = "tmp"
+library = "tmp"
+include = ["dir:/"]
+exclude = ["file:*.key"]
+permission = ["*"]
+
+[[user]]
+username = "u"
+credential = "secret"
+scope = ["tmp"]
+
+[security]
+allow_plaintext_credential = true
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := conf.Parse(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := httptest.NewServer(s.httpSvr.Handler)
+	t.Cleanup(svr.Close)
+
+	do := func(method, name, body string, header ...string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, svr.URL+name, strings.NewReader(body))
+		req.SetBasicAuth("u", "secret")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	tests := []struct {
+		method string
+		name   string
+		body   string
+		header []string
+		status int
+	}{
+		{"MKCOL", "/tmp/dir", "", nil, http.StatusCreated},
+		{http.MethodPut, "/tmp/dir/a.txt", "0123456789", nil, http.StatusCreated},
+		{http.MethodPut, "/tmp/b.txt", "0123456789", nil, http.StatusInsufficientStorage},
+		{http.MethodPut, "/tmp/c.key", "", nil, http.StatusNotFound},
+		{"PROPPATCH", "/tmp/dir/a.txt", `<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:z"><D:set><D:prop><Z:color>red</Z:color></D:prop></D:set></D:propertyupdate>`, nil, http.StatusMultiStatus},
+		{"MOVE", "/tmp/dir", "", []string{"Destination", svr.URL + "/tmp/moved"}, http.StatusCreated},
+		{http.MethodGet, "/tmp/moved/a.txt", "", nil, http.StatusOK},
+		{http.MethodDelete, "/tmp/moved", "", nil, http.StatusNoContent},
+		{http.MethodPut, "/tmp/b.txt", "0123456789", nil, http.StatusCreated},
+		{"PROPPATCH", "/tmp/b.txt", `<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:z"><D:set><D:prop><Z:color>blue</Z:color></D:prop></D:set></D:propertyupdate>`, nil, http.StatusMultiStatus},
+	}
+	for _, tt := range tests {
+		if status, body := do(tt.method, tt.name, tt.body, tt.header...); status != tt.status {
+			t.Errorf("%s %s: %d %s, want %d", tt.method, tt.name, status, body, tt.status)
+		}
+	}
+
+	_, body := do("PROPFIND", "/tmp/b.txt", "", "Depth", "0")
+	if !strings.Contains(body, "<D:getcontentlength>10</D:getcontentlength>") || !strings.Contains(body, ">blue</") {
+		t.Errorf("propfind: %s", body)
+	}
+}
+
+func TestAnonymousReadOnly(t *testing.T) {
+	cfgPath := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(cfgPath, []byte(`
+http_enable = true
+http_listen = "127.0.0.1:0"
+
+[[library]]
+name = "tmp"
+backend = "memory"
+prefix = "tmp"
+strip_prefix = true
+
+[[scope]]
+name = "all"
+library = "tmp"
+include = ["dir:/"]
+permission = ["*"]
+
+[[scope]]
+name = "public"
+library = "tmp"
+include = ["dir:/"]
+permission = ["read"]
+
+[[user]]
+username = "u"
+credential = "secret"
+scope = ["all"]
+
+[security]
+allow_plaintext_credential = true
+
+[anonymous]
+scope = ["public"]
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := conf.Parse(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := httptest.NewServer(s.httpSvr.Handler)
+	t.Cleanup(svr.Close)
+
+	do := func(method, name string, auth bool) *http.Response {
+		t.Helper()
+		var body io.Reader
+		if method == http.MethodPut {
+			body = strings.NewReader("data")
+		}
+		req, _ := http.NewRequest(method, svr.URL+name, body)
+		if auth {
+			req.SetBasicAuth("u", "secret")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := do(http.MethodPut, "/tmp/a.txt", false); resp.StatusCode != http.StatusUnauthorized ||
+		resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("anonymous put: %d %v", resp.StatusCode, resp.Header)
+	}
+	if resp := do(http.MethodPut, "/tmp/a.txt", true); resp.StatusCode != http.StatusCreated {
+		t.Errorf("put: %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodGet, "/tmp/a.txt", false); resp.StatusCode != http.StatusOK {
+		t.Errorf("anonymous get: %d", resp.StatusCode)
+	}
+	if resp := do("MKCOL", "/tmp/dir", false); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous mkcol: %d", resp.StatusCode)
+	}
+}
+
+func TestUploadHandler(t *testing.T) {
+	var cause error
+	h := &uploadHandler{next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		cause = context.Cause(r.Context())
+	})}
+
+	req := httptest.NewRequest(http.MethodPut, "/a.txt", strings.NewReader("complete"))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if cause != nil {
+		t.Errorf("complete upload aborted: %v", cause)
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/a.txt", nil)
+	req.Body = io.NopCloser(io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(io.ErrUnexpectedEOF)))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if !errors.Is(cause, io.ErrUnexpectedEOF) {
+		t.Errorf("failed upload not aborted: %v", cause)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/fs"
+	"github.com/llklkl/webdav/internal/model"
+)
+
+// userHandler serves a library whose prefix or mount point contains the
+// username, only the user itself may access the prefix with its name.
+type userHandler struct {
+	prefix     string
+	fileSystem *fs.Fs
+	// each user has its own files and locks when the mount point is a template
+	perUserLock bool
+	locks       lockSystems
+}
+
+func newUserHandler(prefix string, fileSystem *fs.Fs, perUserLock bool, locks lockSystems) *userHandler {
+	return &userHandler{
+		prefix:      prefix,
+		fileSystem:  fileSystem,
+		perUserLock: perUserLock,
+		locks:       locks,
+	}
+}
+
+func (h *userHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user := model.GetUser(r.Context())
+	if user == nil || user.Anonymous ||
+		(conf.IsTemplate(h.prefix) && r.PathValue("username") != user.Username) {
+		model.MarkDenied(r.Context())
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	owner := ""
+	if h.perUserLock {
+		owner = user.Username
+	}
+	handler := &webdav.Handler{
+		Prefix:     strings.TrimSuffix(strings.ReplaceAll(h.prefix, conf.UsernamePlaceholder, user.Username), "/"),
+		FileSystem: h.fileSystem,
+		LockSystem: h.locks.get(r, owner),
+	}
+	handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package sftpfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/pkg/sftp"
+)
+
+// file is a regular file on the host.
+type file struct {
+	*sftp.File
+}
+
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.Name(), Err: errors.New("not a directory")}
+}
+
+// dirFile lists the directory on the first Readdir.
+type dirFile struct {
+	ctx     context.Context
+	client  *sftp.Client
+	path    string
+	info    os.FileInfo
+	entries []os.FileInfo
+	listed  bool
+}
+
+func (f *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.listed {
+		entries, err := f.client.ReadDirContext(f.ctx, f.path)
+		if err != nil {
+			return nil, err
+		}
+		f.entries, f.listed = entries, true
+	}
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(f.entries))
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+func (f *dirFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *dirFile) Read(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: f.path, Err: errors.New("is a directory")}
+}
+
+func (f *dirFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (f *dirFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.path, Err: errors.New("is a directory")}
+}
+
+func (f *dirFile) Close() error {
+	return nil
+}
@@ -0,0 +1,294 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+// Package sftpfs implements a webdav.FileSystem over a directory of a remote
+// host, which is accessed by SFTP through a pool of SSH connections.
+package sftpfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/webdav"
+
+	"github.com/llklkl/webdav/conf"
+	"github.com/llklkl/webdav/internal/pkg"
+)
+
+const (
+	defaultPort     = "22"
+	defaultMaxConns = 4
+	dialTimeout     = 10 * time.Second
+)
+
+type FileSystem struct {
+	addr   string
+	config *ssh.ClientConfig
+	root   string
+
+	next  atomic.Uint32
+	slots []*slot
+}
+
+// slot holds a connection of the pool, which is dialed on first use and
+// again after it is lost.
+type slot struct {
+	mu   sync.Mutex
+	conn *conn
+}
+
+type conn struct {
+	ssh  *ssh.Client
+	sftp *sftp.Client
+}
+
+func New(cfg *conf.SFTPConf) (*FileSystem, error) {
+	hostKey, err := hostKeyCallback(cfg.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	var auth []ssh.AuthMethod
+	if cfg.PrivateKeyPath != "" {
+		signer, err := loadPrivateKey(cfg.PrivateKeyPath, cfg.PrivateKeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		auth = append(auth, ssh.Password(cfg.Password))
+	}
+
+	addr := cfg.Address
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, defaultPort)
+	}
+	fsys := &FileSystem{
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            cfg.Username,
+			Auth:            auth,
+			HostKeyCallback: hostKey,
+			Timeout:         dialTimeout,
+		},
+		root:  path.Clean(cfg.Root),
+		slots: make([]*slot, cfg.MaxConns),
+	}
+	if len(fsys.slots) == 0 {
+		fsys.slots = make([]*slot, defaultMaxConns)
+	}
+	for i := range fsys.slots {
+		fsys.slots[i] = &slot{}
+	}
+
+	return fsys, nil
+}
+
+// hostKeyCallback accepts only the pinned key, or a key with the pinned
+// fingerprint.
+func hostKeyCallback(pinned string) (ssh.HostKeyCallback, error) {
+	if strings.HasPrefix(pinned, "SHA256:") {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if fingerprint := ssh.FingerprintSHA256(key); fingerprint != pinned {
+				return fmt.Errorf("the host key %s of %s is not pinned", fingerprint, hostname)
+			}
+			return nil
+		}, nil
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pinned))
+	if err != nil {
+		return nil, fmt.Errorf("parse sftp host key error: %w", err)
+	}
+	return ssh.FixedHostKey(key), nil
+}
+
+func loadPrivateKey(name, passphrase string) (ssh.Signer, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read sftp private key error: %w", err)
+	}
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse sftp private key error: %w", err)
+	}
+	return signer, nil
+}
+
+// client returns the connections of the pool in turn.
+func (fsys *FileSystem) client() (*sftp.Client, error) {
+	s := fsys.slots[fsys.next.Add(1)%uint32(len(fsys.slots))]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		return s.conn.sftp, nil
+	}
+
+	sshClient, err := ssh.Dial("tcp", fsys.addr, fsys.config)
+	if err != nil {
+		return nil, fmt.Errorf("connect sftp host[%s] error: %w", fsys.addr, err)
+	}
+	sftpClient, err := sftp.NewClient(sshClient, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		_ = sshClient.Close()
+		return nil, fmt.Errorf("start sftp session with host[%s] error: %w", fsys.addr, err)
+	}
+	c := &conn{ssh: sshClient, sftp: sftpClient}
+	s.conn = c
+	pkg.SafeG(func() {
+		_ = sshClient.Wait()
+		_ = sftpClient.Close()
+		s.mu.Lock()
+		if s.conn == c {
+			s.conn = nil
+		}
+		s.mu.Unlock()
+	})
+	return sftpClient, nil
+}
+
+// Close closes the connections of the pool.
+func (fsys *FileSystem) Close() error {
+	for _, s := range fsys.slots {
+		s.mu.Lock()
+		if s.conn != nil {
+			_ = s.conn.ssh.Close()
+			s.conn = nil
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// resolve returns the path of the file on the host, which can not escape the
+// root.
+func (fsys *FileSystem) resolve(name string) string {
+	return path.Join(fsys.root, path.Clean("/"+name))
+}
+
+func (fsys *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	client, err := fsys.client()
+	if err != nil {
+		return err
+	}
+	return client.Mkdir(fsys.resolve(name))
+}
+
+func (fsys *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	client, err := fsys.client()
+	if err != nil {
+		return nil, err
+	}
+	p := fsys.resolve(name)
+	if flag&os.O_CREATE == 0 {
+		info, err := client.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+				return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+			}
+			return &dirFile{ctx: ctx, client: client, path: p, info: info}, nil
+		}
+	}
+
+	f, err := client.OpenFile(p, flag)
+	if err != nil {
+		return nil, err
+	}
+	return &file{File: f}, nil
+}
+
+func (fsys *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	p := fsys.resolve(name)
+	if p == fsys.root {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrInvalid}
+	}
+	client, err := fsys.client()
+	if err != nil {
+		return err
+	}
+	if err := removeAll(ctx, client, p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// removeAll removes the directory depth-first, the symbolic links are removed
+// without following them.
+func removeAll(ctx context.Context, client *sftp.Client, p string) error {
+	info, err := client.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return client.Remove(p)
+	}
+	entries, err := client.ReadDirContext(ctx, p)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := removeAll(ctx, client, path.Join(p, entry.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return client.RemoveDirectory(p)
+}
+
+func (fsys *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldPath, newPath := fsys.resolve(oldName), fsys.resolve(newName)
+	if oldPath == fsys.root || newPath == fsys.root {
+		return &os.PathError{Op: "rename", Path: oldName, Err: os.ErrInvalid}
+	}
+	client, err := fsys.client()
+	if err != nil {
+		return err
+	}
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(oldPath, newPath)
+	}
+	return client.Rename(oldPath, newPath)
+}
+
+func (fsys *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	client, err := fsys.client()
+	if err != nil {
+		return nil, err
+	}
+	return client.Stat(fsys.resolve(name))
+}
@@ -0,0 +1,330 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package sftpfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/llklkl/webdav/conf"
+)
+
+// testServer is an in-process SSH server with the sftp subsystem, which
+// serves the local file system.
+type testServer struct {
+	addr    string
+	hostKey ssh.PublicKey
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newTestServer(t *testing.T, password string, userKey ssh.PublicKey) *testServer {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if password != "" && c.User() == "u" && string(pass) == password {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if userKey != nil && c.User() == "u" && bytes.Equal(key.Marshal(), userKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &testServer{addr: ln.Addr().String(), hostKey: signer.PublicKey()}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, c)
+			s.mu.Unlock()
+			go s.serve(c, config)
+		}
+	}()
+	t.Cleanup(s.closeConns)
+	return s
+}
+
+func (s *testServer) serve(c net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					return
+				}
+				_ = server.Serve()
+				_ = channel.Close()
+			}
+		}()
+	}
+}
+
+func (s *testServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		_ = c.Close()
+	}
+	s.conns = nil
+}
+
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func newTestFs(t *testing.T, cfg *conf.SFTPConf) *FileSystem {
+	fsys, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fsys.Close() })
+	return fsys
+}
+
+func TestFiles(t *testing.T) {
+	srv := newTestServer(t, "secret", nil)
+	root := t.TempDir()
+	fsys := newTestFs(t, &conf.SFTPConf{
+		Address:  srv.addr,
+		Username: "u",
+		Password: "secret",
+		HostKey:  authorizedKey(srv.hostKey),
+		Root:     root,
+		MaxConns: 2,
+	})
+	ctx := context.Background()
+
+	if err := fsys.Mkdir(ctx, "/docs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Mkdir(ctx, "/a/b", 0755); !os.IsNotExist(err) {
+		t.Errorf("mkdir without parent: %v", err)
+	}
+	f, err := fsys.OpenFile(ctx, "/docs/x.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "docs/x.txt")); string(data) != "hello world" {
+		t.Fatalf("remote file: %q", data)
+	}
+
+	f, err = fsys.OpenFile(ctx, "/../docs/x.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(6, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(f); string(data) != "world" {
+		t.Errorf("read from offset: %q", data)
+	}
+	f.Close()
+
+	dir, err := fsys.OpenFile(ctx, "/docs", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := dir.Readdir(-1)
+	if err != nil || len(entries) != 1 || entries[0].Name() != "x.txt" || entries[0].Size() != 11 {
+		t.Errorf("readdir: %v %v", entries, err)
+	}
+	if _, err := fsys.OpenFile(ctx, "/docs", os.O_RDWR, 0); err == nil {
+		t.Errorf("opened a directory for writing")
+	}
+
+	if err := fsys.Rename(ctx, "/docs", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := fsys.Stat(ctx, "/moved/x.txt"); err != nil || info.Size() != 11 {
+		t.Errorf("stat moved: %v %v", info, err)
+	}
+	if _, err := fsys.Stat(ctx, "/docs"); !os.IsNotExist(err) {
+		t.Errorf("stat renamed: %v", err)
+	}
+
+	// a symbolic link is removed without removing its target
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "keep"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "moved/link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.RemoveAll(ctx, "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "moved")); !os.IsNotExist(err) {
+		t.Errorf("directory left: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "keep")); err != nil {
+		t.Errorf("target of link removed: %v", err)
+	}
+	if err := fsys.RemoveAll(ctx, "/"); err == nil {
+		t.Errorf("removed the root")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("pass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, _ := ssh.NewSignerFromKey(priv)
+	srv := newTestServer(t, "", signer.PublicKey())
+	root := t.TempDir()
+
+	cfg := &conf.SFTPConf{
+		Address:              srv.addr,
+		Username:             "u",
+		PrivateKeyPath:       keyPath,
+		PrivateKeyPassphrase: "pass",
+		HostKey:              ssh.FingerprintSHA256(srv.hostKey),
+		Root:                 root,
+	}
+	if _, err := newTestFs(t, cfg).Stat(context.Background(), "/"); err != nil {
+		t.Errorf("public key auth: %v", err)
+	}
+
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ssh.NewPublicKey(other)
+	cfg.HostKey = authorizedKey(otherKey)
+	if _, err := newTestFs(t, cfg).Stat(context.Background(), "/"); err == nil {
+		t.Errorf("connected to a host with another key")
+	}
+
+	cfg.HostKey = ssh.FingerprintSHA256(srv.hostKey)
+	cfg.PrivateKeyPath, cfg.Password = "", "wrong"
+	if _, err := newTestFs(t, cfg).Stat(context.Background(), "/"); err == nil {
+		t.Errorf("authenticated by a wrong password")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	srv := newTestServer(t, "secret", nil)
+	fsys := newTestFs(t, &conf.SFTPConf{
+		Address:  srv.addr,
+		Username: "u",
+		Password: "secret",
+		HostKey:  authorizedKey(srv.hostKey),
+		Root:     t.TempDir(),
+		MaxConns: 2,
+	})
+	ctx := context.Background()
+	for range 4 {
+		if _, err := fsys.Stat(ctx, "/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv.mu.Lock()
+	dialed := len(srv.conns)
+	srv.mu.Unlock()
+	if dialed != 2 {
+		t.Errorf("dialed %d connections", dialed)
+	}
+
+	srv.closeConns()
+	// the lost connections are dialed again
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var errs []error
+		for range 2 {
+			if _, err := fsys.Stat(ctx, "/"); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(errs) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not reconnected: %v", errs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.conns) == 0 {
+		t.Errorf("no new connection")
+	}
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+// Package trash keeps the deleted files of a library in its .trash directory.
+// An item is the deleted file or directory, stored with its original name in
+// .trash/<id>/, and its metadata in .trash/<id>.json.
+package trash
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// Dir is the trash directory in the root of a library.
+const Dir = "/.trash"
+
+// DefaultRetention is how long the items are kept when not configured.
+const DefaultRetention = 30 * 24 * time.Hour
+
+const metaExt = ".json"
+
+type Item struct {
+	ID string `json:"id"`
+	// the original path of the file in the library
+	Path string `json:"path"`
+	// who deleted the file, empty for the anonymous user
+	User      string    `json:"user"`
+	DeletedAt time.Time `json:"deleted_at"`
+	// the file was replaced by an upload, instead of deleted
+	Overwritten bool `json:"overwritten,omitempty"`
+	IsDir       bool `json:"is_dir"`
+}
+
+// Name returns the path of the deleted file in the trash.
+func (item *Item) Name() string {
+	return path.Join(Dir, item.ID, path.Base(item.Path))
+}
+
+// Contains reports whether the path is in the trash directory.
+func Contains(name string) bool {
+	return name == Dir || strings.HasPrefix(name, Dir+"/")
+}
+
+// Split returns the id of the item of a path in the trash, and the path
+// within the item, e.g. /a.txt for /.trash/<id>/a.txt.
+func Split(name string) (id, rest string) {
+	name = strings.TrimPrefix(strings.TrimPrefix(name, Dir), "/")
+	id, rest, _ = strings.Cut(name, "/")
+	if rest != "" {
+		rest = "/" + rest
+	}
+	return id, rest
+}
+
+func validID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, "/\\")
+}
+
+// newID returns an id which sorts by the deletion time.
+func newID(now time.Time) string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return now.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+// Bin manages the trash of a root of a library.
+type Bin struct {
+	fsys webdav.FileSystem
+}
+
+func New(fsys webdav.FileSystem) *Bin {
+	return &Bin{fsys: fsys}
+}
+
+// Ensure creates the trash directory.
+func (b *Bin) Ensure(ctx context.Context) error {
+	if _, err := b.fsys.Stat(ctx, Dir); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	if err := b.fsys.Mkdir(ctx, Dir, 0o700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Move moves the file into the trash.
+func (b *Bin) Move(ctx context.Context, name, user string, overwritten bool) (*Item, error) {
+	if name == "/" || Contains(name) {
+		return nil, &os.PathError{Op: "trash", Path: name, Err: os.ErrInvalid}
+	}
+	info, err := b.fsys.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.Ensure(ctx); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	item := &Item{
+		ID:          newID(now),
+		Path:        name,
+		User:        user,
+		DeletedAt:   now,
+		Overwritten: overwritten,
+		IsDir:       info.IsDir(),
+	}
+	if err := b.fsys.Mkdir(ctx, path.Join(Dir, item.ID), 0o700); err != nil {
+		return nil, err
+	}
+	if err := b.writeItem(ctx, item); err != nil {
+		_ = b.Purge(ctx, item.ID)
+		return nil, err
+	}
+	if err := b.fsys.Rename(ctx, name, item.Name()); err != nil {
+		_ = b.Purge(ctx, item.ID)
+		return nil, err
+	}
+	return item, nil
+}
+
+func (b *Bin) writeItem(ctx context.Context, item *Item) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	f, err := b.fsys.OpenFile(ctx, path.Join(Dir, item.ID+metaExt), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Get returns the item, the error is os.ErrNotExist when it is not found.
+func (b *Bin) Get(ctx context.Context, id string) (*Item, error) {
+	if !validID(id) {
+		return nil, &os.PathError{Op: "trash", Path: id, Err: os.ErrNotExist}
+	}
+	f, err := b.fsys.OpenFile(ctx, path.Join(Dir, id+metaExt), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	item := &Item{}
+	if err := json.Unmarshal(data, item); err != nil {
+		return nil, fmt.Errorf("parse trash item[%s] error: %w", id, err)
+	}
+	item.ID = id
+	return item, nil
+}
+
+// List returns the items, the latest first.
+func (b *Bin) List(ctx context.Context) ([]*Item, error) {
+	f, err := b.fsys.OpenFile(ctx, Dir, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	infos, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var items []*Item
+	for _, info := range infos {
+		id, ok := strings.CutSuffix(info.Name(), metaExt)
+		if !ok || info.IsDir() {
+			continue
+		}
+		item, err := b.Get(ctx, id)
+		if err != nil {
+			continue
+		}
+		items = append(items, item)
+	}
+	slices.SortFunc(items, func(a, b *Item) int { return b.DeletedAt.Compare(a.DeletedAt) })
+	return items, nil
+}
+
+// Restore moves the item back to the path, its original path when to is
+// empty. An existing file is not replaced.
+func (b *Bin) Restore(ctx context.Context, item *Item, to string) error {
+	if to == "" {
+		to = item.Path
+	}
+	if to == "/" || Contains(to) {
+		return &os.PathError{Op: "restore", Path: to, Err: os.ErrInvalid}
+	}
+	if _, err := b.fsys.Stat(ctx, to); err == nil {
+		return &os.PathError{Op: "restore", Path: to, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := b.fsys.Rename(ctx, item.Name(), to); err != nil {
+		return err
+	}
+	return b.Purge(ctx, item.ID)
+}
+
+// Purge removes the item permanently.
+func (b *Bin) Purge(ctx context.Context, id string) error {
+	if !validID(id) {
+		return &os.PathError{Op: "purge", Path: id, Err: os.ErrNotExist}
+	}
+	return errors.Join(
+		b.fsys.RemoveAll(ctx, path.Join(Dir, id)),
+		b.fsys.RemoveAll(ctx, path.Join(Dir, id+metaExt)),
+	)
+}
+
+// Expire purges the items deleted before the time, and returns how many are
+// purged.
+func (b *Bin) Expire(ctx context.Context, before time.Time) (int, error) {
+	items, err := b.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, item := range items {
+		if !item.DeletedAt.Before(before) {
+			continue
+		}
+		if err := b.Purge(ctx, item.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package trash
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func writeFile(t *testing.T, fsys webdav.FileSystem, name, data string) {
+	t.Helper()
+	f, err := fsys.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestBin(t *testing.T) {
+	ctx := context.Background()
+	fsys := webdav.NewMemFS()
+	bin := New(fsys)
+	if err := fsys.Mkdir(ctx, "/docs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fsys, "/docs/a.txt", "content")
+
+	file, err := bin.Move(ctx, "/docs/a.txt", "alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := bin.Move(ctx, "/docs", "bob", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat(ctx, "/docs"); !os.IsNotExist(err) {
+		t.Errorf("stat deleted: %v", err)
+	}
+	if _, err := bin.Move(ctx, "/.trash", "bob", false); err == nil {
+		t.Errorf("moved the trash into itself")
+	}
+
+	items, err := bin.List(ctx)
+	if err != nil || len(items) != 2 || items[0].ID != dir.ID || !items[0].IsDir || items[1].User != "alice" {
+		t.Fatalf("list: %v %v", items, err)
+	}
+	if id, rest := Split(file.Name()); id != file.ID || rest != "/a.txt" {
+		t.Errorf("split: %s %s", id, rest)
+	}
+
+	// the parent of the original path is deleted too
+	if err := bin.Restore(ctx, file, ""); !os.IsNotExist(err) {
+		t.Errorf("restore without parent: %v", err)
+	}
+	if err := bin.Restore(ctx, dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := bin.Restore(ctx, file, ""); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fsys.OpenFile(ctx, "/docs/a.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "content" {
+		t.Errorf("restored content: %q", data)
+	}
+	if items, _ := bin.List(ctx); len(items) != 0 {
+		t.Errorf("items left: %v", items)
+	}
+
+	writeFile(t, fsys, "/b.txt", "b")
+	if _, err := bin.Move(ctx, "/docs/a.txt", "alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := bin.Restore(ctx, file, "/b.txt"); err == nil {
+		t.Errorf("restore replaced a file")
+	}
+	if n, err := bin.Expire(ctx, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("expire recent: %d %v", n, err)
+	}
+	if n, err := bin.Expire(ctx, time.Now().Add(time.Second)); err != nil || n != 1 {
+		t.Errorf("expire: %d %v", n, err)
+	}
+	info, err := fsys.Stat(ctx, Dir)
+	if err != nil || !info.IsDir() {
+		t.Fatalf("stat trash: %v", err)
+	}
+	d, _ := fsys.OpenFile(ctx, Dir, os.O_RDONLY, 0)
+	if infos, _ := d.Readdir(-1); len(infos) != 0 {
+		t.Errorf("files left in trash: %v", infos)
+	}
+	d.Close()
+}
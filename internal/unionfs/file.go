@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package unionfs
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"golang.org/x/net/webdav"
+)
+
+// dirFile lists the merged entries of a directory.
+type dirFile struct {
+	webdav.File
+	fsys    *FileSystem
+	ctx     context.Context
+	name    string
+	entries []os.FileInfo
+	listed  bool
+}
+
+func (f *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.listed {
+		entries, err := f.fsys.readDir(f.ctx, f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.entries, f.listed = entries, true
+	}
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(f.entries))
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+// copyUpFile reads a file of a lower layer, which is copied up on the first
+// write.
+type copyUpFile struct {
+	webdav.File
+	fsys   *FileSystem
+	ctx    context.Context
+	name   string
+	flag   int
+	copied bool
+}
+
+func (f *copyUpFile) Write(p []byte) (int, error) {
+	if !f.copied {
+		offset, err := f.File.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		if err := f.fsys.copyUp(f.ctx, f.name); err != nil {
+			return 0, err
+		}
+		upper, err := f.fsys.upper.OpenFile(f.ctx, f.name, f.flag, 0)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := upper.Seek(offset, io.SeekStart); err != nil {
+			upper.Close()
+			return 0, err
+		}
+		f.File.Close()
+		f.File, f.copied = upper, true
+	}
+	return f.File.Write(p)
+}
@@ -0,0 +1,416 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+// Package unionfs stacks read only layers below a writable upper layer.
+//
+// A file is read from the first layer which has it, the upper layer first, and
+// the listing of a directory merges all layers. Writes go to the upper layer:
+// a file of a lower layer is copied up before it is modified or renamed, and a
+// deleted file is hidden by a whiteout .wh.<name> beside it. A directory which
+// is created over a deleted one is marked opaque by .wh..wh..opq, which hides
+// the directories of the lower layers.
+package unionfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueName     = ".wh..wh..opq"
+)
+
+// Reserved reports whether the name is a marker of the upper layer, which can
+// not be accessed through the union.
+func Reserved(name string) bool {
+	return strings.HasPrefix(path.Base(name), whiteoutPrefix)
+}
+
+func whiteout(name string) string {
+	return path.Join(path.Dir(name), whiteoutPrefix+path.Base(name))
+}
+
+// notFound reports whether the error means the layer does not have the file,
+// e.g. a parent is a file.
+func notFound(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR)
+}
+
+type FileSystem struct {
+	upper webdav.FileSystem
+	lower []webdav.FileSystem
+}
+
+// New returns the union of the layers, the first lower layer has precedence.
+func New(upper webdav.FileSystem, lower ...webdav.FileSystem) *FileSystem {
+	return &FileSystem{upper: upper, lower: lower}
+}
+
+func (u *FileSystem) exists(ctx context.Context, fsys webdav.FileSystem, name string) bool {
+	_, err := fsys.Stat(ctx, name)
+	return err == nil
+}
+
+// hidden reports whether the files of the lower layers at name are hidden by
+// the upper layer, i.e. name or a parent is deleted, a parent is opaque, or a
+// parent is replaced by a file.
+func (u *FileSystem) hidden(ctx context.Context, name string) bool {
+	for p := name; p != "/"; p = path.Dir(p) {
+		if u.exists(ctx, u.upper, whiteout(p)) || u.exists(ctx, u.upper, path.Join(path.Dir(p), opaqueName)) {
+			return true
+		}
+		if p != name {
+			if info, err := u.upper.Stat(ctx, p); err == nil && !info.IsDir() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// find returns the layer which serves name, and the file info of name.
+func (u *FileSystem) find(ctx context.Context, name string) (webdav.FileSystem, os.FileInfo, error) {
+	if Reserved(name) {
+		return nil, nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	info, err := u.upper.Stat(ctx, name)
+	if err == nil {
+		return u.upper, info, nil
+	}
+	if !notFound(err) {
+		return nil, nil, err
+	}
+	if !u.hidden(ctx, name) {
+		for _, fsys := range u.lower {
+			if info, err := fsys.Stat(ctx, name); err == nil {
+				return fsys, info, nil
+			}
+		}
+	}
+	return nil, nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+// inLower reports whether a lower layer has a visible file at name.
+func (u *FileSystem) inLower(ctx context.Context, name string) bool {
+	if u.hidden(ctx, name) {
+		return false
+	}
+	for _, fsys := range u.lower {
+		if u.exists(ctx, fsys, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// findDir returns an error unless name is a directory of the union.
+func (u *FileSystem) findDir(ctx context.Context, name string) error {
+	_, info, err := u.find(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &os.PathError{Op: "open", Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// copyUpDir creates the directory of the union and its parents in the upper
+// layer.
+func (u *FileSystem) copyUpDir(ctx context.Context, name string) error {
+	if info, err := u.upper.Stat(ctx, name); err == nil {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	_, info, err := u.find(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := u.copyUpDir(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	if err := u.upper.Mkdir(ctx, name, info.Mode().Perm()); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// copyUp copies the file, or the directory with its contents, from the lower
+// layers to the upper layer.
+func (u *FileSystem) copyUp(ctx context.Context, name string) error {
+	layer, info, err := u.find(ctx, name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if err := u.copyUpDir(ctx, name); err != nil {
+			return err
+		}
+		infos, err := u.readDir(ctx, name)
+		if err != nil {
+			return err
+		}
+		for _, child := range infos {
+			if err := u.copyUp(ctx, path.Join(name, child.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if layer == u.upper {
+		return nil
+	}
+	if err := u.copyUpDir(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	src, err := layer.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := u.upper.OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// created clears the whiteout of a file created in the upper layer, a
+// directory over a directory of the lower layers is marked opaque.
+func (u *FileSystem) created(ctx context.Context, name string, isDir bool) error {
+	if u.exists(ctx, u.upper, whiteout(name)) {
+		if err := u.upper.RemoveAll(ctx, whiteout(name)); err != nil {
+			return err
+		}
+	}
+	if !isDir {
+		return nil
+	}
+	for _, fsys := range u.lower {
+		if info, err := fsys.Stat(ctx, name); err == nil && info.IsDir() {
+			return u.mark(ctx, path.Join(name, opaqueName))
+		}
+	}
+	return nil
+}
+
+// mark creates an empty marker in the upper layer.
+func (u *FileSystem) mark(ctx context.Context, name string) error {
+	f, err := u.upper.OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// removed hides the files of the lower layers at name after it is removed
+// from the upper layer.
+func (u *FileSystem) removed(ctx context.Context, name string) error {
+	if !u.inLower(ctx, name) {
+		return nil
+	}
+	if err := u.copyUpDir(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	return u.mark(ctx, whiteout(name))
+}
+
+func (u *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if Reserved(name) {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+	}
+	if _, _, err := u.find(ctx, name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if err := u.findDir(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	if err := u.copyUpDir(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	if err := u.upper.Mkdir(ctx, name, perm); err != nil {
+		return err
+	}
+	return u.created(ctx, name, true)
+}
+
+func (u *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if Reserved(name) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	layer, info, err := u.find(ctx, name)
+	if err != nil && !notFound(err) {
+		return nil, err
+	}
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	switch {
+	case err != nil:
+		if !write || flag&os.O_CREATE == 0 {
+			return nil, err
+		}
+		if err := u.findDir(ctx, path.Dir(name)); err != nil {
+			return nil, err
+		}
+	case info.IsDir():
+		f, err := layer.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &dirFile{File: f, fsys: u, ctx: ctx, name: name}, nil
+	case !write || layer == u.upper:
+		return layer.OpenFile(ctx, name, flag, perm)
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case flag&os.O_TRUNC == 0:
+		// the file is copied up on the first write, e.g. not by PROPPATCH
+		f, err := layer.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &copyUpFile{File: f, fsys: u, ctx: ctx, name: name, flag: flag &^ (os.O_CREATE | os.O_EXCL)}, nil
+	}
+
+	if err := u.copyUpDir(ctx, path.Dir(name)); err != nil {
+		return nil, err
+	}
+	f, err := u.upper.OpenFile(ctx, name, flag|os.O_CREATE, perm)
+	if err != nil {
+		return nil, err
+	}
+	if err := u.created(ctx, name, false); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (u *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	if Reserved(name) {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	if name == "/" {
+		return os.ErrInvalid
+	}
+	if _, _, err := u.find(ctx, name); err != nil {
+		if notFound(err) {
+			return nil
+		}
+		return err
+	}
+	if err := u.upper.RemoveAll(ctx, name); err != nil {
+		return err
+	}
+	return u.removed(ctx, name)
+}
+
+func (u *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	if Reserved(oldName) || Reserved(newName) {
+		return &os.PathError{Op: "rename", Path: newName, Err: os.ErrPermission}
+	}
+	_, info, err := u.find(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if err := u.findDir(ctx, path.Dir(newName)); err != nil {
+		return err
+	}
+	if _, _, err := u.find(ctx, newName); err == nil {
+		if err := u.RemoveAll(ctx, newName); err != nil {
+			return err
+		}
+	}
+	if err := u.copyUp(ctx, oldName); err != nil {
+		return err
+	}
+	if err := u.copyUpDir(ctx, path.Dir(newName)); err != nil {
+		return err
+	}
+	if err := u.upper.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	if err := u.created(ctx, newName, info.IsDir()); err != nil {
+		return err
+	}
+	return u.removed(ctx, oldName)
+}
+
+func (u *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	_, info, err := u.find(ctx, name)
+	return info, err
+}
+
+// readDir merges the entries of the directory in all layers, without the
+// markers and the deleted files.
+func (u *FileSystem) readDir(ctx context.Context, name string) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+	seen := map[string]bool{}
+	opaque := false
+	layers := u.lower
+	if u.hidden(ctx, name) {
+		layers = nil
+	}
+	for i, fsys := range append([]webdav.FileSystem{u.upper}, layers...) {
+		if i > 0 && opaque {
+			break
+		}
+		f, err := fsys.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if notFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			// a file of the layer is shadowed by the directory
+			continue
+		}
+		for _, info := range entries {
+			switch entry := info.Name(); {
+			case i == 0 && entry == opaqueName:
+				opaque = true
+			case i == 0 && strings.HasPrefix(entry, whiteoutPrefix):
+				seen[entry[len(whiteoutPrefix):]] = true
+			case strings.HasPrefix(entry, whiteoutPrefix) || seen[entry]:
+			default:
+				seen[entry] = true
+				infos = append(infos, info)
+			}
+		}
+	}
+	return infos, nil
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package unionfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func putFile(t *testing.T, fsys webdav.FileSystem, name, data string) {
+	t.Helper()
+	f, err := fsys.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getFile(fsys webdav.FileSystem, name string) (string, error) {
+	f, err := fsys.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	return string(data), err
+}
+
+func list(t *testing.T, fsys webdav.FileSystem, name string) []string {
+	t.Helper()
+	f, err := fsys.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	slices.Sort(names)
+	return names
+}
+
+// newUnion returns the union of an empty upper layer, and two lower layers
+// with /data/a.txt, /data/b.txt and /data/sub/c.txt.
+func newUnion(t *testing.T) (*FileSystem, string) {
+	t.Helper()
+	upper, golden, patch := t.TempDir(), t.TempDir(), t.TempDir()
+	for dir, files := range map[string]map[string]string{
+		golden: {"data/a.txt": "golden a", "data/b.txt": "golden b", "data/sub/c.txt": "golden c"},
+		patch:  {"data/a.txt": "patched a"},
+	} {
+		for name, data := range files {
+			if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return New(webdav.Dir(upper), webdav.Dir(patch), webdav.Dir(golden)), upper
+}
+
+func TestRead(t *testing.T) {
+	u, upper := newUnion(t)
+	if got, err := getFile(u, "/data/a.txt"); err != nil || got != "patched a" {
+		t.Errorf("read a: %q %v", got, err)
+	}
+	putFile(t, u, "/data/b.txt", "team b")
+	if got, _ := getFile(u, "/data/b.txt"); got != "team b" {
+		t.Errorf("read b: %q", got)
+	}
+	if got := list(t, u, "/data"); !slices.Equal(got, []string{"a.txt", "b.txt", "sub"}) {
+		t.Errorf("list %v", got)
+	}
+	if info, err := u.Stat(context.Background(), "/data/sub"); err != nil || !info.IsDir() {
+		t.Errorf("stat sub: %v %v", info, err)
+	}
+	if _, err := os.Stat(filepath.Join(upper, "data", "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("copied up without a write: %v", err)
+	}
+
+	// a file of a lower layer is copied up on the first write
+	f, err := u.OpenFile(context.Background(), "/data/a.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(8, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("!")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if data, _ := os.ReadFile(filepath.Join(upper, "data", "a.txt")); string(data) != "patched !" {
+		t.Errorf("copied up %q", data)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	ctx := context.Background()
+	u, upper := newUnion(t)
+	if err := u.RemoveAll(ctx, "/data/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.Stat(ctx, "/data/a.txt"); !os.IsNotExist(err) {
+		t.Errorf("stat deleted: %v", err)
+	}
+	if got := list(t, u, "/data"); !slices.Equal(got, []string{"b.txt", "sub"}) {
+		t.Errorf("list %v", got)
+	}
+	if _, err := u.Stat(ctx, "/data/.wh.a.txt"); !os.IsNotExist(err) {
+		t.Errorf("stat whiteout: %v", err)
+	}
+	putFile(t, u, "/data/a.txt", "new a")
+	if got, _ := getFile(u, "/data/a.txt"); got != "new a" {
+		t.Errorf("read recreated %q", got)
+	}
+
+	// a directory created over a deleted one hides the lower files
+	if err := u.RemoveAll(ctx, "/data/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.Stat(ctx, "/data/sub/c.txt"); !os.IsNotExist(err) {
+		t.Errorf("stat in deleted: %v", err)
+	}
+	if err := u.Mkdir(ctx, "/data/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got := list(t, u, "/data/sub"); len(got) != 0 {
+		t.Errorf("list recreated %v", got)
+	}
+	if err := u.Mkdir(ctx, "/data/sub", 0755); !os.IsExist(err) {
+		t.Errorf("mkdir existing: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(upper, "data", opaqueName)); !os.IsNotExist(err) {
+		t.Errorf("parent marked opaque: %v", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	ctx := context.Background()
+	u, _ := newUnion(t)
+	if err := u.Mkdir(ctx, "/moved", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Rename(ctx, "/data", "/moved/data"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.Stat(ctx, "/data"); !os.IsNotExist(err) {
+		t.Errorf("stat renamed: %v", err)
+	}
+	if got, _ := getFile(u, "/moved/data/sub/c.txt"); got != "golden c" {
+		t.Errorf("read moved %q", got)
+	}
+	if got := list(t, u, "/"); !slices.Equal(got, []string{"moved"}) {
+		t.Errorf("list root %v", got)
+	}
+
+	// moved back over the original directory of the lower layers
+	if err := u.RemoveAll(ctx, "/moved/data/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Rename(ctx, "/moved/data", "/data"); err != nil {
+		t.Fatal(err)
+	}
+	if got := list(t, u, "/data"); !slices.Equal(got, []string{"a.txt", "sub"}) {
+		t.Errorf("list moved back %v", got)
+	}
+	if err := u.Rename(ctx, "/data/a.txt", "/data/.wh.sub"); !os.IsPermission(err) {
+		t.Errorf("rename to a marker: %v", err)
+	}
+}
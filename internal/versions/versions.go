@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+// Package versions keeps the previous contents of the overwritten files of a
+// library in its .versions directory. The versions of a file are stored in
+// .versions/<path>/, named by the time they are replaced with the extension of
+// the file, e.g.
+// .versions/docs/a.txt/20240601T080000.000000000Z-1a2b.txt.
+package versions
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// Dir is the versions directory in the root of a library.
+const Dir = "/.versions"
+
+const timeLayout = "20060102T150405.000000000Z"
+
+// Policy limits the versions of each file.
+type Policy struct {
+	// the latest versions kept, unlimited when 0
+	Keep int
+	// the versions replaced before it are removed, never when 0
+	MaxAge time.Duration
+}
+
+// Contains reports whether the path is in the versions directory.
+func Contains(name string) bool {
+	return name == Dir || strings.HasPrefix(name, Dir+"/")
+}
+
+// Path returns the directory of the versions of a file.
+func Path(name string) string {
+	return path.Join(Dir, name)
+}
+
+// Original returns the path of the file in the library whose versions are in
+// the directory.
+func Original(dir string) string {
+	return path.Clean("/" + strings.TrimPrefix(dir, Dir))
+}
+
+// Time parses the time when the version was replaced from its name.
+func Time(version string) (time.Time, bool) {
+	if len(version) < len(timeLayout) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(timeLayout, version[:len(timeLayout)])
+	return t, err == nil
+}
+
+func newName(now time.Time, name string) string {
+	b := make([]byte, 2)
+	_, _ = rand.Read(b)
+	return now.UTC().Format(timeLayout) + "-" + hex.EncodeToString(b) + path.Ext(name)
+}
+
+// Store manages the versions of a root of a library.
+type Store struct {
+	fsys   webdav.FileSystem
+	policy Policy
+}
+
+func New(fsys webdav.FileSystem, policy Policy) *Store {
+	return &Store{fsys: fsys, policy: policy}
+}
+
+// Ensure creates the versions directory.
+func (s *Store) Ensure(ctx context.Context) error {
+	return s.mkdirAll(ctx, Dir)
+}
+
+// Save moves the file into its versions, and removes the versions beyond the
+// policy.
+func (s *Store) Save(ctx context.Context, name string) (string, error) {
+	dir := Path(name)
+	if err := s.mkdirAll(ctx, dir); err != nil {
+		return "", err
+	}
+	version := path.Join(dir, newName(time.Now(), name))
+	if err := s.fsys.Rename(ctx, name, version); err != nil {
+		return "", err
+	}
+	return version, s.prune(ctx, dir, time.Now())
+}
+
+func (s *Store) mkdirAll(ctx context.Context, dir string) error {
+	if info, err := s.fsys.Stat(ctx, dir); err == nil {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: os.ErrExist}
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if dir != "/" {
+		if err := s.mkdirAll(ctx, path.Dir(dir)); err != nil {
+			return err
+		}
+	}
+	if err := s.fsys.Mkdir(ctx, dir, 0o700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns the names of the versions of the file, the latest first.
+func (s *Store) List(ctx context.Context, name string) ([]string, error) {
+	infos, err := s.readDir(ctx, Path(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if _, ok := Time(info.Name()); ok && !info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	slices.Sort(names)
+	slices.Reverse(names)
+	return names, nil
+}
+
+func (s *Store) readDir(ctx context.Context, dir string) ([]os.FileInfo, error) {
+	f, err := s.fsys.OpenFile(ctx, dir, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(-1)
+}
+
+// prune removes the versions in the directory beyond the policy.
+func (s *Store) prune(ctx context.Context, dir string, now time.Time) error {
+	names, err := s.List(ctx, Original(dir))
+	if err != nil {
+		return err
+	}
+	for i, name := range names {
+		t, _ := Time(name)
+		if (s.policy.Keep > 0 && i >= s.policy.Keep) || (s.policy.MaxAge > 0 && now.Sub(t) > s.policy.MaxAge) {
+			if err := s.fsys.RemoveAll(ctx, path.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Expire removes the versions beyond the policy of all files, and the
+// directories left empty.
+func (s *Store) Expire(ctx context.Context) error {
+	_, err := s.expire(ctx, Dir, time.Now())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// expire returns whether the directory is left empty.
+func (s *Store) expire(ctx context.Context, dir string, now time.Time) (bool, error) {
+	if err := s.prune(ctx, dir, now); err != nil {
+		return false, err
+	}
+	infos, err := s.readDir(ctx, dir)
+	if err != nil {
+		return false, err
+	}
+	left := len(infos)
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		child := path.Join(dir, info.Name())
+		empty, err := s.expire(ctx, child, now)
+		if err != nil {
+			return false, err
+		}
+		if empty {
+			if err := s.fsys.RemoveAll(ctx, child); err != nil {
+				return false, err
+			}
+			left--
+		}
+	}
+	return left == 0, nil
+}
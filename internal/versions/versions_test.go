@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2024 llklkl
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ *
+ */
+package versions
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func writeFile(t *testing.T, fsys webdav.FileSystem, name, data string) {
+	t.Helper()
+	f, err := fsys.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func readFile(t *testing.T, fsys webdav.FileSystem, name string) string {
+	t.Helper()
+	f, err := fsys.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	fsys := webdav.NewMemFS()
+	store := New(fsys, Policy{Keep: 2})
+	if err := fsys.Mkdir(ctx, "/docs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"v1", "v2", "v3"} {
+		writeFile(t, fsys, "/docs/a.txt", data)
+		if _, err := store.Save(ctx, "/docs/a.txt"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fsys.Stat(ctx, "/docs/a.txt"); !os.IsNotExist(err) {
+		t.Errorf("stat saved: %v", err)
+	}
+
+	names, err := store.List(ctx, "/docs/a.txt")
+	if err != nil || len(names) != 2 {
+		t.Fatalf("list: %v %v", names, err)
+	}
+	if got := readFile(t, fsys, path.Join(Path("/docs/a.txt"), names[0])); got != "v3" {
+		t.Errorf("latest version %q", got)
+	}
+	if got := readFile(t, fsys, path.Join(Path("/docs/a.txt"), names[1])); got != "v2" {
+		t.Errorf("previous version %q", got)
+	}
+	if path.Ext(names[0]) != ".txt" {
+		t.Errorf("version %s without the extension", names[0])
+	}
+	if ts, ok := Time(names[0]); !ok || time.Since(ts) > time.Minute {
+		t.Errorf("time of %s: %v", names[0], ts)
+	}
+	if got := Original(Path("/docs/a.txt")); got != "/docs/a.txt" {
+		t.Errorf("original %s", got)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	ctx := context.Background()
+	fsys := webdav.NewMemFS()
+	store := New(fsys, Policy{MaxAge: time.Hour})
+	writeFile(t, fsys, "/a.txt", "new")
+	if _, err := store.Save(ctx, "/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.mkdirAll(ctx, Path("/old/b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fsys, path.Join(Path("/old/b.txt"), newName(time.Now().Add(-2*time.Hour), "b.txt")), "old")
+
+	if err := store.Expire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := store.List(ctx, "/a.txt"); len(names) != 1 {
+		t.Errorf("versions of a.txt %v", names)
+	}
+	if _, err := fsys.Stat(ctx, Path("/old")); !os.IsNotExist(err) {
+		t.Errorf("empty directory left: %v", err)
+	}
+	if err := New(webdav.NewMemFS(), Policy{}).Expire(ctx); err != nil {
+		t.Errorf("expire without versions: %v", err)
+	}
+}